@@ -0,0 +1,76 @@
+// Package atomicfile publishes files by writing them to a temporary file next to the
+// target and renaming that over the target, so readers only ever see complete files.
+package atomicfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// File is a temporary file that replaces its target on Commit.
+type File struct {
+	*os.File
+	path string
+	sync bool
+}
+
+// Create opens a temporary file in the same directory as path, so the final rename
+// stays within one filesystem. With sync set, Commit fsyncs the file and the directory.
+func Create(path string, sync bool) (*File, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	// CreateTemp uses 0600, match what os.Create would have given the target
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &File{File: f, path: path, sync: sync}, nil
+}
+
+// Commit renames the temporary file over the target. It does not close the file,
+// which may still be in use for reading.
+func (f *File) Commit() error {
+	if f.sync {
+		if err := f.File.Sync(); err != nil {
+			return fmt.Errorf("sync: %w", err)
+		}
+	}
+	if err := os.Rename(f.File.Name(), f.path); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	if f.sync {
+		if err := SyncDir(filepath.Dir(f.path)); err != nil {
+			return fmt.Errorf("sync dir: %w", err)
+		}
+	}
+	return nil
+}
+
+// Abort closes and removes the temporary file, leaving the target untouched.
+func (f *File) Abort() {
+	_ = f.File.Close()
+	_ = os.Remove(f.File.Name())
+}
+
+// Remove removes the temporary file without closing it, for when whoever took over the
+// file has closed it already.
+func (f *File) Remove() {
+	_ = os.Remove(f.File.Name())
+}
+
+// SyncDir fsyncs a directory, making renames and creations within it durable.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
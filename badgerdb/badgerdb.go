@@ -1,10 +1,14 @@
 package badgerdb
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
 	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/pb"
+	"github.com/dgraph-io/ristretto/v2/z"
+	"github.com/perbu/db-shootout/durability"
 	"github.com/perbu/db-shootout/keyset"
 )
 
@@ -13,41 +17,130 @@ type BadgerDB struct {
 	dirsize  int
 	current  int
 	db       *badger.DB
+	mode     durability.Mode
+	data     *keyset.Dataset
+	bulk     bool
+	profile  Profile
+
+	// iteration state for Next
+	txn      *badger.Txn
+	iter     *badger.Iterator
+	iterDone bool
+}
+
+// Option configures a BadgerDB.
+type Option func(*BadgerDB)
+
+// WithDurability selects when writes are synced to disk.
+func WithDurability(mode durability.Mode) Option {
+	return func(b *BadgerDB) {
+		b.mode = mode
+	}
+}
+
+// WithDataset populates the store from a pre-generated dataset instead of generating
+// entries while writing.
+func WithDataset(data *keyset.Dataset) Option {
+	return func(b *BadgerDB) {
+		b.data = data
+	}
+}
+
+// WithBulkLoad makes CreateFolder write the entries in key order through a StreamWriter,
+// which builds the LSM tables directly instead of going through the memtable.
+func WithBulkLoad() Option {
+	return func(b *BadgerDB) {
+		b.bulk = true
+	}
 }
 
-func New(filename string, dirsize int) *BadgerDB {
-	return &BadgerDB{
+func New(filename string, dirsize int, opts ...Option) *BadgerDB {
+	b := &BadgerDB{
 		filename: filename,
 		dirsize:  dirsize,
 	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
 }
 
-func (b *BadgerDB) OpenReadOnly() error {
-	opts := badger.DefaultOptions(b.filename).WithReadOnly(true)
+// options returns the options of the profile, with logging off.
+func (b *BadgerDB) options() badger.Options {
+	opts := b.profile.apply(badger.DefaultOptions(b.filename))
 	opts.Logger = nil
-	db, err := badger.Open(opts)
+	return opts
+}
+
+// openWritable opens the database for writing. Only per-op durability syncs every write.
+func (b *BadgerDB) openWritable() (*badger.DB, error) {
+	if b.profile.InMemory && b.db != nil {
+		return b.db, nil
+	}
+	return badger.Open(b.options().WithSyncWrites(b.mode == durability.PerOp))
+}
+
+// syncBatches reports whether batches are synced explicitly. An in-memory database has
+// nothing to sync.
+func (b *BadgerDB) syncBatches() bool {
+	return b.mode == durability.PerBatch && !b.profile.InMemory
+}
+
+func (b *BadgerDB) OpenReadOnly() error {
+	if b.profile.InMemory {
+		if b.db == nil {
+			return fmt.Errorf("open badger: in-memory database has not been created")
+		}
+		b.closeIter()
+		b.iterDone = false
+		return nil
+	}
+	db, err := badger.Open(b.options().WithReadOnly(true))
 	if err != nil {
 		return fmt.Errorf("open badger: %w", err)
 	}
 	b.db = db
+	b.iterDone = false
 	return nil
 }
 
-func (b *BadgerDB) CreateFolder() error {
-	opts := badger.DefaultOptions(b.filename)
-	opts.Logger = nil
-	db, err := badger.Open(opts)
+func (b *BadgerDB) CreateFolder() (err error) {
+	db, err := b.openWritable()
 	if err != nil {
 		return fmt.Errorf("create badger: %w", err)
 	}
 	b.db = db
+	// a failed create does not leave the database open
+	defer func() {
+		if err != nil {
+			_ = b.Close()
+		}
+	}()
+
+	if b.bulk {
+		if err := b.stream(); err != nil {
+			return fmt.Errorf("bulk load: %w", err)
+		}
+		b.current = 0
+		return nil
+	}
+
+	if b.mode == durability.PerOp {
+		for i := 0; i < b.dirsize; i++ {
+			if err := b.Put(b.data.Key(i), b.data.Value(i)); err != nil {
+				return err
+			}
+		}
+		b.current = 0
+		return nil
+	}
 
 	wb := db.NewWriteBatch()
 	defer wb.Cancel()
 
 	for i := 0; i < b.dirsize; i++ {
-		key := []byte(keyset.GenerateKey(i))
-		val := []byte(keyset.GenerateRandomContent(64))
+		key := b.data.KeyBytes(i)
+		val := b.data.ValueBytes(i)
 		if err := wb.Set(key, val); err != nil {
 			return fmt.Errorf("set: %w", err)
 		}
@@ -56,12 +149,110 @@ func (b *BadgerDB) CreateFolder() error {
 	if err := wb.Flush(); err != nil {
 		return fmt.Errorf("flush: %w", err)
 	}
+	if b.syncBatches() {
+		if err := db.Sync(); err != nil {
+			return fmt.Errorf("sync: %w", err)
+		}
+	}
 
 	b.current = 0
 	return nil
 }
 
+// stream writes every entry through a StreamWriter, which replaces the contents of the
+// database. Flush syncs the tables whatever the durability mode.
+func (b *BadgerDB) stream() error {
+	sw := b.db.NewStreamWriter()
+	if err := sw.Prepare(); err != nil {
+		return fmt.Errorf("prepare: %w", err)
+	}
+	buf := z.NewBuffer(1<<20, "shootout.bulk")
+	defer buf.Release()
+	for _, i := range b.data.Sorted(b.dirsize) {
+		badger.KVToBuffer(&pb.KV{
+			Key:     b.data.KeyBytes(i),
+			Value:   b.data.ValueBytes(i),
+			Version: 1,
+		}, buf)
+	}
+	if err := sw.Write(buf); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	if err := sw.Flush(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	return nil
+}
+
+// OpenReadWrite opens (or creates) the database for incremental updates via Put.
+func (b *BadgerDB) OpenReadWrite() error {
+	db, err := b.openWritable()
+	if err != nil {
+		return fmt.Errorf("open badger: %w", err)
+	}
+	b.db = db
+	return nil
+}
+
+// Put stores a single entry in its own transaction.
+func (b *BadgerDB) Put(key, value string) error {
+	if b.db == nil {
+		return fmt.Errorf("database is not open")
+	}
+	err := b.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), []byte(value))
+	})
+	if err != nil {
+		return fmt.Errorf("set: %w", err)
+	}
+	// a single Put is a batch of one
+	if b.syncBatches() {
+		if err := b.db.Sync(); err != nil {
+			return fmt.Errorf("sync: %w", err)
+		}
+	}
+	return nil
+}
+
+// Settle brings a freshly written database into its steady-state shape: the memtable is
+// flushed by closing and reopening the database, every table is compacted into one level
+// and the value log is garbage collected. It needs the database open for writing.
+func (b *BadgerDB) Settle() error {
+	if b.db == nil {
+		return fmt.Errorf("database is not open")
+	}
+	b.closeIter()
+	if !b.profile.InMemory {
+		// badger has no explicit memtable flush, but Close writes it out as a table
+		if err := b.db.Close(); err != nil {
+			b.db = nil
+			return fmt.Errorf("close: %w", err)
+		}
+		db, err := b.openWritable()
+		b.db = db
+		if err != nil {
+			return fmt.Errorf("reopen badger: %w", err)
+		}
+	}
+	if err := b.db.Flatten(1); err != nil {
+		return fmt.Errorf("flatten: %w", err)
+	}
+	if b.profile.InMemory {
+		return nil // no value log
+	}
+	for {
+		err := b.db.RunValueLogGC(0.5)
+		if errors.Is(err, badger.ErrNoRewrite) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("value log gc: %w", err)
+		}
+	}
+}
+
 func (b *BadgerDB) Delete() error {
+	b.closeIter()
 	if b.db != nil {
 		if err := b.db.Close(); err != nil {
 			return fmt.Errorf("close before delete: %w", err)
@@ -72,6 +263,12 @@ func (b *BadgerDB) Delete() error {
 }
 
 func (b *BadgerDB) Close() error {
+	// badger waits for open transactions before closing
+	b.closeIter()
+	if b.profile.InMemory {
+		// closing would drop the data, Delete does that
+		return nil
+	}
 	if b.db != nil {
 		err := b.db.Close()
 		b.db = nil
@@ -80,13 +277,105 @@ func (b *BadgerDB) Close() error {
 	return nil
 }
 
+// Next returns the next key of the database, walking it with a key-only iterator in key order.
 func (b *BadgerDB) Next() (string, bool, error) {
-	if b.current >= b.dirsize {
+	if b.iterDone {
+		return "", false, nil
+	}
+	if b.db == nil {
+		return "", false, fmt.Errorf("database is not open")
+	}
+	if b.iter == nil {
+		b.txn = b.db.NewTransaction(false)
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		b.iter = b.txn.NewIterator(opts)
+		b.iter.Rewind()
+	} else {
+		b.iter.Next()
+	}
+	if !b.iter.Valid() {
+		b.closeIter()
+		b.iterDone = true
 		return "", false, nil
 	}
-	entry := keyset.GenerateKey(b.current)
 	b.current++
-	return entry, true, nil
+	return string(b.iter.Item().Key()), true, nil
+}
+
+// PrefixScan returns the keys starting with prefix in key order, with a key-only iterator
+// restricted to the prefix.
+func (b *BadgerDB) PrefixScan(prefix string) ([]string, error) {
+	if b.db == nil {
+		return nil, fmt.Errorf("database is not open")
+	}
+	var keys []string
+	err := b.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(prefix)
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Seek(opts.Prefix); iter.ValidForPrefix(opts.Prefix); iter.Next() {
+			keys = append(keys, string(iter.Item().Key()))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("view: %w", err)
+	}
+	return keys, nil
+}
+
+// ReadPage returns up to limit keys after cursor in key order, and the cursor of the next
+// page, which is the last key returned. Each page seeks a fresh iterator past the cursor.
+// The next cursor is empty after the last page.
+func (b *BadgerDB) ReadPage(cursor string, limit int) ([]string, string, error) {
+	if b.db == nil {
+		return nil, "", fmt.Errorf("database is not open")
+	}
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	keys := make([]string, 0, limit)
+	var next string
+	err := b.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Seek([]byte(keyset.KeyAfter(cursor))); iter.Valid(); iter.Next() {
+			if len(keys) == limit {
+				next = keys[limit-1]
+				break
+			}
+			keys = append(keys, string(iter.Item().Key()))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return keys, next, nil
+}
+
+// Rewind makes Next start over from the first key, without reopening the database.
+func (b *BadgerDB) Rewind() {
+	b.closeIter()
+	b.iterDone = false
+}
+
+// closeIter closes the iterator of Next and its transaction, if any.
+func (b *BadgerDB) closeIter() {
+	if b.iter != nil {
+		b.iter.Close()
+		b.iter = nil
+	}
+	if b.txn != nil {
+		b.txn.Discard()
+		b.txn = nil
+	}
+	b.current = 0
 }
 
 func (b *BadgerDB) Lookup(index int, valid bool) (string, error) {
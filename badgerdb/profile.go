@@ -0,0 +1,77 @@
+package badgerdb
+
+import (
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/options"
+)
+
+// Profile is a set of badger options. Zero fields keep badger.DefaultOptions: 64 MiB
+// memtables, values up to 1 MiB stored in the LSM tree, snappy compression and a
+// 256 MiB block cache.
+type Profile struct {
+	Name           string
+	MemTableSize   int64 // bytes per memtable
+	NumMemtables   int
+	ValueThreshold int64 // values at least this large go to the value log
+	ValueLogSize   int64 // bytes per value log file
+	BlockCacheSize int64 // bytes, -1 disables the cache
+	NoCompression  bool
+	InMemory       bool // keep everything in memory, nothing is written to disk
+}
+
+var (
+	// ProfileDefault is badger.DefaultOptions.
+	ProfileDefault = Profile{Name: "default"}
+	// ProfileLowMemory shrinks the memtables, value log files and block cache.
+	ProfileLowMemory = Profile{Name: "low-memory", MemTableSize: 4 << 20, NumMemtables: 2,
+		ValueThreshold: 1 << 10, ValueLogSize: 16 << 20, BlockCacheSize: 8 << 20}
+	// ProfileValueLog moves every value out of the LSM tree into the value log.
+	ProfileValueLog = Profile{Name: "value-log", ValueThreshold: 32}
+	// ProfileNoCompression stores table blocks uncompressed.
+	ProfileNoCompression = Profile{Name: "no-compression", NoCompression: true}
+	// ProfileNoCache stores table blocks uncompressed and doesn't cache them,
+	// badger only runs without a block cache when nothing is compressed.
+	ProfileNoCache = Profile{Name: "no-cache", NoCompression: true, BlockCacheSize: -1}
+	// ProfileInMemory never touches the disk.
+	ProfileInMemory = Profile{Name: "in-memory", InMemory: true}
+
+	// Profiles lists the predefined profiles, for benchmarks.
+	Profiles = []Profile{ProfileDefault, ProfileLowMemory, ProfileValueLog, ProfileNoCompression, ProfileNoCache, ProfileInMemory}
+)
+
+// WithProfile opens the database with the options of profile. An in-memory database
+// can't be reopened: it stays open from CreateFolder until Delete, Close leaves it alone
+// and OpenReadOnly carries on using it.
+func WithProfile(profile Profile) Option {
+	return func(b *BadgerDB) {
+		b.profile = profile
+	}
+}
+
+// apply returns opts changed by the profile.
+func (p Profile) apply(opts badger.Options) badger.Options {
+	if p.MemTableSize > 0 {
+		opts = opts.WithMemTableSize(p.MemTableSize)
+	}
+	if p.NumMemtables > 0 {
+		opts = opts.WithNumMemtables(p.NumMemtables)
+	}
+	if p.ValueThreshold > 0 {
+		opts = opts.WithValueThreshold(p.ValueThreshold)
+	}
+	if p.ValueLogSize > 0 {
+		opts = opts.WithValueLogFileSize(p.ValueLogSize)
+	}
+	if p.BlockCacheSize > 0 {
+		opts = opts.WithBlockCacheSize(p.BlockCacheSize)
+	} else if p.BlockCacheSize < 0 {
+		opts = opts.WithBlockCacheSize(0)
+	}
+	if p.NoCompression {
+		opts = opts.WithCompression(options.None)
+	}
+	if p.InMemory {
+		opts = opts.WithDir("").WithValueDir("").WithInMemory(true)
+	}
+	return opts
+}
@@ -2,13 +2,14 @@ package main
 
 import (
 	"math/rand"
+	"path/filepath"
 	"testing"
 
 	"github.com/perbu/db-shootout/badgerdb"
 )
 
 func BenchmarkCreateFolderBadger(b *testing.B) {
-	db := badgerdb.New("test.badger", dirsize)
+	db := badgerdb.New("test.badger", dirsize, badgerdb.WithDataset(dataset))
 	for i := 0; i < b.N; i++ {
 		if err := db.CreateFolder(); err != nil {
 			b.Fatalf("create folder: %v", err)
@@ -74,3 +75,77 @@ func BenchmarkReaddirBadger(b *testing.B) {
 		b.Fatalf("delete: %v", err)
 	}
 }
+
+// BenchmarkCreateFolderBadgerProfile reports the time and allocations of CreateFolder per profile.
+func BenchmarkCreateFolderBadgerProfile(b *testing.B) {
+	for _, profile := range badgerdb.Profiles {
+		b.Run(profile.Name, func(b *testing.B) {
+			db := badgerdb.New(filepath.Join(b.TempDir(), "test.badger"), dirsize,
+				badgerdb.WithProfile(profile), badgerdb.WithDataset(dataset))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := db.CreateFolder(); err != nil {
+					b.Fatalf("create folder: %v", err)
+				}
+				if err := db.Delete(); err != nil {
+					b.Fatalf("delete: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkLookupBadgerProfile looks up existing keys per profile.
+func BenchmarkLookupBadgerProfile(b *testing.B) {
+	for _, profile := range badgerdb.Profiles {
+		b.Run(profile.Name, func(b *testing.B) {
+			db := badgerdb.New(filepath.Join(b.TempDir(), "test.badger"), dirsize,
+				badgerdb.WithProfile(profile), badgerdb.WithDataset(dataset))
+			if err := db.CreateFolder(); err != nil {
+				b.Fatalf("create folder: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				b.Fatalf("close: %v", err)
+			}
+			if err := db.OpenReadOnly(); err != nil {
+				b.Fatalf("open readonly: %v", err)
+			}
+			defer db.Delete()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Lookup(rand.Intn(dirsize), true); err != nil {
+					b.Fatalf("lookup valid: %v", err)
+				}
+			}
+			b.StopTimer()
+		})
+	}
+}
+
+// TestBadgerProfiles checks that every profile survives a close and reopen.
+func TestBadgerProfiles(t *testing.T) {
+	for _, profile := range badgerdb.Profiles {
+		t.Run(profile.Name, func(t *testing.T) {
+			db := badgerdb.New(filepath.Join(t.TempDir(), "test.badger"), dirsize,
+				badgerdb.WithProfile(profile), badgerdb.WithDataset(dataset))
+			if err := db.CreateFolder(); err != nil {
+				t.Fatalf("create folder: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+			if err := db.OpenReadOnly(); err != nil {
+				t.Fatalf("open readonly: %v", err)
+			}
+			defer db.Delete()
+			for _, i := range []int{0, dirsize / 2, dirsize - 1} {
+				if value, err := db.Lookup(i, true); err != nil || value != dataset.Value(i) {
+					t.Fatalf("lookup %d got %q, %v, want %q", i, value, err, dataset.Value(i))
+				}
+			}
+			if _, err := db.Lookup(0, false); err == nil {
+				t.Fatalf("lookup of an invalid key succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,560 @@
+// Package bitcask stores the folder the way Bitcask does: every put and removal is
+// appended to a data file, and an in-memory hash index, the keydir, maps each live key to
+// the position of its latest value. Lookups are a map access and one read.
+//
+// Opening a bitcask rebuilds the keydir. On Close a writable handle writes a hint file
+// holding the keydir, so the next open can load it instead of scanning the whole data
+// file. Merge rewrites the data file with only the live entries.
+package bitcask
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/perbu/db-shootout/atomicfile"
+	"github.com/perbu/db-shootout/durability"
+	"github.com/perbu/db-shootout/keyset"
+)
+
+const (
+	dataName = "data"
+	hintName = "hint"
+
+	opPut    byte = 1
+	opRemove byte = 2
+)
+
+// location is where the latest value of a key sits in the data file.
+type location struct {
+	offset int64  // of the value
+	size   uint32 // of the value
+	record uint32 // size of the whole record, counted as dead once the key is overwritten
+}
+
+// Bitcask implements the BenchmarkDB interface with an append-only data file.
+type Bitcask struct {
+	dirname string
+	dirsize int
+	mode    durability.Mode
+	data    *keyset.Dataset
+	hints   bool
+
+	f        *os.File
+	w        *bufio.Writer // nil on read-only handles
+	size     int64         // bytes in the data file, including what w still buffers
+	dead     int64         // bytes of overwritten and removed records
+	keydir   map[string]location
+	dirty    bool     // the keydir has changed since the hint was written
+	listing  []string // keys for Next, taken from the keydir on the first call
+	sorted   []string // keys in order for ReadPage, taken from the keydir on the first call
+	current  int
+	listDone bool
+}
+
+// Option configures a Bitcask.
+type Option func(*Bitcask)
+
+// WithDurability selects when the data file is fsynced. Per-batch fsyncs at the end of
+// Populate, Merge and Close, per-op also after every Put and Remove.
+func WithDurability(mode durability.Mode) Option {
+	return func(b *Bitcask) {
+		b.mode = mode
+	}
+}
+
+// WithDataset populates the store from a pre-generated dataset instead of generating
+// entries while writing.
+func WithDataset(data *keyset.Dataset) Option {
+	return func(b *Bitcask) {
+		b.data = data
+	}
+}
+
+// WithoutHints neither writes nor reads hint files, so every open scans the data file.
+func WithoutHints() Option {
+	return func(b *Bitcask) {
+		b.hints = false
+	}
+}
+
+// New creates a new Bitcask keeping its files in the directory dirname.
+func New(dirname string, dirsize int, opts ...Option) *Bitcask {
+	b := &Bitcask{
+		dirname: dirname,
+		dirsize: dirsize,
+		hints:   true,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+func (b *Bitcask) dataPath() string {
+	return filepath.Join(b.dirname, dataName)
+}
+
+func (b *Bitcask) hintPath() string {
+	return filepath.Join(b.dirname, hintName)
+}
+
+// OpenReadOnly opens the data file and rebuilds the keydir.
+func (b *Bitcask) OpenReadOnly() error {
+	f, err := os.Open(b.dataPath())
+	if err != nil {
+		return fmt.Errorf("open bitcask: %w", err)
+	}
+	if _, err := b.load(f); err != nil {
+		f.Close()
+		return err
+	}
+	b.f = f
+	return nil
+}
+
+// OpenReadWrite opens the data file for Put and Remove, creating it if needed. A torn
+// record at the end of the file, left by a crash, is cut off.
+func (b *Bitcask) OpenReadWrite() error {
+	if err := os.MkdirAll(b.dirname, 0o755); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+	f, err := os.OpenFile(b.dataPath(), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("open bitcask: %w", err)
+	}
+	valid, err := b.load(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return fmt.Errorf("truncate: %w", err)
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return fmt.Errorf("seek: %w", err)
+	}
+	b.f = f
+	b.w = bufio.NewWriter(f)
+	return nil
+}
+
+// load rebuilds the keydir from the hint file, if there is a usable one, and the part of
+// the data file written after it. It returns the offset just past the last complete record.
+func (b *Bitcask) load(f *os.File) (int64, error) {
+	b.keydir = nil
+	b.size, b.dead = 0, 0
+	if b.hints {
+		if err := b.readHint(); err != nil {
+			// a missing or damaged hint only costs a full scan
+			b.keydir = nil
+			b.size, b.dead = 0, 0
+		}
+	}
+	if b.keydir == nil {
+		b.keydir = make(map[string]location)
+	}
+	// readHint has checked that the hint doesn't run past the data file
+	valid, err := b.replay(f, b.size)
+	if err != nil {
+		return 0, fmt.Errorf("replay: %w", err)
+	}
+	b.size = valid
+	b.dirty = false
+	b.resetListing()
+	return valid, nil
+}
+
+// replay applies every complete record from offset on to the keydir and returns the
+// offset just past the last one.
+func (b *Bitcask) replay(f *os.File, offset int64) (int64, error) {
+	r := bufio.NewReaderSize(io.NewSectionReader(f, offset, 1<<62), 1<<16)
+	for {
+		op, key, n, headerLen, vlen, err := readRecord(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errChecksum) {
+				return offset, nil
+			}
+			return 0, err
+		}
+		b.apply(op, key, location{
+			offset: offset + int64(headerLen) + int64(len(key)),
+			size:   uint32(vlen),
+			record: uint32(n),
+		})
+		offset += n
+	}
+}
+
+var errChecksum = errors.New("checksum mismatch")
+
+// A record is the op, the key and value lengths as uvarints, the key, the value and a
+// CRC32 of everything before it. readRecord returns the op, the key, the size of the
+// record, the size of its header and the length of its value.
+func readRecord(r *bufio.Reader) (byte, string, int64, int, uint64, error) {
+	op, err := r.ReadByte()
+	if err != nil {
+		return 0, "", 0, 0, 0, err
+	}
+	klen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, "", 0, 0, 0, io.ErrUnexpectedEOF
+	}
+	vlen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, "", 0, 0, 0, io.ErrUnexpectedEOF
+	}
+	if klen+vlen > 1<<30 {
+		return 0, "", 0, 0, 0, errChecksum
+	}
+	buf := make([]byte, klen+vlen+4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, "", 0, 0, 0, io.ErrUnexpectedEOF
+	}
+	header := encodeHeader(op, klen, vlen)
+	crc := crc32.Update(crc32.ChecksumIEEE(header), crc32.IEEETable, buf[:klen+vlen])
+	if crc != binary.LittleEndian.Uint32(buf[klen+vlen:]) {
+		return 0, "", 0, 0, 0, errChecksum
+	}
+	return op, string(buf[:klen]), int64(len(header) + len(buf)), len(header), vlen, nil
+}
+
+func encodeHeader(op byte, klen, vlen uint64) []byte {
+	header := make([]byte, 1, 1+2*binary.MaxVarintLen64)
+	header[0] = op
+	header = binary.AppendUvarint(header, klen)
+	return binary.AppendUvarint(header, vlen)
+}
+
+// apply updates the keydir with a record, counting the records it makes dead.
+func (b *Bitcask) apply(op byte, key string, loc location) {
+	if old, ok := b.keydir[key]; ok {
+		b.dead += int64(old.record)
+	} else {
+		b.sorted = nil
+	}
+	switch op {
+	case opPut:
+		b.keydir[key] = loc
+	case opRemove:
+		delete(b.keydir, key)
+		b.sorted = nil
+		// the tombstone itself is only needed until a merge
+		b.dead += int64(loc.record)
+	}
+}
+
+// append writes one record and applies it to the keydir.
+func (b *Bitcask) append(op byte, key, value string) error {
+	if b.w == nil {
+		return fmt.Errorf("bitcask is not open for writing")
+	}
+	header := encodeHeader(op, uint64(len(key)), uint64(len(value)))
+	crc := crc32.ChecksumIEEE(header)
+	crc = crc32.Update(crc, crc32.IEEETable, []byte(key))
+	crc = crc32.Update(crc, crc32.IEEETable, []byte(value))
+	b.w.Write(header)
+	b.w.WriteString(key)
+	b.w.WriteString(value)
+	// bufio.Writer keeps the first error and returns it from every later call
+	if _, err := b.w.Write(binary.LittleEndian.AppendUint32(nil, crc)); err != nil {
+		return fmt.Errorf("append: %w", err)
+	}
+	n := int64(len(header) + len(key) + len(value) + 4)
+	b.apply(op, key, location{
+		offset: b.size + int64(len(header)+len(key)),
+		size:   uint32(len(value)),
+		record: uint32(n),
+	})
+	b.size += n
+	b.dirty = true
+	// apply has dropped ReadPage's sorted keys if the key set changed, and Next carries
+	// on with its snapshot
+	return nil
+}
+
+// sync flushes buffered records and, with durable set, fsyncs the data file.
+func (b *Bitcask) sync(durable bool) error {
+	if err := b.w.Flush(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	if durable {
+		if err := b.f.Sync(); err != nil {
+			return fmt.Errorf("sync: %w", err)
+		}
+	}
+	return nil
+}
+
+// Put appends a new value for key.
+func (b *Bitcask) Put(key, value string) error {
+	if err := b.append(opPut, key, value); err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	if b.mode == durability.PerOp {
+		return b.sync(true)
+	}
+	return nil
+}
+
+// Remove appends a tombstone for key.
+func (b *Bitcask) Remove(key string) error {
+	if err := b.append(opRemove, key, ""); err != nil {
+		return fmt.Errorf("remove: %w", err)
+	}
+	if b.mode == durability.PerOp {
+		return b.sync(true)
+	}
+	return nil
+}
+
+// CreateFolder replaces the directory with a fresh data file holding dirsize entries,
+// and writes its hint file.
+func (b *Bitcask) CreateFolder() error {
+	if err := os.RemoveAll(b.dirname); err != nil {
+		return fmt.Errorf("remove directory: %w", err)
+	}
+	if err := b.OpenReadWrite(); err != nil {
+		return err
+	}
+	if err := b.Populate(); err != nil {
+		b.Close()
+		return fmt.Errorf("populate: %w", err)
+	}
+	if err := b.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+	return nil
+}
+
+// Populate appends dirsize entries to a bitcask open for writing.
+func (b *Bitcask) Populate() error {
+	for i := 0; i < b.dirsize; i++ {
+		if err := b.append(opPut, b.data.Key(i), b.data.Value(i)); err != nil {
+			return err
+		}
+	}
+	return b.sync(b.mode != durability.None)
+}
+
+// Merge rewrites the data file with only the live entries, in key order, and writes a
+// fresh hint file for it. The new data file replaces the old one atomically.
+func (b *Bitcask) Merge() error {
+	if b.w == nil {
+		return fmt.Errorf("bitcask is not open for writing")
+	}
+	if err := b.sync(false); err != nil {
+		return err
+	}
+	durable := b.mode != durability.None
+	out, err := atomicfile.Create(b.dataPath(), durable)
+	if err != nil {
+		return fmt.Errorf("create data file: %w", err)
+	}
+	keys := make([]string, 0, len(b.keydir))
+	for key := range b.keydir {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	merged := &Bitcask{mode: b.mode, f: out.File, w: bufio.NewWriter(out.File), keydir: make(map[string]location, len(keys))}
+	for _, key := range keys {
+		loc := b.keydir[key]
+		value := make([]byte, loc.size)
+		if _, err := b.f.ReadAt(value, loc.offset); err != nil {
+			out.Abort()
+			return fmt.Errorf("read %s: %w", key, err)
+		}
+		if err := merged.append(opPut, key, string(value)); err != nil {
+			out.Abort()
+			return err
+		}
+	}
+	if err := merged.w.Flush(); err != nil {
+		out.Abort()
+		return fmt.Errorf("flush: %w", err)
+	}
+	// the old hint points into the old data file, it must not outlive it
+	if err := os.Remove(b.hintPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		out.Abort()
+		return fmt.Errorf("remove hint: %w", err)
+	}
+	if err := out.Commit(); err != nil {
+		out.Abort()
+		return fmt.Errorf("publish: %w", err)
+	}
+	// the file handle now refers to the new data file
+	_ = b.f.Close()
+	b.f = out.File
+	b.w = merged.w
+	b.keydir = merged.keydir
+	b.size, b.dead = merged.size, 0
+	b.dirty = true
+	b.resetListing()
+	if _, err := b.f.Seek(b.size, io.SeekStart); err != nil {
+		return fmt.Errorf("seek: %w", err)
+	}
+	return b.writeHint()
+}
+
+// Dead returns the number of bytes in the data file taken up by overwritten and removed
+// entries, which a Merge would reclaim.
+func (b *Bitcask) Dead() int64 {
+	return b.dead
+}
+
+// Delete removes the directory and every file in it.
+func (b *Bitcask) Delete() error {
+	if err := b.Close(); err != nil {
+		return err
+	}
+	return os.RemoveAll(b.dirname)
+}
+
+// Close closes the data file. A writable handle syncs the data file first and, if the
+// keydir changed, writes a hint file for the next open.
+func (b *Bitcask) Close() error {
+	if b.f == nil {
+		return nil
+	}
+	var err error
+	if b.w != nil {
+		err = b.sync(b.mode != durability.None)
+		if err == nil && b.dirty {
+			err = b.writeHint()
+		}
+	}
+	if closeErr := b.f.Close(); err == nil {
+		err = closeErr
+	}
+	b.f, b.w = nil, nil
+	b.keydir = nil
+	b.resetListing()
+	return err
+}
+
+func (b *Bitcask) resetListing() {
+	b.listing, b.sorted = nil, nil
+	b.current = 0
+	b.listDone = false
+}
+
+// Next returns the live keys in keydir order, which is no order in particular. The keys
+// are a snapshot taken on the first call: keys put since are not listed, keys removed
+// since are skipped.
+func (b *Bitcask) Next() (string, bool, error) {
+	if b.keydir == nil {
+		return "", false, fmt.Errorf("database is not open")
+	}
+	if b.listDone {
+		return "", false, nil
+	}
+	if b.listing == nil {
+		b.listing = make([]string, 0, len(b.keydir))
+		for key := range b.keydir {
+			b.listing = append(b.listing, key)
+		}
+	}
+	for b.current < len(b.listing) {
+		key := b.listing[b.current]
+		b.current++
+		if _, ok := b.keydir[key]; ok {
+			return key, true, nil
+		}
+	}
+	b.listDone = true
+	return "", false, nil
+}
+
+// PrefixScan returns the live keys starting with prefix. The keydir is a hash index, so
+// this scans every key, in no particular order.
+func (b *Bitcask) PrefixScan(prefix string) ([]string, error) {
+	if b.keydir == nil {
+		return nil, fmt.Errorf("database is not open")
+	}
+	var keys []string
+	for key := range b.keydir {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// ReadPage returns up to limit keys after cursor in key order, and the cursor of the next
+// page, which is the last key returned. The keydir has no order, so the first call sorts
+// its keys, and the following pages binary-search them until the key set changes. The
+// next cursor is empty after the last page.
+func (b *Bitcask) ReadPage(cursor string, limit int) ([]string, string, error) {
+	if b.keydir == nil {
+		return nil, "", fmt.Errorf("database is not open")
+	}
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	if b.sorted == nil {
+		b.sorted = make([]string, 0, len(b.keydir))
+		for key := range b.keydir {
+			b.sorted = append(b.sorted, key)
+		}
+		slices.Sort(b.sorted)
+	}
+	i, _ := slices.BinarySearch(b.sorted, keyset.KeyAfter(cursor))
+	end := min(i+limit, len(b.sorted))
+	keys := slices.Clone(b.sorted[i:end])
+	if end == len(b.sorted) {
+		return keys, "", nil
+	}
+	return keys, keys[len(keys)-1], nil
+}
+
+// Get returns the value of key and whether it exists.
+func (b *Bitcask) Get(key string) (string, bool, error) {
+	if b.keydir == nil {
+		return "", false, fmt.Errorf("database is not open")
+	}
+	loc, ok := b.keydir[key]
+	if !ok {
+		return "", false, nil
+	}
+	if b.w != nil && b.w.Buffered() > 0 {
+		if err := b.w.Flush(); err != nil {
+			return "", false, fmt.Errorf("flush: %w", err)
+		}
+	}
+	value := make([]byte, loc.size)
+	if _, err := b.f.ReadAt(value, loc.offset); err != nil {
+		return "", false, fmt.Errorf("read: %w", err)
+	}
+	return string(value), true, nil
+}
+
+// Lookup retrieves the content of the entry at the given index.
+func (b *Bitcask) Lookup(index int, valid bool) (string, error) {
+	if index < 0 || index >= b.dirsize {
+		return "", fmt.Errorf("index out of bounds")
+	}
+	var filename string
+	switch valid {
+	case true:
+		filename = keyset.GenerateKey(index)
+	case false:
+		filename = keyset.GenerateInvalidKey(index)
+	}
+	value, ok, err := b.Get(filename)
+	if err != nil {
+		return "", fmt.Errorf("get: %w", err)
+	}
+	if !ok {
+		return "", fmt.Errorf("no row found")
+	}
+	return value, nil
+}
@@ -0,0 +1,129 @@
+package bitcask
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/perbu/db-shootout/atomicfile"
+	"github.com/perbu/db-shootout/durability"
+)
+
+// hintMagic starts every hint file.
+const hintMagic = "bchint1\n"
+
+// A hint file is the magic, then as uvarints the size of the data file it covers, the
+// dead bytes in it and the number of keys, then for every key its length, the key, and
+// the offset, size and record size of its value. A CRC32 of everything before it ends
+// the file.
+
+// writeHint atomically replaces the hint file with the keydir. The data file must have
+// been flushed, and synced if the hint is.
+func (b *Bitcask) writeHint() error {
+	if !b.hints {
+		b.dirty = false
+		return nil
+	}
+	f, err := atomicfile.Create(b.hintPath(), b.mode != durability.None)
+	if err != nil {
+		return fmt.Errorf("create hint: %w", err)
+	}
+	h := crc32.NewIEEE()
+	w := bufio.NewWriter(io.MultiWriter(f, h))
+	buf := []byte(hintMagic)
+	buf = binary.AppendUvarint(buf, uint64(b.size))
+	buf = binary.AppendUvarint(buf, uint64(b.dead))
+	buf = binary.AppendUvarint(buf, uint64(len(b.keydir)))
+	w.Write(buf)
+	for key, loc := range b.keydir {
+		buf = binary.AppendUvarint(buf[:0], uint64(len(key)))
+		buf = append(buf, key...)
+		buf = binary.AppendUvarint(buf, uint64(loc.offset))
+		buf = binary.AppendUvarint(buf, uint64(loc.size))
+		buf = binary.AppendUvarint(buf, uint64(loc.record))
+		w.Write(buf)
+	}
+	err = w.Flush()
+	if err == nil {
+		_, err = f.Write(h.Sum(nil))
+	}
+	if err == nil {
+		err = f.Commit()
+	}
+	if err != nil {
+		f.Abort()
+		return fmt.Errorf("write hint: %w", err)
+	}
+	b.dirty = false
+	return f.Close()
+}
+
+// readHint loads the keydir, the data size and the dead bytes from the hint file. Keys
+// are substrings of the file contents, which saves an allocation per key.
+func (b *Bitcask) readHint() error {
+	raw, err := os.ReadFile(b.hintPath())
+	if err != nil {
+		return err
+	}
+	if len(raw) < len(hintMagic)+4 {
+		return fmt.Errorf("hint too short")
+	}
+	body, sum := raw[:len(raw)-4], raw[len(raw)-4:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+		return fmt.Errorf("hint: %w", errChecksum)
+	}
+	rest, ok := strings.CutPrefix(string(body), hintMagic)
+	if !ok {
+		return fmt.Errorf("not a hint file")
+	}
+	var size, dead, count uint64
+	for _, v := range []*uint64{&size, &dead, &count} {
+		if *v, rest, err = readUvarint(rest); err != nil {
+			return fmt.Errorf("hint header: %w", err)
+		}
+	}
+	if info, err := os.Stat(b.dataPath()); err != nil || uint64(info.Size()) < size {
+		return fmt.Errorf("hint covers more than the data file")
+	}
+	if count > uint64(len(rest)) {
+		return fmt.Errorf("hint: %w", io.ErrUnexpectedEOF)
+	}
+	keydir := make(map[string]location, count)
+	for i := uint64(0); i < count; i++ {
+		var klen, offset, vsize, record uint64
+		if klen, rest, err = readUvarint(rest); err != nil {
+			return fmt.Errorf("hint entry %d: %w", i, err)
+		}
+		if klen > uint64(len(rest)) {
+			return fmt.Errorf("hint entry %d: %w", i, io.ErrUnexpectedEOF)
+		}
+		key := rest[:klen]
+		rest = rest[klen:]
+		for _, v := range []*uint64{&offset, &vsize, &record} {
+			if *v, rest, err = readUvarint(rest); err != nil {
+				return fmt.Errorf("hint entry %d: %w", i, err)
+			}
+		}
+		keydir[key] = location{offset: int64(offset), size: uint32(vsize), record: uint32(record)}
+	}
+	b.keydir = keydir
+	b.size, b.dead = int64(size), int64(dead)
+	return nil
+}
+
+// readUvarint returns the uvarint at the start of s and the rest of s.
+func readUvarint(s string) (uint64, string, error) {
+	var x uint64
+	for i := 0; i < len(s) && i < binary.MaxVarintLen64; i++ {
+		c := s[i]
+		x |= uint64(c&0x7f) << (7 * i)
+		if c < 0x80 {
+			return x, s[i+1:], nil
+		}
+	}
+	return 0, "", io.ErrUnexpectedEOF
+}
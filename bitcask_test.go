@@ -0,0 +1,230 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/perbu/db-shootout/bitcask"
+)
+
+func BenchmarkCreateFolderBitcask(b *testing.B) {
+	db := bitcask.New(filepath.Join(b.TempDir(), "test.bitcask"), dirsize, bitcask.WithDataset(dataset))
+	for i := 0; i < b.N; i++ {
+		if err := db.CreateFolder(); err != nil {
+			b.Fatalf("create folder: %v", err)
+		}
+		if err := db.Delete(); err != nil {
+			b.Fatalf("delete: %v", err)
+		}
+	}
+}
+
+func BenchmarkLookupBitcask(b *testing.B) {
+	db := bitcask.New(filepath.Join(b.TempDir(), "test.bitcask"), dirsize, bitcask.WithDataset(dataset))
+	if err := db.CreateFolder(); err != nil {
+		b.Fatalf("create folder: %v", err)
+	}
+	if err := db.OpenReadOnly(); err != nil {
+		b.Fatalf("open readonly: %v", err)
+	}
+	defer db.Delete()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Lookup(rand.Intn(dirsize), true); err != nil {
+			b.Fatalf("lookup valid: %v", err)
+		}
+	}
+	b.StopTimer()
+}
+
+// BenchmarkPutBitcask overwrites existing keys, which only appends to the data file.
+func BenchmarkPutBitcask(b *testing.B) {
+	db := bitcask.New(filepath.Join(b.TempDir(), "test.bitcask"), dirsize, bitcask.WithDataset(dataset))
+	if err := db.CreateFolder(); err != nil {
+		b.Fatalf("create folder: %v", err)
+	}
+	if err := db.OpenReadWrite(); err != nil {
+		b.Fatalf("open readwrite: %v", err)
+	}
+	defer db.Delete()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.Put(dataset.Key(i%dirsize), dataset.Value(i%dirsize)); err != nil {
+			b.Fatalf("put: %v", err)
+		}
+	}
+	b.StopTimer()
+}
+
+// TestBitcask checks that puts and removals survive a reopen with and without the hint
+// file, and that a merge reclaims the dead entries without losing live ones.
+func TestBitcask(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "test.bitcask")
+	db := bitcask.New(dir, dirsize, bitcask.WithDataset(dataset))
+	if err := db.CreateFolder(); err != nil {
+		t.Fatalf("create folder: %v", err)
+	}
+	if err := db.OpenReadWrite(); err != nil {
+		t.Fatalf("open readwrite: %v", err)
+	}
+	for i := 0; i < dirsize/2; i++ {
+		if err := db.Put(dataset.Key(i), "new"); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	if err := db.Remove(dataset.Key(dirsize - 1)); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	check := func(t *testing.T, db *bitcask.Bitcask) {
+		t.Helper()
+		if err := db.OpenReadOnly(); err != nil {
+			t.Fatalf("open readonly: %v", err)
+		}
+		defer db.Close()
+		for _, i := range []int{0, dirsize/2 - 1} {
+			if value, err := db.Lookup(i, true); err != nil || value != "new" {
+				t.Fatalf("lookup %d got %q, %v, want %q", i, value, err, "new")
+			}
+		}
+		if value, err := db.Lookup(dirsize/2, true); err != nil || value != dataset.Value(dirsize/2) {
+			t.Fatalf("lookup %d got %q, %v, want %q", dirsize/2, value, err, dataset.Value(dirsize/2))
+		}
+		if _, err := db.Lookup(dirsize-1, true); err == nil {
+			t.Fatalf("lookup of a removed key succeeded")
+		}
+		n := 0
+		for {
+			_, ok, err := db.Next()
+			if err != nil {
+				t.Fatalf("next: %v", err)
+			}
+			if !ok {
+				break
+			}
+			n++
+		}
+		if n != dirsize-1 {
+			t.Fatalf("listed %d entries, want %d", n, dirsize-1)
+		}
+	}
+	t.Run("hint", func(t *testing.T) {
+		check(t, db)
+	})
+	t.Run("replay", func(t *testing.T) {
+		check(t, bitcask.New(dir, dirsize, bitcask.WithoutHints()))
+	})
+	t.Run("merge", func(t *testing.T) {
+		before, err := os.Stat(filepath.Join(dir, "data"))
+		if err != nil {
+			t.Fatalf("stat: %v", err)
+		}
+		if err := db.OpenReadWrite(); err != nil {
+			t.Fatalf("open readwrite: %v", err)
+		}
+		if db.Dead() == 0 {
+			t.Fatalf("no dead bytes before the merge")
+		}
+		if err := db.Merge(); err != nil {
+			t.Fatalf("merge: %v", err)
+		}
+		if db.Dead() != 0 {
+			t.Fatalf("%d dead bytes after the merge", db.Dead())
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		after, err := os.Stat(filepath.Join(dir, "data"))
+		if err != nil {
+			t.Fatalf("stat: %v", err)
+		}
+		if after.Size() >= before.Size() {
+			t.Fatalf("data file grew from %d to %d bytes", before.Size(), after.Size())
+		}
+		check(t, db)
+		check(t, bitcask.New(dir, dirsize, bitcask.WithoutHints()))
+	})
+	t.Run("torn", func(t *testing.T) {
+		path := filepath.Join(dir, "data")
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("stat: %v", err)
+		}
+		// the half-written put is dropped on open, the data before it is kept
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		if _, err := f.Write([]byte{1, 4, 60, 'a', 'b'}); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		f.Close()
+		check(t, db)
+		if err := db.OpenReadWrite(); err != nil {
+			t.Fatalf("open readwrite: %v", err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		if after, err := os.Stat(path); err != nil || after.Size() != info.Size() {
+			t.Fatalf("torn record not cut off: %v", err)
+		}
+	})
+}
+
+// TestBitcaskNextAcrossWrites writes in the middle of a readdir, which carries on with its
+// snapshot of the keys instead of starting over.
+func TestBitcaskNextAcrossWrites(t *testing.T) {
+	db := bitcask.New(filepath.Join(t.TempDir(), "test.bitcask"), dirsize, bitcask.WithDataset(dataset))
+	if err := db.CreateFolder(); err != nil {
+		t.Fatalf("create folder: %v", err)
+	}
+	if err := db.OpenReadWrite(); err != nil {
+		t.Fatalf("open readwrite: %v", err)
+	}
+	defer db.Close()
+	seen := make(map[string]bool)
+	next := func() bool {
+		name, ok, err := db.Next()
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		if !ok {
+			return false
+		}
+		if seen[name] {
+			t.Fatalf("next returned %q twice", name)
+		}
+		seen[name] = true
+		return true
+	}
+	for i := 0; i < dirsize/2; i++ {
+		next()
+	}
+	// remove a key the readdir hasn't reached yet
+	removed := ""
+	for i := 0; i < dirsize && removed == ""; i++ {
+		if !seen[dataset.Key(i)] {
+			removed = dataset.Key(i)
+		}
+	}
+	if err := db.Remove(removed); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := db.Put("new", "added"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	for next() {
+	}
+	if seen[removed] {
+		t.Fatalf("next returned %q after it was removed", removed)
+	}
+	if len(seen) != dirsize-1 {
+		t.Fatalf("readdir across writes: %d entries, want %d", len(seen), dirsize-1)
+	}
+}
@@ -1,10 +1,13 @@
 package boltdb
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 
 	bolt "github.com/openkvlab/boltdb"
+	"github.com/perbu/db-shootout/durability"
 	"github.com/perbu/db-shootout/keyset"
 )
 
@@ -15,15 +18,70 @@ type BoltDB struct {
 	current  int
 	db       *bolt.DB
 	bucket   []byte
+	mode     durability.Mode
+	data     *keyset.Dataset
+	bulk     bool
+
+	layout      Layout
+	directories int
+	dir         int // directory addressed by Lookup, Next and Put
+
+	// iteration state for Next: a read transaction holding a cursor into the directory,
+	// and the last key returned, to pick up from after a write ended the transaction
+	iterTx   *bolt.Tx
+	cursor   *bolt.Cursor
+	prefix   []byte
+	last     []byte
+	iterDone bool
+}
+
+// Option configures a BoltDB
+type Option func(*BoltDB)
+
+// WithDurability selects when commits are fsynced
+func WithDurability(mode durability.Mode) Option {
+	return func(b *BoltDB) {
+		b.mode = mode
+	}
+}
+
+// WithDataset populates the store from a pre-generated dataset instead of generating
+// entries while writing
+func WithDataset(data *keyset.Dataset) Option {
+	return func(b *BoltDB) {
+		b.data = data
+	}
+}
+
+// WithBulkLoad makes CreateFolder insert the keys in sorted order into pages filled to
+// the brim (FillPercent 1.0), in a single transaction even with per-op durability
+func WithBulkLoad() Option {
+	return func(b *BoltDB) {
+		b.bulk = true
+	}
 }
 
 // New creates a new BoltDB instance with the given filename and directory size
-func New(filename string, dirsize int) *BoltDB {
-	return &BoltDB{
+func New(filename string, dirsize int, opts ...Option) *BoltDB {
+	b := &BoltDB{
 		filename: filename,
 		dirsize:  dirsize,
 		bucket:   []byte("directory"),
 	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// openWritable opens the file for writing, honouring the durability mode
+func (b *BoltDB) openWritable() (*bolt.DB, error) {
+	db, err := bolt.Open(b.filename, 0o600, nil)
+	if err != nil {
+		return nil, err
+	}
+	db.NoSync = b.mode == durability.None
+	return db, nil
 }
 
 // OpenReadOnly opens an existing BoltDB file for read operations
@@ -32,36 +90,59 @@ func (b *BoltDB) OpenReadOnly() error {
 	if err != nil {
 		return fmt.Errorf("open bolt: %w", err)
 	}
+	// bolt asserts (panics) on pages past the end of a truncated file, so refuse it up front
+	if err := checkSize(db); err != nil {
+		db.Close()
+		return fmt.Errorf("open bolt: %w", err)
+	}
 	b.db = db
+	b.resetIteration()
 	return nil
 }
 
+// checkSize verifies that the file holds every page the meta page claims.
+func checkSize(db *bolt.DB) error {
+	info, err := os.Stat(db.Path())
+	if err != nil {
+		return err
+	}
+	return db.View(func(tx *bolt.Tx) error {
+		if info.Size() < tx.Size() {
+			return fmt.Errorf("file is truncated: %d bytes, expected %d: %w", info.Size(), tx.Size(), io.ErrUnexpectedEOF)
+		}
+		return nil
+	})
+}
+
 // CreateFolder creates (or overwrites) the BoltDB file and populates it
 func (b *BoltDB) CreateFolder() error {
 	// Open with write permissions
-	db, err := bolt.Open(b.filename, 0o600, nil)
+	db, err := b.openWritable()
 	if err != nil {
 		return fmt.Errorf("create bolt: %w", err)
 	}
 	b.db = db
 
-	// Create bucket and populate in a single transaction
-	err = db.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists(b.bucket)
-		if err != nil {
-			return fmt.Errorf("create bucket: %w", err)
+	if b.mode == durability.PerOp && !b.bulk {
+		if err := b.populatePerOp(); err != nil {
+			b.db.Close()
+			return fmt.Errorf("populate: %w", err)
 		}
+		b.current = 0
+		return nil
+	}
 
-		// Populate the bucket
-		for i := 0; i < b.dirsize; i++ {
-			key := []byte(keyset.GenerateKey(i))
-			val := []byte(keyset.GenerateRandomContent(64))
-			if err := bucket.Put(key, val); err != nil {
-				return fmt.Errorf("put: %w", err)
+	// Create the buckets and populate every directory in a single transaction
+	err = db.Update(func(tx *bolt.Tx) error {
+		for dir := 0; dir < b.directoryCount(); dir++ {
+			b.dir = dir
+			if err := b.populateDirectory(tx); err != nil {
+				return err
 			}
 		}
 		return nil
 	})
+	b.dir = 0
 	if err != nil {
 		b.db.Close()
 		return fmt.Errorf("populate: %w", err)
@@ -72,8 +153,98 @@ func (b *BoltDB) CreateFolder() error {
 	return nil
 }
 
+// populateDirectory writes the entries of the selected directory
+func (b *BoltDB) populateDirectory(tx *bolt.Tx) error {
+	bucket, prefix, err := b.directory(tx, true)
+	if err != nil {
+		return err
+	}
+
+	if b.bulk {
+		// appending in key order never splits a page, so pages can be filled completely
+		bucket.FillPercent = 1.0
+		for _, i := range b.data.Sorted(b.dirsize) {
+			if err := bucket.Put(entryKey(prefix, b.data.Key(i)), b.data.ValueBytes(i)); err != nil {
+				return fmt.Errorf("put: %w", err)
+			}
+		}
+		return nil
+	}
+
+	// Populate the bucket
+	for i := 0; i < b.dirsize; i++ {
+		key := entryKey(prefix, b.data.Key(i))
+		val := b.data.ValueBytes(i)
+		if err := bucket.Put(key, val); err != nil {
+			return fmt.Errorf("put: %w", err)
+		}
+	}
+	return nil
+}
+
+// populatePerOp creates the bucket and then commits every entry in its own transaction
+func (b *BoltDB) populatePerOp() error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(b.bucket)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("create bucket: %w", err)
+	}
+	defer func() { b.dir = 0 }()
+	for dir := 0; dir < b.directoryCount(); dir++ {
+		b.dir = dir
+		for i := 0; i < b.dirsize; i++ {
+			if err := b.Put(b.data.Key(i), b.data.Value(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// OpenReadWrite opens (or creates) the BoltDB file for incremental updates via Put
+func (b *BoltDB) OpenReadWrite() error {
+	db, err := b.openWritable()
+	if err != nil {
+		return fmt.Errorf("open bolt: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(b.bucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("create bucket: %w", err)
+	}
+	b.db = db
+	return nil
+}
+
+// Put stores a single entry in the selected directory in its own transaction
+func (b *BoltDB) Put(key, value string) error {
+	if b.db == nil {
+		return fmt.Errorf("database is not open")
+	}
+	// a write that grows the file remaps it, which waits for every read transaction,
+	// Next's included: end it first, Next resumes after its last key
+	b.suspendIteration()
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket, prefix, err := b.directory(tx, true)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(entryKey(prefix, key), []byte(value))
+	})
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	return nil
+}
+
 // Delete removes the underlying BoltDB file from the filesystem
 func (b *BoltDB) Delete() error {
+	b.resetIteration()
 	if b.db != nil {
 		if err := b.db.Close(); err != nil {
 			return fmt.Errorf("close before delete: %w", err)
@@ -85,6 +256,8 @@ func (b *BoltDB) Delete() error {
 
 // Close closes the database handle, if open
 func (b *BoltDB) Close() error {
+	// bolt waits for open read transactions before closing
+	b.resetIteration()
 	if b.db != nil {
 		err := b.db.Close()
 		b.db = nil
@@ -93,14 +266,124 @@ func (b *BoltDB) Close() error {
 	return nil
 }
 
-// Next returns the next key in sequence
+// Next returns the next name in the selected directory, walking it with a cursor in
+// key order. The read transaction stays open until the directory is exhausted or Put
+// ends it.
 func (b *BoltDB) Next() (string, bool, error) {
-	if b.current >= b.dirsize {
+	if b.iterDone {
+		return "", false, nil
+	}
+	if b.db == nil {
+		return "", false, fmt.Errorf("database is not open")
+	}
+	var key []byte
+	if b.cursor == nil {
+		tx, err := b.db.Begin(false)
+		if err != nil {
+			return "", false, fmt.Errorf("begin: %w", err)
+		}
+		bucket, prefix, err := b.directory(tx, false)
+		if err == nil && bucket == nil {
+			err = fmt.Errorf("directory %d not found", b.dir)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return "", false, err
+		}
+		b.iterTx, b.cursor, b.prefix = tx, bucket.Cursor(), prefix
+		if b.last == nil {
+			key, _ = b.cursor.Seek(prefix)
+		} else if key, _ = b.cursor.Seek(b.last); bytes.Equal(key, b.last) {
+			key, _ = b.cursor.Next()
+		}
+	} else {
+		key, _ = b.cursor.Next()
+	}
+	if key == nil || !bytes.HasPrefix(key, b.prefix) {
+		b.resetIteration()
+		b.iterDone = true
 		return "", false, nil
 	}
-	entry := keyset.GenerateKey(b.current)
 	b.current++
-	return entry, true, nil
+	b.last = append(b.last[:0], key...)
+	return string(key[len(b.prefix):]), true, nil
+}
+
+// PrefixScan returns the keys of the selected directory starting with prefix in key
+// order, seeking a cursor to the first one
+func (b *BoltDB) PrefixScan(prefix string) ([]string, error) {
+	if b.db == nil {
+		return nil, fmt.Errorf("database is not open")
+	}
+	var keys []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket, dirPrefix, err := b.directory(tx, false)
+		if err != nil {
+			return err
+		}
+		if bucket == nil {
+			return fmt.Errorf("directory %d not found", b.dir)
+		}
+		start := entryKey(dirPrefix, prefix)
+		c := bucket.Cursor()
+		for k, _ := c.Seek(start); k != nil && bytes.HasPrefix(k, start); k, _ = c.Next() {
+			keys = append(keys, string(k[len(dirPrefix):]))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// ReadPage returns up to limit keys of the selected directory after cursor in key order,
+// and the cursor of the next page, which is the last key returned. Each page seeks a
+// cursor past the previous one. The next cursor is empty after the last page
+func (b *BoltDB) ReadPage(cursor string, limit int) ([]string, string, error) {
+	if b.db == nil {
+		return nil, "", fmt.Errorf("database is not open")
+	}
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	keys := make([]string, 0, limit)
+	var next string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket, dirPrefix, err := b.directory(tx, false)
+		if err != nil {
+			return err
+		}
+		if bucket == nil {
+			return fmt.Errorf("directory %d not found", b.dir)
+		}
+		c := bucket.Cursor()
+		for k, _ := c.Seek(entryKey(dirPrefix, keyset.KeyAfter(cursor))); k != nil && bytes.HasPrefix(k, dirPrefix); k, _ = c.Next() {
+			if len(keys) == limit {
+				next = keys[limit-1]
+				break
+			}
+			keys = append(keys, string(k[len(dirPrefix):]))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return keys, next, nil
+}
+
+// resetIteration ends the read transaction of Next, so the next call starts over
+func (b *BoltDB) resetIteration() {
+	b.suspendIteration()
+	b.last = nil
+	b.iterDone = false
+	b.current = 0
+}
+
+// suspendIteration ends the read transaction of Next, keeping its position
+func (b *BoltDB) suspendIteration() {
+	if b.iterTx != nil {
+		_ = b.iterTx.Rollback()
+	}
+	b.iterTx, b.cursor, b.prefix = nil, nil, nil
 }
 
 // Lookup retrieves content for the generated key at the given index
@@ -122,11 +405,14 @@ func (b *BoltDB) Lookup(index int, valid bool) (string, error) {
 
 	var value string
 	err := b.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(b.bucket)
+		bucket, prefix, err := b.directory(tx, false)
+		if err != nil {
+			return err
+		}
 		if bucket == nil {
 			return fmt.Errorf("bucket not found")
 		}
-		val := bucket.Get([]byte(filename))
+		val := bucket.Get(entryKey(prefix, filename))
 		if val == nil {
 			return fmt.Errorf("no row found")
 		}
@@ -0,0 +1,105 @@
+package boltdb
+
+import (
+	"fmt"
+
+	bolt "github.com/openkvlab/boltdb"
+)
+
+// Layout selects how directories map onto bolt buckets
+type Layout int
+
+const (
+	// LayoutSingle keeps the entries in the top-level bucket, keyed on their name.
+	// It only has room for one directory. This is the default.
+	LayoutSingle Layout = iota
+	// LayoutNested gives every directory a sub-bucket of the top-level bucket, named after
+	// the directory ID, the way a metadata store keeps one bucket per directory inode
+	LayoutNested
+	// LayoutComposite keeps every directory in the top-level bucket, keyed on "parentID/name"
+	LayoutComposite
+)
+
+func (l Layout) String() string {
+	switch l {
+	case LayoutSingle:
+		return "single"
+	case LayoutNested:
+		return "nested"
+	case LayoutComposite:
+		return "composite"
+	default:
+		return fmt.Sprintf("layout(%d)", int(l))
+	}
+}
+
+// WithLayout selects how directories are stored
+func WithLayout(layout Layout) Option {
+	return func(b *BoltDB) {
+		b.layout = layout
+	}
+}
+
+// WithDirectories makes CreateFolder create n directories of dirsize entries each.
+// LayoutSingle ignores it.
+func WithDirectories(n int) Option {
+	return func(b *BoltDB) {
+		b.directories = n
+	}
+}
+
+// directoryCount returns the number of directories CreateFolder creates
+func (b *BoltDB) directoryCount() int {
+	if b.layout == LayoutSingle || b.directories < 1 {
+		return 1
+	}
+	return b.directories
+}
+
+// SelectDirectory makes Lookup, Next and Put address directory dir, and restarts Next
+func (b *BoltDB) SelectDirectory(dir int) error {
+	if dir < 0 || dir >= b.directoryCount() {
+		return fmt.Errorf("directory %d out of bounds", dir)
+	}
+	b.dir = dir
+	b.resetIteration()
+	return nil
+}
+
+// directory returns the bucket holding the selected directory and the prefix of the
+// directory's keys in it. With create, missing buckets are created, otherwise the bucket
+// is nil if the directory doesn't exist.
+func (b *BoltDB) directory(tx *bolt.Tx, create bool) (*bolt.Bucket, []byte, error) {
+	var top *bolt.Bucket
+	if create {
+		var err error
+		if top, err = tx.CreateBucketIfNotExists(b.bucket); err != nil {
+			return nil, nil, fmt.Errorf("create bucket: %w", err)
+		}
+	} else if top = tx.Bucket(b.bucket); top == nil {
+		return nil, nil, nil
+	}
+	// zero-padded, so directories sort in numeric order
+	id := []byte(fmt.Sprintf("%08d", b.dir))
+	switch b.layout {
+	case LayoutNested:
+		if !create {
+			return top.Bucket(id), nil, nil
+		}
+		sub, err := top.CreateBucketIfNotExists(id)
+		if err != nil {
+			return nil, nil, fmt.Errorf("create directory bucket: %w", err)
+		}
+		return sub, nil, nil
+	case LayoutComposite:
+		return top, append(id, '/'), nil
+	default:
+		return top, nil, nil
+	}
+}
+
+// entryKey returns the key of name in a directory with the given prefix
+func entryKey(prefix []byte, name string) []byte {
+	key := make([]byte, 0, len(prefix)+len(name))
+	return append(append(key, prefix...), name...)
+}
@@ -1,14 +1,16 @@
 package main
 
 import (
+	"fmt"
 	"math/rand"
+	"path/filepath"
 	"testing"
 
 	"github.com/perbu/db-shootout/boltdb"
 )
 
 func BenchmarkCreateFolderBolt(b *testing.B) {
-	db := boltdb.New("test.db", dirsize)
+	db := boltdb.New("test.db", dirsize, boltdb.WithDataset(dataset))
 	for i := 0; i < b.N; i++ {
 		if err := db.CreateFolder(); err != nil {
 			b.Fatalf("create folder: %v", err)
@@ -77,3 +79,163 @@ func BenchmarkReaddirBolt(b *testing.B) {
 		b.Fatalf("delete: %v", err)
 	}
 }
+
+var boltDirectoryCounts = []int{1, 16, 256}
+
+// boltLayouts opens a read-only bolt store of each layout and directory count for fn.
+func boltLayouts(b *testing.B, fn func(b *testing.B, db *boltdb.BoltDB, directories int)) {
+	for _, layout := range []boltdb.Layout{boltdb.LayoutNested, boltdb.LayoutComposite} {
+		for _, directories := range boltDirectoryCounts {
+			b.Run(fmt.Sprintf("%s/dirs-%d", layout, directories), func(b *testing.B) {
+				db := boltdb.New(filepath.Join(b.TempDir(), "test.db"), dirsize, boltdb.WithDataset(dataset),
+					boltdb.WithLayout(layout), boltdb.WithDirectories(directories), boltdb.WithBulkLoad())
+				if err := db.CreateFolder(); err != nil {
+					b.Fatalf("create folder: %v", err)
+				}
+				if err := db.Close(); err != nil {
+					b.Fatalf("close: %v", err)
+				}
+				if err := db.OpenReadOnly(); err != nil {
+					b.Fatalf("open readonly: %v", err)
+				}
+				defer db.Close()
+				b.ResetTimer()
+				fn(b, db, directories)
+				b.StopTimer()
+			})
+		}
+	}
+}
+
+// BenchmarkLookupBoltLayout looks up random entries in random directories.
+func BenchmarkLookupBoltLayout(b *testing.B) {
+	boltLayouts(b, func(b *testing.B, db *boltdb.BoltDB, directories int) {
+		for i := 0; i < b.N; i++ {
+			if err := db.SelectDirectory(rand.Intn(directories)); err != nil {
+				b.Fatalf("select directory: %v", err)
+			}
+			if _, err := db.Lookup(rand.Intn(dirsize), true); err != nil {
+				b.Fatalf("lookup valid: %v", err)
+			}
+		}
+	})
+}
+
+// BenchmarkReaddirBoltLayout reads a random directory in full per iteration.
+func BenchmarkReaddirBoltLayout(b *testing.B) {
+	boltLayouts(b, func(b *testing.B, db *boltdb.BoltDB, directories int) {
+		for i := 0; i < b.N; i++ {
+			if err := db.SelectDirectory(rand.Intn(directories)); err != nil {
+				b.Fatalf("select directory: %v", err)
+			}
+			for entry := 0; entry < dirsize; entry++ {
+				if _, ok, err := db.Next(); err != nil || !ok {
+					b.Fatalf("next: %v, %v", ok, err)
+				}
+			}
+		}
+	})
+}
+
+// TestBoltLayouts checks that directories are kept apart in every layout.
+func TestBoltLayouts(t *testing.T) {
+	const directories = 3
+	for _, layout := range []boltdb.Layout{boltdb.LayoutSingle, boltdb.LayoutNested, boltdb.LayoutComposite} {
+		t.Run(layout.String(), func(t *testing.T) {
+			db := boltdb.New(filepath.Join(t.TempDir(), "test.db"), dirsize, boltdb.WithDataset(dataset),
+				boltdb.WithLayout(layout), boltdb.WithDirectories(directories))
+			if err := db.CreateFolder(); err != nil {
+				t.Fatalf("create folder: %v", err)
+			}
+			count := directories
+			if layout == boltdb.LayoutSingle {
+				count = 1
+				if err := db.SelectDirectory(1); err == nil {
+					t.Fatalf("selected a second directory in the single layout")
+				}
+			}
+			// overwrite one entry in the last directory only
+			if err := db.SelectDirectory(count - 1); err != nil {
+				t.Fatalf("select directory: %v", err)
+			}
+			if err := db.Put(dataset.Key(5), "changed"); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+			if err := db.OpenReadOnly(); err != nil {
+				t.Fatalf("open readonly: %v", err)
+			}
+			defer db.Close()
+			for dir := 0; dir < count; dir++ {
+				if err := db.SelectDirectory(dir); err != nil {
+					t.Fatalf("select directory: %v", err)
+				}
+				want := dataset.Value(5)
+				if dir == count-1 {
+					want = "changed"
+				}
+				if value, err := db.Lookup(5, true); err != nil || value != want {
+					t.Fatalf("directory %d: lookup got %q, %v, want %q", dir, value, err, want)
+				}
+				for i := 0; i < dirsize; i++ {
+					name, ok, err := db.Next()
+					if err != nil || !ok || name != dataset.Key(i) {
+						t.Fatalf("directory %d: next got %q, %v, %v, want %q", dir, name, ok, err, dataset.Key(i))
+					}
+				}
+				if name, ok, err := db.Next(); err != nil || ok {
+					t.Fatalf("directory %d: next past the end got %q, %v, %v", dir, name, ok, err)
+				}
+			}
+		})
+	}
+}
+
+// TestBoltNextAcrossPut writes while a readdir is under way. The writes grow the file, so
+// bolt remaps it, which waits for open read transactions: Next's must not be one of them.
+func TestBoltNextAcrossPut(t *testing.T) {
+	const puts = 200
+	db := boltdb.New(filepath.Join(t.TempDir(), "test.db"), dirsize, boltdb.WithDataset(dataset))
+	if err := db.CreateFolder(); err != nil {
+		t.Fatalf("create folder: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := db.OpenReadWrite(); err != nil {
+		t.Fatalf("open read-write: %v", err)
+	}
+	defer db.Close()
+	seen := make(map[string]bool)
+	next := func() bool {
+		name, ok, err := db.Next()
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		if !ok {
+			return false
+		}
+		if seen[name] {
+			t.Fatalf("next returned %q twice", name)
+		}
+		seen[name] = true
+		return true
+	}
+	for i := 0; i < dirsize/2; i++ {
+		next()
+	}
+	// after every existing key, so the rest of the readdir lists them
+	value := string(make([]byte, 16<<10))
+	for i := 0; i < puts; i++ {
+		if err := db.Put(fmt.Sprintf("zz_%04d", i), value); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	for next() {
+	}
+	if len(seen) != dirsize+puts {
+		t.Fatalf("readdir across puts: %d entries, want %d", len(seen), dirsize+puts)
+	}
+}
@@ -0,0 +1,421 @@
+// Package btree is a small page-based B+tree kept in this repo, so lookup and readdir
+// cost can be correlated with structural metrics that the third-party stores don't
+// expose: page reads, splits and tree height.
+//
+// Page 0 holds the metadata, every other page one node. Entries live in the leaves, which
+// are linked left to right for Next. A read-only handle has no page cache of its own, so
+// every node it visits is one pread of a page and one page read in Stats. A writable
+// handle keeps the pages it touches in memory and writes the dirty ones back on Close.
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/perbu/db-shootout/durability"
+	"github.com/perbu/db-shootout/keyset"
+)
+
+const (
+	magic = "btree01\n"
+
+	// DefaultPageSize is the page size of a new tree unless WithPageSize says otherwise.
+	DefaultPageSize = 4096
+	// minPageSize leaves room for a few entries of the generated size.
+	minPageSize = 512
+)
+
+// meta is the content of page 0.
+type meta struct {
+	pageSize uint32
+	fanout   uint32
+	root     uint32
+	height   uint32
+	pages    uint32 // including page 0
+	entries  uint64
+}
+
+const metaSize = len(magic) + 5*4 + 8
+
+// Stats are the structural counters of a tree. The counters are kept from the handle's
+// creation or the last ResetStats, Height and Pages describe the tree as it is now.
+type Stats struct {
+	PageReads  int64 // pages read from the file
+	PageWrites int64 // pages written to the file, page 0 included
+	Splits     int64 // nodes split by inserts
+	Height     int   // levels, 1 for a tree that is a single leaf
+	Pages      int   // pages in the file, page 0 included
+}
+
+// BTree implements the BenchmarkDB interface on top of an in-repo B+tree.
+type BTree struct {
+	filename string
+	dirsize  int
+	pageSize int
+	fanout   int
+	mode     durability.Mode
+	data     *keyset.Dataset
+
+	f     *os.File
+	meta  meta
+	cache map[uint32]*node // pages of a writable handle, nil when read-only
+	buf   []byte           // one page
+	stats Stats
+
+	leaf     *node // leaf Next is in
+	pos      int   // next entry in leaf
+	iterDone bool
+}
+
+// Option configures a BTree.
+type Option func(*BTree)
+
+// WithPageSize sets the page size of a new tree in bytes. An existing tree keeps the
+// page size it was created with.
+func WithPageSize(size int) Option {
+	return func(t *BTree) {
+		t.pageSize = size
+	}
+}
+
+// WithFanout caps the number of keys in a node, which is otherwise only limited by the
+// page size. An existing tree keeps the fanout it was created with.
+func WithFanout(n int) Option {
+	return func(t *BTree) {
+		t.fanout = n
+	}
+}
+
+// WithDurability selects whether Close fsyncs the file after writing back dirty pages.
+// Pages are only written on Close, so per-op durability is the same as per-batch.
+func WithDurability(mode durability.Mode) Option {
+	return func(t *BTree) {
+		t.mode = mode
+	}
+}
+
+// WithDataset populates the tree from a pre-generated dataset instead of generating
+// entries while writing.
+func WithDataset(data *keyset.Dataset) Option {
+	return func(t *BTree) {
+		t.data = data
+	}
+}
+
+// New creates a new BTree stored in filename.
+func New(filename string, dirsize int, opts ...Option) *BTree {
+	t := &BTree{
+		filename: filename,
+		dirsize:  dirsize,
+		pageSize: DefaultPageSize,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// Stats returns the structural counters.
+func (t *BTree) Stats() Stats {
+	s := t.stats
+	s.Height, s.Pages = int(t.meta.height), int(t.meta.pages)
+	return s
+}
+
+// ResetStats zeroes the page read, page write and split counters.
+func (t *BTree) ResetStats() {
+	t.stats = Stats{}
+}
+
+// OpenReadOnly opens the tree for Lookup and Next.
+func (t *BTree) OpenReadOnly() error {
+	return t.open(os.O_RDONLY, false)
+}
+
+// OpenReadWrite opens the tree for Put.
+func (t *BTree) OpenReadWrite() error {
+	return t.open(os.O_RDWR, true)
+}
+
+func (t *BTree) open(flag int, writable bool) error {
+	f, err := os.OpenFile(t.filename, flag, 0)
+	if err != nil {
+		return fmt.Errorf("open btree: %w", err)
+	}
+	header := make([]byte, metaSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		f.Close()
+		return fmt.Errorf("read meta: %w", err)
+	}
+	m, err := decodeMeta(header)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("open btree: %w", err)
+	}
+	t.f, t.meta = f, m
+	t.pageSize, t.fanout = int(m.pageSize), int(m.fanout)
+	t.buf = make([]byte, t.pageSize)
+	t.cache = nil
+	if writable {
+		t.cache = make(map[uint32]*node)
+	}
+	t.resetIteration()
+	return nil
+}
+
+// CreateFolder creates the file with an empty tree and inserts dirsize entries.
+func (t *BTree) CreateFolder() error {
+	if t.pageSize < minPageSize || t.pageSize > 1<<16 {
+		return fmt.Errorf("page size %d outside [%d, %d]", t.pageSize, minPageSize, 1<<16)
+	}
+	if t.fanout == 1 {
+		return fmt.Errorf("fanout must be at least 2")
+	}
+	if err := t.Close(); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(t.filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("create btree: %w", err)
+	}
+	t.f = f
+	t.meta = meta{pageSize: uint32(t.pageSize), fanout: uint32(t.fanout), height: 1, pages: 1}
+	t.buf = make([]byte, t.pageSize)
+	t.cache = make(map[uint32]*node)
+	t.meta.root = t.alloc(true).id
+	if err := t.Populate(); err != nil {
+		t.Close()
+		return fmt.Errorf("populate: %w", err)
+	}
+	if err := t.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+	return nil
+}
+
+// Populate inserts dirsize entries, in index order, into a writable tree.
+func (t *BTree) Populate() error {
+	for i := 0; i < t.dirsize; i++ {
+		if err := t.Put(t.data.Key(i), t.data.Value(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put inserts or replaces the value of key.
+func (t *BTree) Put(key, value string) error {
+	if t.cache == nil {
+		return fmt.Errorf("btree is not open for writing")
+	}
+	if err := t.put(key, value); err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	t.resetIteration()
+	return nil
+}
+
+// page returns the node in page id, reading it from the file unless a writable handle
+// already has it.
+func (t *BTree) page(id uint32) (*node, error) {
+	if n, ok := t.cache[id]; ok {
+		return n, nil
+	}
+	if id == 0 || id >= t.meta.pages {
+		return nil, fmt.Errorf("page %d out of bounds", id)
+	}
+	if _, err := t.f.ReadAt(t.buf, int64(id)*int64(t.pageSize)); err != nil {
+		return nil, fmt.Errorf("read page %d: %w", id, err)
+	}
+	t.stats.PageReads++
+	n, err := decode(id, t.buf)
+	if err != nil {
+		return nil, err
+	}
+	if t.cache != nil {
+		t.cache[id] = n
+	}
+	return n, nil
+}
+
+// alloc appends a new, dirty page to a writable tree.
+func (t *BTree) alloc(leaf bool) *node {
+	n := &node{id: t.meta.pages, leaf: leaf, dirty: true}
+	if !leaf {
+		n.children = []uint32{}
+	}
+	t.meta.pages++
+	t.cache[n.id] = n
+	return n
+}
+
+// flush writes the dirty pages and page 0 back, in page order.
+func (t *BTree) flush() error {
+	ids := make([]uint32, 0, len(t.cache))
+	for id, n := range t.cache {
+		if n.dirty {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		n := t.cache[id]
+		n.encode(t.buf)
+		if _, err := t.f.WriteAt(t.buf, int64(id)*int64(t.pageSize)); err != nil {
+			return fmt.Errorf("write page %d: %w", id, err)
+		}
+		t.stats.PageWrites++
+		n.dirty = false
+	}
+	clear(t.buf)
+	t.meta.encode(t.buf)
+	if _, err := t.f.WriteAt(t.buf, 0); err != nil {
+		return fmt.Errorf("write meta: %w", err)
+	}
+	t.stats.PageWrites++
+	if t.mode != durability.None {
+		if err := t.f.Sync(); err != nil {
+			return fmt.Errorf("sync: %w", err)
+		}
+	}
+	return nil
+}
+
+func (m meta) encode(page []byte) {
+	b := append(page[:0], magic...)
+	for _, v := range []uint32{m.pageSize, m.fanout, m.root, m.height, m.pages} {
+		b = binary.LittleEndian.AppendUint32(b, v)
+	}
+	binary.LittleEndian.PutUint64(b[len(b):len(b)+8], m.entries)
+}
+
+func decodeMeta(b []byte) (meta, error) {
+	if string(b[:len(magic)]) != magic {
+		return meta{}, fmt.Errorf("not a btree file")
+	}
+	var m meta
+	b = b[len(magic):]
+	for _, v := range []*uint32{&m.pageSize, &m.fanout, &m.root, &m.height, &m.pages} {
+		*v = binary.LittleEndian.Uint32(b)
+		b = b[4:]
+	}
+	m.entries = binary.LittleEndian.Uint64(b)
+	if m.pageSize < minPageSize || m.pageSize > 1<<16 || m.root == 0 || m.root >= m.pages {
+		return meta{}, fmt.Errorf("bad meta page")
+	}
+	return m, nil
+}
+
+// Delete removes the file.
+func (t *BTree) Delete() error {
+	if err := t.Close(); err != nil {
+		return err
+	}
+	return os.Remove(t.filename)
+}
+
+// Close closes the file, writing back dirty pages first on a writable handle.
+func (t *BTree) Close() error {
+	if t.f == nil {
+		return nil
+	}
+	var err error
+	if t.cache != nil {
+		err = t.flush()
+	}
+	if closeErr := t.f.Close(); err == nil {
+		err = closeErr
+	}
+	t.f, t.cache = nil, nil
+	t.resetIteration()
+	return err
+}
+
+func (t *BTree) resetIteration() {
+	t.leaf, t.pos = nil, 0
+	t.iterDone = false
+}
+
+// Next returns the keys in order, walking the linked leaves.
+func (t *BTree) Next() (string, bool, error) {
+	if t.f == nil {
+		return "", false, fmt.Errorf("database is not open")
+	}
+	if t.iterDone {
+		return "", false, nil
+	}
+	if t.leaf == nil {
+		leaf, err := t.leftmost()
+		if err != nil {
+			return "", false, err
+		}
+		t.leaf, t.pos = leaf, 0
+	}
+	for t.pos >= len(t.leaf.keys) {
+		if t.leaf.next == 0 {
+			t.iterDone = true
+			return "", false, nil
+		}
+		leaf, err := t.page(t.leaf.next)
+		if err != nil {
+			return "", false, err
+		}
+		t.leaf, t.pos = leaf, 0
+	}
+	key := t.leaf.keys[t.pos]
+	t.pos++
+	return key, true, nil
+}
+
+// PrefixScan returns the keys starting with prefix in key order, reading only the leaves
+// that hold them and the path down to the first.
+func (t *BTree) PrefixScan(prefix string) ([]string, error) {
+	if t.f == nil {
+		return nil, fmt.Errorf("database is not open")
+	}
+	return t.scan(prefix)
+}
+
+// ReadPage returns up to limit keys after cursor in key order, and the cursor of the next
+// page, which is the last key returned. Each page descends to the leaf holding its first
+// key. The next cursor is empty after the last page.
+func (t *BTree) ReadPage(cursor string, limit int) ([]string, string, error) {
+	if t.f == nil {
+		return nil, "", fmt.Errorf("database is not open")
+	}
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	keys, more, err := t.list(keyset.KeyAfter(cursor), limit)
+	if err != nil || !more {
+		return keys, "", err
+	}
+	return keys, keys[len(keys)-1], nil
+}
+
+// Lookup retrieves the content of the entry at the given index.
+func (t *BTree) Lookup(index int, valid bool) (string, error) {
+	if t.f == nil {
+		return "", fmt.Errorf("database is not open")
+	}
+	if index < 0 || index >= t.dirsize {
+		return "", fmt.Errorf("index out of bounds")
+	}
+	var filename string
+	switch valid {
+	case true:
+		filename = keyset.GenerateKey(index)
+	case false:
+		filename = keyset.GenerateInvalidKey(index)
+	}
+	value, ok, err := t.get(filename)
+	if err != nil {
+		return "", fmt.Errorf("get: %w", err)
+	}
+	if !ok {
+		return "", fmt.Errorf("no row found")
+	}
+	return value, nil
+}
@@ -0,0 +1,144 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	kindLeaf     byte = 1
+	kindInternal byte = 2
+
+	// nodeHeader is the kind, the number of keys and, for leaves, the right sibling.
+	nodeHeader = 1 + 2 + 4
+)
+
+// node is a decoded page. A leaf holds keys and values and links to its right sibling,
+// an internal node holds n keys and n+1 children. Keys in children[i] are below keys[i],
+// keys in children[i+1] are at or above it.
+type node struct {
+	id       uint32
+	leaf     bool
+	keys     []string
+	values   []string // leaves only
+	children []uint32 // internal nodes only
+	next     uint32   // leaves only, 0 for the rightmost leaf
+	dirty    bool
+}
+
+// size returns the number of bytes encode needs.
+func (n *node) size() int {
+	size := nodeHeader
+	for i := range n.keys {
+		size += n.cell(i)
+	}
+	if !n.leaf {
+		size += 4
+	}
+	return size
+}
+
+// cell returns the number of bytes key i takes, with its value or the child right of it.
+func (n *node) cell(i int) int {
+	if n.leaf {
+		return 2 + 2 + len(n.keys[i]) + len(n.values[i])
+	}
+	return 2 + len(n.keys[i]) + 4
+}
+
+// middle returns the key whose cell straddles the middle of the node's cells, and the
+// number of bytes of the cells before it.
+func (n *node) middle() (int, int) {
+	total := n.size() - nodeHeader
+	before := 0
+	for i := range n.keys {
+		if 2*(before+n.cell(i)) > total {
+			return i, before
+		}
+		before += n.cell(i)
+	}
+	return len(n.keys) - 1, before - n.cell(len(n.keys)-1)
+}
+
+// encode writes the node into page, which must be at least size() bytes.
+//
+// A leaf cell is the key length, the value length, the key and the value. An internal
+// node has its first child after the header, then for every key its length, the key and
+// the child to the right of it. Lengths are uint16, page IDs uint32, all little-endian.
+func (n *node) encode(page []byte) {
+	clear(page)
+	page[0] = kindInternal
+	if n.leaf {
+		page[0] = kindLeaf
+	}
+	binary.LittleEndian.PutUint16(page[1:], uint16(len(n.keys)))
+	binary.LittleEndian.PutUint32(page[3:], n.next)
+	b := page[nodeHeader:nodeHeader]
+	if !n.leaf {
+		b = binary.LittleEndian.AppendUint32(b, n.children[0])
+	}
+	for i, key := range n.keys {
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(key)))
+		if n.leaf {
+			b = binary.LittleEndian.AppendUint16(b, uint16(len(n.values[i])))
+			b = append(b, key...)
+			b = append(b, n.values[i]...)
+		} else {
+			b = append(b, key...)
+			b = binary.LittleEndian.AppendUint32(b, n.children[i+1])
+		}
+	}
+}
+
+// decode parses the page with the given ID.
+func decode(id uint32, page []byte) (*node, error) {
+	n := &node{id: id}
+	switch page[0] {
+	case kindLeaf:
+		n.leaf = true
+	case kindInternal:
+	default:
+		return nil, fmt.Errorf("page %d: unknown kind %d", id, page[0])
+	}
+	count := int(binary.LittleEndian.Uint16(page[1:]))
+	n.next = binary.LittleEndian.Uint32(page[3:])
+	b := page[nodeHeader:]
+	short := fmt.Errorf("page %d: cells overrun the page", id)
+	n.keys = make([]string, 0, count)
+	if n.leaf {
+		n.values = make([]string, 0, count)
+	} else {
+		if len(b) < 4 {
+			return nil, short
+		}
+		n.children = make([]uint32, 0, count+1)
+		n.children = append(n.children, binary.LittleEndian.Uint32(b))
+		b = b[4:]
+	}
+	for i := 0; i < count; i++ {
+		if n.leaf {
+			if len(b) < 4 {
+				return nil, short
+			}
+			klen, vlen := int(binary.LittleEndian.Uint16(b)), int(binary.LittleEndian.Uint16(b[2:]))
+			if len(b) < 4+klen+vlen {
+				return nil, short
+			}
+			n.keys = append(n.keys, string(b[4:4+klen]))
+			n.values = append(n.values, string(b[4+klen:4+klen+vlen]))
+			b = b[4+klen+vlen:]
+		} else {
+			if len(b) < 2 {
+				return nil, short
+			}
+			klen := int(binary.LittleEndian.Uint16(b))
+			if len(b) < 2+klen+4 {
+				return nil, short
+			}
+			n.keys = append(n.keys, string(b[2:2+klen]))
+			n.children = append(n.children, binary.LittleEndian.Uint32(b[2+klen:]))
+			b = b[2+klen+4:]
+		}
+	}
+	return n, nil
+}
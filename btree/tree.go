@@ -0,0 +1,187 @@
+package btree
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// overflows reports whether a node has to be split.
+func (t *BTree) overflows(n *node) bool {
+	return (t.fanout > 0 && len(n.keys) > t.fanout) || n.size() > t.pageSize
+}
+
+// search descends from the root to the leaf that would hold key.
+func (t *BTree) search(key string) (*node, error) {
+	n, err := t.page(t.meta.root)
+	if err != nil {
+		return nil, err
+	}
+	for !n.leaf {
+		i := sort.Search(len(n.keys), func(i int) bool { return n.keys[i] > key })
+		if n, err = t.page(n.children[i]); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// get returns the value of key and whether it exists.
+func (t *BTree) get(key string) (string, bool, error) {
+	leaf, err := t.search(key)
+	if err != nil {
+		return "", false, err
+	}
+	i, found := slices.BinarySearch(leaf.keys, key)
+	if !found {
+		return "", false, nil
+	}
+	return leaf.values[i], true, nil
+}
+
+// put inserts or replaces key, splitting the root if it overflows.
+func (t *BTree) put(key, value string) error {
+	if 2+2+len(key)+len(value) > (t.pageSize-nodeHeader)/2 {
+		return fmt.Errorf("entry of %d bytes does not fit half a page", len(key)+len(value))
+	}
+	sep, right, err := t.insert(t.meta.root, key, value)
+	if err != nil {
+		return err
+	}
+	if right == nil {
+		return nil
+	}
+	root := t.alloc(false)
+	root.keys = []string{sep}
+	root.children = []uint32{t.meta.root, right.id}
+	t.meta.root = root.id
+	t.meta.height++
+	return nil
+}
+
+// insert puts key into the subtree at id. If the subtree's root splits, it returns the
+// new right sibling and the separator key to insert into the parent.
+func (t *BTree) insert(id uint32, key, value string) (string, *node, error) {
+	n, err := t.page(id)
+	if err != nil {
+		return "", nil, err
+	}
+	if n.leaf {
+		i, found := slices.BinarySearch(n.keys, key)
+		if found {
+			n.values[i] = value
+		} else {
+			n.keys = slices.Insert(n.keys, i, key)
+			n.values = slices.Insert(n.values, i, value)
+			t.meta.entries++
+		}
+		n.dirty = true
+		if !t.overflows(n) {
+			return "", nil, nil
+		}
+		t.stats.Splits++
+		// split by bytes rather than by keys, so that skewed entry sizes can't leave more
+		// than a page on one side. put keeps every entry within half a page, so one of the
+		// two sides of the middle entry fits either way; it goes where the halves even out,
+		// and to the upper half on a tie, as with equal entries split by keys.
+		mid, before := n.middle()
+		if before+n.cell(mid) < n.size()-nodeHeader-before {
+			mid++
+		}
+		mid = min(max(mid, 1), len(n.keys)-1)
+		right := t.alloc(true)
+		right.keys = slices.Clone(n.keys[mid:])
+		right.values = slices.Clone(n.values[mid:])
+		right.next = n.next
+		n.keys, n.values = n.keys[:mid:mid], n.values[:mid:mid]
+		n.next = right.id
+		return right.keys[0], right, nil
+	}
+
+	i := sort.Search(len(n.keys), func(i int) bool { return n.keys[i] > key })
+	sep, child, err := t.insert(n.children[i], key, value)
+	if err != nil || child == nil {
+		return "", nil, err
+	}
+	n.keys = slices.Insert(n.keys, i, sep)
+	n.children = slices.Insert(n.children, i+1, child.id)
+	n.dirty = true
+	if !t.overflows(n) {
+		return "", nil, nil
+	}
+	t.stats.Splits++
+	// the middle key moves up, so neither half holds more than half the cells
+	mid, _ := n.middle()
+	right := t.alloc(false)
+	up := n.keys[mid]
+	right.keys = slices.Clone(n.keys[mid+1:])
+	right.children = slices.Clone(n.children[mid+1:])
+	n.keys, n.children = n.keys[:mid:mid], n.children[:mid+1:mid+1]
+	return up, right, nil
+}
+
+// leftmost returns the first leaf.
+func (t *BTree) leftmost() (*node, error) {
+	n, err := t.page(t.meta.root)
+	if err != nil {
+		return nil, err
+	}
+	for !n.leaf {
+		if n, err = t.page(n.children[0]); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// scan returns the keys starting with prefix, descending to the leaf that would hold
+// prefix and walking the linked leaves from there.
+func (t *BTree) scan(prefix string) ([]string, error) {
+	leaf, err := t.search(prefix)
+	if err != nil {
+		return nil, err
+	}
+	i, _ := slices.BinarySearch(leaf.keys, prefix)
+	var keys []string
+	for {
+		for ; i < len(leaf.keys); i++ {
+			if !strings.HasPrefix(leaf.keys[i], prefix) {
+				return keys, nil
+			}
+			keys = append(keys, leaf.keys[i])
+		}
+		if leaf.next == 0 {
+			return keys, nil
+		}
+		if leaf, err = t.page(leaf.next); err != nil {
+			return nil, err
+		}
+		i = 0
+	}
+}
+
+// list returns up to limit keys from from on, and whether any keys follow them.
+func (t *BTree) list(from string, limit int) ([]string, bool, error) {
+	leaf, err := t.search(from)
+	if err != nil {
+		return nil, false, err
+	}
+	i, _ := slices.BinarySearch(leaf.keys, from)
+	keys := make([]string, 0, limit)
+	for {
+		for ; i < len(leaf.keys); i++ {
+			if len(keys) == limit {
+				return keys, true, nil
+			}
+			keys = append(keys, leaf.keys[i])
+		}
+		if leaf.next == 0 {
+			return keys, false, nil
+		}
+		if leaf, err = t.page(leaf.next); err != nil {
+			return nil, false, err
+		}
+		i = 0
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/perbu/db-shootout/btree"
+	"github.com/perbu/db-shootout/keyset"
+)
+
+// btreeShapes are the page sizes and fanouts the B+tree benchmarks compare. A fanout of
+// 0 fills pages as far as they go.
+var btreeShapes = []struct {
+	pageSize int
+	fanout   int
+}{
+	{512, 0},
+	{4096, 0},
+	{4096, 8},
+	{16384, 0},
+}
+
+func btreeShapeName(pageSize, fanout int) string {
+	return fmt.Sprintf("page=%d/fanout=%d", pageSize, fanout)
+}
+
+// newBTree creates a populated tree and opens it read-only with zeroed counters.
+func newBTree(tb testing.TB, pageSize, fanout int) *btree.BTree {
+	db := btree.New(filepath.Join(tb.TempDir(), "test.btree"), dirsize,
+		btree.WithPageSize(pageSize), btree.WithFanout(fanout), btree.WithDataset(dataset))
+	if err := db.CreateFolder(); err != nil {
+		tb.Fatalf("create folder: %v", err)
+	}
+	if err := db.OpenReadOnly(); err != nil {
+		tb.Fatalf("open readonly: %v", err)
+	}
+	db.ResetStats()
+	return db
+}
+
+// BenchmarkCreateFolderBTree reports the splits and pages of building the tree per shape.
+func BenchmarkCreateFolderBTree(b *testing.B) {
+	for _, shape := range btreeShapes {
+		b.Run(btreeShapeName(shape.pageSize, shape.fanout), func(b *testing.B) {
+			db := btree.New(filepath.Join(b.TempDir(), "test.btree"), dirsize,
+				btree.WithPageSize(shape.pageSize), btree.WithFanout(shape.fanout), btree.WithDataset(dataset))
+			for i := 0; i < b.N; i++ {
+				db.ResetStats()
+				if err := db.CreateFolder(); err != nil {
+					b.Fatalf("create folder: %v", err)
+				}
+			}
+			stats := db.Stats()
+			b.ReportMetric(float64(stats.Splits), "splits/op")
+			b.ReportMetric(float64(stats.Pages), "pages")
+			b.ReportMetric(float64(stats.Height), "height")
+			if err := db.Delete(); err != nil {
+				b.Fatalf("delete: %v", err)
+			}
+		})
+	}
+}
+
+// BenchmarkLookupBTree reports the page reads of a lookup, one per level, next to its cost.
+func BenchmarkLookupBTree(b *testing.B) {
+	for _, shape := range btreeShapes {
+		b.Run(btreeShapeName(shape.pageSize, shape.fanout), func(b *testing.B) {
+			db := newBTree(b, shape.pageSize, shape.fanout)
+			defer db.Delete()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Lookup(rand.Intn(dirsize), true); err != nil {
+					b.Fatalf("lookup valid: %v", err)
+				}
+			}
+			b.StopTimer()
+			stats := db.Stats()
+			b.ReportMetric(float64(stats.PageReads)/float64(b.N), "page-reads/op")
+			b.ReportMetric(float64(stats.Height), "height")
+		})
+	}
+}
+
+// BenchmarkReaddirBTree reports the page reads of listing the whole directory.
+func BenchmarkReaddirBTree(b *testing.B) {
+	for _, shape := range btreeShapes {
+		b.Run(btreeShapeName(shape.pageSize, shape.fanout), func(b *testing.B) {
+			db := newBTree(b, shape.pageSize, shape.fanout)
+			if err := db.Close(); err != nil {
+				b.Fatalf("close: %v", err)
+			}
+			defer db.Delete()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := db.OpenReadOnly(); err != nil {
+					b.Fatalf("open readonly: %v", err)
+				}
+				for entry := 0; entry < dirsize; entry++ {
+					if _, _, err := db.Next(); err != nil {
+						b.Fatalf("next: %v", err)
+					}
+				}
+				if err := db.Close(); err != nil {
+					b.Fatalf("close: %v", err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(db.Stats().PageReads)/float64(b.N), "page-reads/op")
+		})
+	}
+}
+
+// TestBTree checks lookups, ordered listing, updates through a reopen and the counters
+// for every benchmarked shape.
+func TestBTree(t *testing.T) {
+	for _, shape := range btreeShapes {
+		t.Run(btreeShapeName(shape.pageSize, shape.fanout), func(t *testing.T) {
+			db := newBTree(t, shape.pageSize, shape.fanout)
+			defer db.Delete()
+			for i := 0; i < dirsize; i++ {
+				if value, err := db.Lookup(i, true); err != nil || value != dataset.Value(i) {
+					t.Fatalf("lookup %d got %q, %v, want %q", i, value, err, dataset.Value(i))
+				}
+			}
+			if _, err := db.Lookup(0, false); err == nil {
+				t.Fatalf("lookup of an invalid key succeeded")
+			}
+			stats := db.Stats()
+			// a read-only handle reads every level of every lookup
+			if stats.PageReads != int64((dirsize+1)*stats.Height) {
+				t.Fatalf("%d page reads for %d lookups in a tree of height %d", stats.PageReads, dirsize+1, stats.Height)
+			}
+			if shape.pageSize <= 4096 && stats.Height < 2 {
+				t.Fatalf("height %d, want a split root", stats.Height)
+			}
+
+			var keys []string
+			for {
+				key, ok, err := db.Next()
+				if err != nil {
+					t.Fatalf("next: %v", err)
+				}
+				if !ok {
+					break
+				}
+				keys = append(keys, key)
+			}
+			if len(keys) != dirsize || !slices.IsSorted(keys) {
+				t.Fatalf("listed %d entries, sorted %v, want %d sorted", len(keys), slices.IsSorted(keys), dirsize)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+
+			if err := db.OpenReadWrite(); err != nil {
+				t.Fatalf("open readwrite: %v", err)
+			}
+			if err := db.Put(dataset.Key(0), "updated"); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+			if err := db.OpenReadOnly(); err != nil {
+				t.Fatalf("open readonly: %v", err)
+			}
+			if value, err := db.Lookup(0, true); err != nil || value != "updated" {
+				t.Fatalf("lookup after update got %q, %v", value, err)
+			}
+		})
+	}
+}
+
+// TestBTreeSkewedSplit fills a leaf with small entries followed by entries of well over
+// a third of a page, so that the last of them splits it with three of the large ones in
+// the upper half of its keys, and closes the tree before anything splits that half again.
+func TestBTreeSkewedSplit(t *testing.T) {
+	const pageSize = 512
+	path := filepath.Join(t.TempDir(), "test.btree")
+	db := btree.New(path, 0, btree.WithPageSize(pageSize))
+	if err := db.CreateFolder(); err != nil {
+		t.Fatalf("create folder: %v", err)
+	}
+	if err := db.OpenReadWrite(); err != nil {
+		t.Fatalf("open readwrite: %v", err)
+	}
+	values := []string{"a", "b", "c", "d", strings.Repeat("e", 180), strings.Repeat("f", 180), strings.Repeat("g", 180)}
+	for i, value := range values {
+		if err := db.Put(keyset.GenerateKey(i), value); err != nil {
+			t.Fatalf("put %d: %v", i, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	db = btree.New(path, len(values))
+	defer db.Delete()
+	if err := db.OpenReadOnly(); err != nil {
+		t.Fatalf("open readonly: %v", err)
+	}
+	if stats := db.Stats(); stats.Height != 2 {
+		t.Fatalf("height %d, want a split root", stats.Height)
+	}
+	for i := range values {
+		if value, err := db.Lookup(i, true); err != nil || value != values[i] {
+			t.Fatalf("lookup %d got %d bytes, %v, want %d", i, len(value), err, len(values[i]))
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	cdbdb64 "github.com/perbu/db-shootout/cdb64"
+	cdbdb "github.com/perbu/db-shootout/cdbdb"
+	"github.com/perbu/db-shootout/keyset"
+	"github.com/perbu/db-shootout/phash"
+	"github.com/perbu/db-shootout/sortedfile"
+	"github.com/perbu/db-shootout/sqlite"
+	"github.com/perbu/db-shootout/zblob"
+)
+
+var buildWorkers = []int{1, 2, 4, 8}
+
+// builder is a CDB backend that reports where the time of CreateFolder went.
+type builder[S any] interface {
+	creator
+	LastBuild() S
+}
+
+// benchmarkBuild runs CreateFolder and reports the generation, store and publish time per build.
+func benchmarkBuild[S any](b *testing.B, db builder[S], split func(S) (gen, store, publish int64)) {
+	var gen, store, publish int64
+	for i := 0; i < b.N; i++ {
+		if err := db.CreateFolder(); err != nil {
+			b.Fatalf("create folder: %v", err)
+		}
+		g, s, p := split(db.LastBuild())
+		gen, store, publish = gen+g, store+s, publish+p
+		if err := db.Delete(); err != nil {
+			b.Fatalf("delete: %v", err)
+		}
+	}
+	b.ReportMetric(float64(gen)/float64(b.N), "gen-ns/op")
+	b.ReportMetric(float64(store)/float64(b.N), "store-ns/op")
+	b.ReportMetric(float64(publish)/float64(b.N), "publish-ns/op")
+}
+
+// BenchmarkCreateFolderCDBWorkers builds both CDB backends with a growing number of
+// generator goroutines. gen-ns/op is how long the writer waited for entries.
+func BenchmarkCreateFolderCDBWorkers(b *testing.B) {
+	for _, workers := range buildWorkers {
+		b.Run(fmt.Sprintf("CDB/workers-%d", workers), func(b *testing.B) {
+			db := cdbdb.New("test.cdbdb", dirsize, cdbdb.WithBuildWorkers(workers))
+			benchmarkBuild(b, db, func(s cdbdb.BuildStats) (int64, int64, int64) {
+				return int64(s.Generate), int64(s.Store), int64(s.Publish)
+			})
+		})
+		b.Run(fmt.Sprintf("CDB64/workers-%d", workers), func(b *testing.B) {
+			db := cdbdb64.New("test.cdb64", dirsize, cdbdb64.WithBuildWorkers(workers))
+			benchmarkBuild(b, db, func(s cdbdb64.BuildStats) (int64, int64, int64) {
+				return int64(s.Generate), int64(s.Store), int64(s.Publish)
+			})
+		})
+	}
+}
+
+// BenchmarkGenerateEntries measures the generation side alone, without a store.
+func BenchmarkGenerateEntries(b *testing.B) {
+	for _, workers := range buildWorkers {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := keyset.Feed(dirsize, workers, func(key, value []byte) error { return nil }); err != nil {
+					b.Fatalf("feed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// TestFeedOrder checks that parallel generation hands entries to the store in index order.
+func TestFeedOrder(t *testing.T) {
+	const n = 3*keyset.ChunkSize + 17
+	for _, workers := range buildWorkers {
+		next := 0
+		_, err := keyset.Feed(n, workers, func(key, value []byte) error {
+			if want := keyset.GenerateKey(next); string(key) != want {
+				return fmt.Errorf("entry %d: got key %q, want %q", next, key, want)
+			}
+			next++
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("workers %d: %v", workers, err)
+		}
+		if next != n {
+			t.Fatalf("workers %d: got %d entries, want %d", workers, next, n)
+		}
+	}
+}
+
+// TestDatasetPopulate checks that a store populated from a dataset holds the dataset's values.
+func TestDatasetPopulate(t *testing.T) {
+	dir := t.TempDir()
+	for _, db := range []BenchmarkDB{
+		sqlite.New(filepath.Join(dir, "test.db"), dirsize, sqlite.WithDataset(dataset)),
+		cdbdb.New(filepath.Join(dir, "test.cdbdb"), dirsize, cdbdb.WithDataset(dataset)),
+		cdbdb64.New(filepath.Join(dir, "test.cdb64"), dirsize, cdbdb64.WithDataset(dataset)),
+	} {
+		if err := db.CreateFolder(); err != nil {
+			t.Fatalf("create folder: %v", err)
+		}
+		if err := db.OpenReadOnly(); err != nil {
+			t.Fatalf("open readonly: %v", err)
+		}
+		for _, i := range []int{0, dirsize / 2, dirsize - 1} {
+			value, err := db.Lookup(i, true)
+			if err != nil {
+				t.Fatalf("lookup %d: %v", i, err)
+			}
+			if value != dataset.Value(i) {
+				t.Fatalf("%T: index %d holds %q, want %q", db, i, value, dataset.Value(i))
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+	}
+}
+
+// TestDatasetAccessors checks that the byte accessors hand out the same entries as the
+// string ones, and that indexes outside the dataset are generated instead of panicking.
+func TestDatasetAccessors(t *testing.T) {
+	for _, i := range []int{0, dirsize - 1} {
+		if got, want := string(dataset.KeyBytes(i)), dataset.Key(i); got != want {
+			t.Fatalf("key bytes %d: got %q, want %q", i, got, want)
+		}
+		if got, want := string(dataset.ValueBytes(i)), dataset.Value(i); got != want {
+			t.Fatalf("value bytes %d: got %q, want %q", i, got, want)
+		}
+	}
+	for _, i := range []int{-1, dirsize} {
+		if got, want := dataset.Key(i), keyset.GenerateKey(i); got != want {
+			t.Fatalf("key %d: got %q, want %q", i, got, want)
+		}
+		if got, want := string(dataset.KeyBytes(i)), keyset.GenerateKey(i); got != want {
+			t.Fatalf("key bytes %d: got %q, want %q", i, got, want)
+		}
+		if len(dataset.Value(i)) != 64 || len(dataset.ValueBytes(i)) != 64 {
+			t.Fatalf("value %d: want 64 bytes of generated content", i)
+		}
+	}
+}
+
+// TestDatasetVisitOnce checks that writing a static file reads every value once, which is
+// what the crash tests count writes by.
+func TestDatasetVisitOnce(t *testing.T) {
+	dir := t.TempDir()
+	visits := make([]int, dirsize)
+	data := dataset.Visit(func(index int) { visits[index]++ })
+	for _, db := range []BenchmarkDB{
+		sortedfile.New(filepath.Join(dir, "test.sorted"), dirsize, sortedfile.WithDataset(data)),
+		phash.New(filepath.Join(dir, "test.phash"), dirsize, phash.WithDataset(data)),
+		zblob.New(filepath.Join(dir, "test.zblob"), dirsize, zblob.WithDataset(data)),
+	} {
+		clear(visits)
+		if err := db.Populate(); err != nil {
+			t.Fatalf("%T: populate: %v", db, err)
+		}
+		for i, n := range visits {
+			if n != 1 {
+				t.Fatalf("%T: value %d read %d times, want once", db, i, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/perbu/db-shootout/badgerdb"
+	"github.com/perbu/db-shootout/boltdb"
+	"github.com/perbu/db-shootout/pebbledb"
+	"github.com/perbu/db-shootout/sqlite"
+)
+
+// bulkDB is a backend that can be created in bulk and read back.
+type bulkDB interface {
+	creator
+	OpenReadOnly() error
+	Close() error
+	Lookup(index int, valid bool) (string, error)
+}
+
+var bulkBackends = []struct {
+	name string
+	new  func(path string, bulk bool, tb testing.TB) bulkDB
+}{
+	{"Sqlite", func(path string, bulk bool, tb testing.TB) bulkDB {
+		opts := []sqlite.Option{sqlite.WithDataset(dataset)}
+		if bulk {
+			opts = append(opts, sqlite.WithBulkLoad())
+		}
+		return sqlite.New(path, dirsize, opts...)
+	}},
+	{"Bolt", func(path string, bulk bool, tb testing.TB) bulkDB {
+		opts := []boltdb.Option{boltdb.WithDataset(dataset)}
+		if bulk {
+			opts = append(opts, boltdb.WithBulkLoad())
+		}
+		return boltdb.New(path, dirsize, opts...)
+	}},
+	{"Pebble", func(path string, bulk bool, tb testing.TB) bulkDB {
+		opts := []pebbledb.Option{pebbledb.WithDataset(dataset)}
+		if bulk {
+			opts = append(opts, pebbledb.WithBulkLoad())
+		}
+		return pebbledb.New(path, dirsize, tb, opts...)
+	}},
+	{"Badger", func(path string, bulk bool, tb testing.TB) bulkDB {
+		opts := []badgerdb.Option{badgerdb.WithDataset(dataset)}
+		if bulk {
+			opts = append(opts, badgerdb.WithBulkLoad())
+		}
+		return badgerdb.New(path, dirsize, opts...)
+	}},
+}
+
+// BenchmarkCreateFolderBulk compares the normal insertion path with each backend's bulk load.
+func BenchmarkCreateFolderBulk(b *testing.B) {
+	for _, backend := range bulkBackends {
+		for _, bulk := range []bool{false, true} {
+			name := backend.name + "/normal"
+			if bulk {
+				name = backend.name + "/bulk"
+			}
+			b.Run(name, func(b *testing.B) {
+				db := backend.new(filepath.Join(b.TempDir(), "test.db"), bulk, b)
+				for i := 0; i < b.N; i++ {
+					if err := db.CreateFolder(); err != nil {
+						b.Fatalf("create folder: %v", err)
+					}
+					if err := db.Delete(); err != nil {
+						b.Fatalf("delete: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestBulkLoad checks that every entry can be read back after a bulk load.
+func TestBulkLoad(t *testing.T) {
+	for _, backend := range bulkBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			db := backend.new(filepath.Join(t.TempDir(), "test.db"), true, t)
+			if err := db.CreateFolder(); err != nil {
+				t.Fatalf("create folder: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+			if err := db.OpenReadOnly(); err != nil {
+				t.Fatalf("open readonly: %v", err)
+			}
+			defer db.Close()
+			for i := 0; i < dirsize; i++ {
+				value, err := db.Lookup(i, true)
+				if err != nil {
+					t.Fatalf("lookup %d: %v", i, err)
+				}
+				if value != dataset.Value(i) {
+					t.Fatalf("index %d holds %q, want %q", i, value, dataset.Value(i))
+				}
+			}
+			if _, err := db.Lookup(0, false); err == nil {
+				t.Fatalf("lookup of an invalid key succeeded")
+			}
+		})
+	}
+}
@@ -1,11 +1,18 @@
 package cdbdb64
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
+	"time"
 
 	"github.com/perbu/cdb"
+	"github.com/perbu/db-shootout/atomicfile"
+	"github.com/perbu/db-shootout/durability"
 	"github.com/perbu/db-shootout/keyset"
+	"github.com/perbu/db-shootout/overlay"
 )
 
 // CDBDB implements the BenchmarkDB interface using github.com/perbu/cdb
@@ -14,24 +21,105 @@ type CDBDB struct {
 	dirsize  int
 	current  int
 	db       *cdb.MmapCDB
-	keys     [][]byte // Pre-loaded keys for iteration
+	keys     [][]byte    // Pre-loaded keys for iteration
+	info     os.FileInfo // Identifies the generation that is open
+	mode     durability.Mode
+	workers  int             // Goroutines generating entries for a build, 0 or 1 generates inline
+	data     *keyset.Dataset // Pre-generated entries, nil generates them while building
+	stats    BuildStats      // Breakdown of the last build
+
+	threshold int            // Compact the delta once it holds this many keys, 0 disables the overlay
+	delta     *overlay.Delta // Changes on top of the CDB file
+}
+
+// Option configures a CDBDB.
+type Option func(*CDBDB)
+
+// WithDurability selects whether the published file is fsynced. A CDB is always written
+// as one batch, so per-op durability is the same as per-batch.
+func WithDurability(mode durability.Mode) Option {
+	return func(b *CDBDB) {
+		b.mode = mode
+	}
+}
+
+// WithBuildWorkers generates the entries of CreateFolder on n goroutines, feeding the
+// single writer in order. With n of 0 or 1 entries are generated inline.
+func WithBuildWorkers(n int) Option {
+	return func(b *CDBDB) {
+		b.workers = n
+	}
+}
+
+// WithDataset populates the store from a pre-generated dataset instead of generating
+// entries while writing.
+func WithDataset(data *keyset.Dataset) Option {
+	return func(b *CDBDB) {
+		b.data = data
+	}
+}
+
+// BuildStats breaks down the time of the last CreateFolder or Populate.
+type BuildStats struct {
+	Generate time.Duration // generating entries, or waiting for the workers to
+	Store    time.Duration // writer.Put
+	Publish  time.Duration // freezing, syncing and renaming the file into place
+}
+
+// LastBuild reports where the time of the last build went.
+func (b *CDBDB) LastBuild() BuildStats {
+	return b.stats
 }
 
 // New creates a new CDBDB instance with the given filename and directory size.
-func New(filename string, dirsize int) *CDBDB {
-	return &CDBDB{
+func New(filename string, dirsize int, opts ...Option) *CDBDB {
+	b := &CDBDB{
 		filename: filename,
 		dirsize:  dirsize,
 	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
 }
 
 // OpenReadOnly opens an existing CDB file for read operations.
 func (b *CDBDB) OpenReadOnly() error {
-	db, err := cdb.OpenMmap(b.filename)
+	if err := b.openBase(); err != nil {
+		return err
+	}
+	if b.threshold > 0 {
+		if err := b.openDelta(false); err != nil {
+			b.closeBase()
+			return err
+		}
+	}
+	return nil
+}
+
+// openBase maps the CDB file itself and pre-loads its keys.
+func (b *CDBDB) openBase() error {
+	f, err := os.Open(b.filename)
+	if err != nil {
+		return fmt.Errorf("open cdbdb: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat cdbdb: %w", err)
+	}
+	// the mmap reader treats a hash table past the end of the file as empty
+	if err := checkTables(f, info.Size()); err != nil {
+		f.Close()
+		return fmt.Errorf("open cdbdb: %w", err)
+	}
+	// NewMmap closes f on failure
+	db, err := cdb.NewMmap(f)
 	if err != nil {
 		return fmt.Errorf("open cdbdb: %w", err)
 	}
 	b.db = db
+	b.info = info
 	b.current = 0 // Reset current position
 
 	// Pre-load all keys using the iterator for optimal performance
@@ -46,37 +134,80 @@ func (b *CDBDB) OpenReadOnly() error {
 	return nil
 }
 
-// CreateFolder creates (or overwrites) the CDB file, populates it, then freezes it.
-func (b *CDBDB) CreateFolder() error {
-	writer, err := cdb.Create(b.filename)
-	if err != nil {
-		return fmt.Errorf("create cdbdb: %w", err)
+// checkTables verifies that the file holds every hash table its header points at.
+func checkTables(f *os.File, size int64) error {
+	header := make([]byte, 256*16)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("read header: %w", err)
 	}
-
-	if err := b.populateWithWriter(writer); err != nil {
-		writer.Close()
-		return fmt.Errorf("populate: %w", err)
+	for i := 0; i < 256; i++ {
+		offset := binary.LittleEndian.Uint64(header[i*16:])
+		slots := binary.LittleEndian.Uint64(header[i*16+8:])
+		if slots > uint64(size)/16 || offset > uint64(size)-16*slots {
+			return fmt.Errorf("file is truncated: hash table %d ends past %d bytes: %w", i, size, io.ErrUnexpectedEOF)
+		}
 	}
+	return nil
+}
 
-	// Freeze the database (finalize the file) and close the handle.
-	// Freeze returns a *cdbdb.CDB for reading, but we can close it immediately
-	// since CreateFolder only needs to build the file, not keep it open.
-	db, err := writer.Freeze()
+// Reload reopens the file if a new generation has been published since it was opened,
+// and reports whether it did. Iteration starts over after a reload.
+func (b *CDBDB) Reload() (bool, error) {
+	if b.db == nil {
+		return false, fmt.Errorf("database is not open")
+	}
+	info, err := os.Stat(b.filename)
 	if err != nil {
-		return fmt.Errorf("freeze: %w", err)
+		return false, fmt.Errorf("stat cdbdb: %w", err)
 	}
-	_ = db.Close()
+	if os.SameFile(info, b.info) {
+		return false, nil
+	}
+	if err := b.closeBase(); err != nil {
+		return false, fmt.Errorf("close: %w", err)
+	}
+	if err := b.openBase(); err != nil {
+		return false, err
+	}
+	if b.delta != nil {
+		return true, b.mergeKeys()
+	}
+	return true, nil
+}
 
-	return nil
+// CreateFolder creates (or overwrites) the CDB file, populates it, then freezes it.
+func (b *CDBDB) CreateFolder() error {
+	if err := b.build(); err != nil {
+		return err
+	}
+	return b.clearDelta()
 }
 
 // Delete removes the underlying CDB file from the filesystem.
 func (b *CDBDB) Delete() error {
+	if err := b.clearDelta(); err != nil {
+		return err
+	}
 	return os.Remove(b.filename)
 }
 
 // Close closes the read-only database handle, if open.
 func (b *CDBDB) Close() error {
+	err := b.closeBase()
+	if b.delta != nil {
+		if deltaErr := b.delta.Close(); err == nil {
+			err = deltaErr
+		}
+		b.delta = nil
+	}
+	return err
+}
+
+// closeBase unmaps the CDB file, leaving the delta open.
+func (b *CDBDB) closeBase() error {
 	if b.db != nil {
 		err := b.db.Close()
 		b.db = nil
@@ -89,34 +220,68 @@ func (b *CDBDB) Close() error {
 // Populate creates a fresh CDB file and writes dirsize entries to it.
 // This is separate so it can be called alone, but is also used by CreateFolder.
 func (b *CDBDB) Populate() error {
-	writer, err := cdb.Create(b.filename)
+	return b.build()
+}
+
+// build writes a fresh CDB file with the generated entries.
+func (b *CDBDB) build() error {
+	return b.publish(b.populateWithWriter)
+}
+
+// publish writes a fresh CDB file next to the target and atomically renames it into place,
+// so concurrent readers see either the previous generation or the complete new one.
+// Unless durability is off, the file and its directory are fsynced around the rename.
+func (b *CDBDB) publish(fill func(writer *cdb.Writer) error) error {
+	f, err := atomicfile.Create(b.filename, b.mode != durability.None)
 	if err != nil {
 		return fmt.Errorf("create cdbdb: %w", err)
 	}
+	writer, err := cdb.NewWriter(f.File)
+	if err != nil {
+		f.Abort()
+		return fmt.Errorf("create cdbdb: %w", err)
+	}
 
-	if err := b.populateWithWriter(writer); err != nil {
-		writer.Close()
+	if err := fill(writer); err != nil {
+		f.Abort()
 		return fmt.Errorf("populate: %w", err)
 	}
 
-	// Freeze and close.
+	// Freeze the database (finalize the file). Freeze returns a handle for reading,
+	// which also owns f, but we close it as soon as the file is published.
+	start := time.Now()
 	db, err := writer.Freeze()
 	if err != nil {
+		// NewMmap closes f when mapping fails, but not when finalizing does; Abort's
+		// close is a no-op in the first case
+		f.Abort()
 		return fmt.Errorf("freeze: %w", err)
 	}
+	if err := f.Commit(); err != nil {
+		// closing db closes f
+		_ = db.Close()
+		f.Remove()
+		return fmt.Errorf("publish: %w", err)
+	}
 	_ = db.Close()
+	b.stats.Publish = time.Since(start)
 
 	return nil
 }
 
 // populateWithWriter writes the generated key/value pairs to the given cdbdb.Writer.
 func (b *CDBDB) populateWithWriter(writer *cdb.Writer) error {
-	for i := 0; i < b.dirsize; i++ {
-		key := []byte(keyset.GenerateKey(i))
-		val := []byte(keyset.GenerateRandomContent(64))
-		if err := writer.Put(key, val); err != nil {
-			return fmt.Errorf("put: %w", err)
-		}
+	b.stats = BuildStats{}
+	var timing keyset.Timing
+	var err error
+	if b.data != nil {
+		timing, err = b.data.Feed(b.dirsize, writer.Put)
+	} else {
+		timing, err = keyset.Feed(b.dirsize, b.workers, writer.Put)
+	}
+	b.stats.Generate, b.stats.Store = timing.Generate, timing.Store
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
 	}
 	// reset current index after populating
 	b.current = 0
@@ -137,18 +302,73 @@ func (b *CDBDB) Next() (string, bool, error) {
 
 	// Still read the data to simulate a real readdir operation
 	// but now we're using the actual key from iteration, not generated
-	val, err := b.db.Get(b.keys[b.current])
+	val, err := b.get(b.keys[b.current])
 	if err != nil {
 		return "", false, fmt.Errorf("get key %s: %w", key, err)
 	}
 	if val == nil {
 		return "", false, fmt.Errorf("key %s not found", key)
 	}
-
 	b.current++
 	return key, true, nil
 }
 
+// PrefixScan returns the keys starting with prefix. A CDB has no key order to seek in, so
+// this scans the pre-loaded keys, which Put and Remove keep in step with the delta.
+func (b *CDBDB) PrefixScan(prefix string) ([]string, error) {
+	if b.db == nil {
+		return nil, fmt.Errorf("database is not open")
+	}
+	var keys []string
+	for _, key := range b.keys {
+		if bytes.HasPrefix(key, []byte(prefix)) {
+			keys = append(keys, string(key))
+		}
+	}
+	return keys, nil
+}
+
+// ReadPage returns up to limit keys after cursor, and the cursor of the next page. The
+// cursor is a position in the pre-loaded keys, which serve as the position table, so a
+// deep page costs the same as the first. A cursor is only valid for the generation and
+// delta it was read from. The next cursor is empty after the last page.
+func (b *CDBDB) ReadPage(cursor string, limit int) ([]string, string, error) {
+	if b.db == nil {
+		return nil, "", fmt.Errorf("database is not open")
+	}
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	pos, err := keyset.ParsePositionCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	i := int(min(pos, int64(len(b.keys))))
+	end := min(i+limit, len(b.keys))
+	keys := make([]string, 0, end-i)
+	for ; i < end; i++ {
+		keys = append(keys, string(b.keys[i]))
+	}
+	if end == len(b.keys) {
+		return keys, "", nil
+	}
+	return keys, keyset.PositionCursor(int64(end)), nil
+}
+
+// get returns the value of key, looking in the delta before the CDB file.
+// It returns nil if the key doesn't exist or has been removed.
+func (b *CDBDB) get(key []byte) ([]byte, error) {
+	if b.delta != nil {
+		if value, removed, ok := b.delta.Get(string(key)); ok {
+			if removed {
+				return nil, nil
+			}
+			return []byte(value), nil
+		}
+	}
+	return b.db.Get(key)
+}
+
 // LookupValid retrieves content for the generated key at the given index.
 func (b *CDBDB) Lookup(index int, valid bool) (string, error) {
 	if b.db == nil {
@@ -164,7 +384,7 @@ func (b *CDBDB) Lookup(index int, valid bool) (string, error) {
 	case false:
 		filename = keyset.GenerateInvalidKey(index)
 	}
-	val, err := b.db.Get([]byte(filename))
+	val, err := b.get([]byte(filename))
 	if err != nil {
 		return "", fmt.Errorf("get: %w", err)
 	}
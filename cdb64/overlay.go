@@ -0,0 +1,181 @@
+package cdbdb64
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/perbu/cdb"
+	"github.com/perbu/db-shootout/durability"
+	"github.com/perbu/db-shootout/overlay"
+)
+
+// WithOverlay makes the CDB writable. Put and Remove append to a delta log next to the
+// file, which is consulted before the CDB and merged into a new generation of it once
+// the delta holds threshold keys.
+func WithOverlay(threshold int) Option {
+	return func(b *CDBDB) {
+		b.threshold = threshold
+	}
+}
+
+func (b *CDBDB) deltaPath() string {
+	return b.filename + ".delta"
+}
+
+func (b *CDBDB) openDelta(writable bool) error {
+	delta, err := overlay.Open(b.deltaPath(), writable, b.mode != durability.None)
+	if err != nil {
+		return fmt.Errorf("open delta: %w", err)
+	}
+	b.delta = delta
+	if err := b.mergeKeys(); err != nil {
+		delta.Close()
+		b.delta = nil
+		return err
+	}
+	return nil
+}
+
+// mergeKeys applies the delta to the pre-loaded keys: removed keys are dropped and keys
+// that only exist in the delta are listed after the CDB file. Put and Remove keep the
+// keys in step from then on.
+func (b *CDBDB) mergeKeys() error {
+	keys := b.keys[:0]
+	for _, key := range b.keys {
+		if _, removed, ok := b.delta.Get(string(key)); ok && removed {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	b.keys = keys
+	return b.delta.Each(func(key, _ string, removed bool) error {
+		if removed {
+			return nil
+		}
+		val, err := b.db.Get([]byte(key))
+		if err != nil {
+			return fmt.Errorf("get: %w", err)
+		}
+		if val == nil {
+			b.keys = append(b.keys, []byte(key))
+		}
+		return nil
+	})
+}
+
+// clearDelta drops any changes on top of a CDB file that is being replaced.
+func (b *CDBDB) clearDelta() error {
+	if b.delta != nil {
+		return b.delta.Reset()
+	}
+	if err := os.Remove(b.deltaPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove delta: %w", err)
+	}
+	return nil
+}
+
+// OpenReadWrite opens the CDB file and its delta for updates via Put and Remove.
+func (b *CDBDB) OpenReadWrite() error {
+	if b.threshold <= 0 {
+		return fmt.Errorf("cdb is read-only without an overlay")
+	}
+	if err := b.openBase(); err != nil {
+		return err
+	}
+	if err := b.openDelta(true); err != nil {
+		b.closeBase()
+		return err
+	}
+	return nil
+}
+
+// Put sets the value of key in the delta, and lists key after the others if it is new.
+func (b *CDBDB) Put(key, value string) error {
+	if b.delta == nil {
+		return fmt.Errorf("overlay is not open")
+	}
+	old, err := b.get([]byte(key))
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	if err := b.delta.Put(key, value); err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	if old == nil {
+		b.keys = append(b.keys, []byte(key))
+	}
+	return b.maybeCompact()
+}
+
+// Remove deletes key by writing a tombstone to the delta, and drops it from the listing.
+func (b *CDBDB) Remove(key string) error {
+	if b.delta == nil {
+		return fmt.Errorf("overlay is not open")
+	}
+	if err := b.delta.Remove(key); err != nil {
+		return fmt.Errorf("remove: %w", err)
+	}
+	b.unlist(key)
+	return b.maybeCompact()
+}
+
+// unlist drops key from the pre-loaded keys. Next carries on with the key it would have
+// returned anyway.
+func (b *CDBDB) unlist(key string) {
+	i := slices.IndexFunc(b.keys, func(k []byte) bool { return string(k) == key })
+	if i < 0 {
+		return
+	}
+	b.keys = slices.Delete(b.keys, i, i+1)
+	if i < b.current {
+		b.current--
+	}
+}
+
+func (b *CDBDB) maybeCompact() error {
+	if b.delta.Len() < b.threshold {
+		return nil
+	}
+	return b.Compact()
+}
+
+// Compact merges the delta into a new generation of the CDB file and empties the delta.
+// A crash between the two leaves a delta that is replayed onto the new generation,
+// which gives the same result.
+func (b *CDBDB) Compact() error {
+	if b.delta == nil || b.db == nil {
+		return fmt.Errorf("overlay is not open")
+	}
+	err := b.publish(func(writer *cdb.Writer) error {
+		for key, val := range b.db.All() {
+			if _, _, ok := b.delta.Get(string(key)); ok {
+				continue
+			}
+			if err := writer.Put(key, val); err != nil {
+				return fmt.Errorf("put: %w", err)
+			}
+		}
+		return b.delta.Each(func(key, value string, removed bool) error {
+			if removed {
+				return nil
+			}
+			if err := writer.Put([]byte(key), []byte(value)); err != nil {
+				return fmt.Errorf("put: %w", err)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	if err := b.delta.Reset(); err != nil {
+		return fmt.Errorf("reset delta: %w", err)
+	}
+	// switch over to the new generation
+	if err := b.closeBase(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+	return b.openBase()
+}
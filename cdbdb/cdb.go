@@ -1,77 +1,194 @@
 package cdbdb
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/colinmarc/cdb"
+	"github.com/perbu/db-shootout/atomicfile"
+	"github.com/perbu/db-shootout/durability"
 	"github.com/perbu/db-shootout/keyset"
+	"github.com/perbu/db-shootout/overlay"
 )
 
+// headerSize is the table of 256 hash table positions ahead of the records.
+const headerSize = 256 * 8
+
 // CDBDB implements the BenchmarkDB interface using github.com/colinmarc/cdbdb
 type CDBDB struct {
 	filename string
 	dirsize  int
 	current  int
 	db       *cdb.CDB      // read-only handle after freezing
+	file     *os.File      // the file db reads, owned by db and read directly by ReadPage
 	iter     *cdb.Iterator // iterator for sequential reads
+	records  []int64       // offset of every record and the end of the last, built by the first ReadPage
+	info     os.FileInfo   // identifies the generation that is open
+	mode     durability.Mode
+	workers  int             // goroutines generating entries for a build, 0 or 1 generates inline
+	data     *keyset.Dataset // pre-generated entries, nil generates them while building
+	stats    BuildStats      // breakdown of the last build
+
+	threshold int            // compact the delta once it holds this many keys, 0 disables the overlay
+	delta     *overlay.Delta // changes on top of the CDB file
+	baseDone  bool           // Next has gone through the CDB file
+	pending   []string       // keys only present in the delta, listed after the CDB file
+}
+
+// Option configures a CDBDB.
+type Option func(*CDBDB)
+
+// WithDurability selects whether the published file is fsynced. A CDB is always written
+// as one batch, so per-op durability is the same as per-batch.
+func WithDurability(mode durability.Mode) Option {
+	return func(b *CDBDB) {
+		b.mode = mode
+	}
+}
+
+// WithBuildWorkers generates the entries of CreateFolder on n goroutines, feeding the
+// single writer in order. With n of 0 or 1 entries are generated inline.
+func WithBuildWorkers(n int) Option {
+	return func(b *CDBDB) {
+		b.workers = n
+	}
+}
+
+// WithDataset populates the store from a pre-generated dataset instead of generating
+// entries while writing.
+func WithDataset(data *keyset.Dataset) Option {
+	return func(b *CDBDB) {
+		b.data = data
+	}
+}
+
+// BuildStats breaks down the time of the last CreateFolder or Populate.
+type BuildStats struct {
+	Generate time.Duration // generating entries, or waiting for the workers to
+	Store    time.Duration // writer.Put
+	Publish  time.Duration // freezing, syncing and renaming the file into place
+}
+
+// LastBuild reports where the time of the last build went.
+func (b *CDBDB) LastBuild() BuildStats {
+	return b.stats
 }
 
 // New creates a new CDBDB instance with the given filename and directory size.
-func New(filename string, dirsize int) *CDBDB {
-	return &CDBDB{
+func New(filename string, dirsize int, opts ...Option) *CDBDB {
+	b := &CDBDB{
 		filename: filename,
 		dirsize:  dirsize,
 	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
 }
 
 // OpenReadOnly opens an existing CDB file for read operations.
 func (b *CDBDB) OpenReadOnly() error {
-	db, err := cdb.Open(b.filename)
+	if err := b.openBase(); err != nil {
+		return err
+	}
+	if b.threshold > 0 {
+		if err := b.openDelta(false); err != nil {
+			b.closeBase()
+			return err
+		}
+	}
+	return nil
+}
+
+// openBase opens the CDB file itself.
+func (b *CDBDB) openBase() error {
+	f, err := os.Open(b.filename)
+	if err != nil {
+		return fmt.Errorf("open cdbdb: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat cdbdb: %w", err)
+	}
+	db, err := cdb.New(f, nil)
 	if err != nil {
+		f.Close()
 		return fmt.Errorf("open cdbdb: %w", err)
 	}
 	b.db = db
+	b.file = f
+	b.info = info
 	b.iter = db.Iter() // Initialize iterator for sequential reads
 	b.current = 0      // Reset current position
+	b.baseDone = false
+	b.pending = nil
 	return nil
 }
 
-// CreateFolder creates (or overwrites) the CDB file, populates it, then freezes it.
-func (b *CDBDB) CreateFolder() error {
-	writer, err := cdb.Create(b.filename)
+// Reload reopens the file if a new generation has been published since it was opened,
+// and reports whether it did. Iteration starts over after a reload.
+func (b *CDBDB) Reload() (bool, error) {
+	if b.db == nil {
+		return false, fmt.Errorf("database is not open")
+	}
+	info, err := os.Stat(b.filename)
 	if err != nil {
-		return fmt.Errorf("create cdbdb: %w", err)
+		return false, fmt.Errorf("stat cdbdb: %w", err)
 	}
-
-	if err := b.populateWithWriter(writer); err != nil {
-		writer.Close()
-		return fmt.Errorf("populate: %w", err)
+	if os.SameFile(info, b.info) {
+		return false, nil
 	}
-
-	// Freeze the database (finalize the file) and close the handle.
-	// Freeze returns a *cdbdb.CDB for reading, but we can close it immediately
-	// since CreateFolder only needs to build the file, not keep it open.
-	db, err := writer.Freeze()
-	if err != nil {
-		return fmt.Errorf("freeze: %w", err)
+	if err := b.closeBase(); err != nil {
+		return false, fmt.Errorf("close: %w", err)
 	}
-	_ = db.Close()
+	if err := b.openBase(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-	return nil
+// CreateFolder creates (or overwrites) the CDB file, populates it, then freezes it.
+func (b *CDBDB) CreateFolder() error {
+	if err := b.build(); err != nil {
+		return err
+	}
+	return b.clearDelta()
 }
 
 // Delete removes the underlying CDB file from the filesystem.
 func (b *CDBDB) Delete() error {
+	if err := b.clearDelta(); err != nil {
+		return err
+	}
 	return os.Remove(b.filename)
 }
 
 // Close closes the read-only database handle, if open.
 func (b *CDBDB) Close() error {
+	err := b.closeBase()
+	if b.delta != nil {
+		if deltaErr := b.delta.Close(); err == nil {
+			err = deltaErr
+		}
+		b.delta = nil
+	}
+	return err
+}
+
+// closeBase closes the CDB file, leaving the delta open.
+func (b *CDBDB) closeBase() error {
 	if b.db != nil {
 		err := b.db.Close()
-		b.db = nil
+		b.db, b.file = nil, nil
 		b.iter = nil // Clear iterator reference
+		b.records = nil
 		return err
 	}
 	return nil
@@ -80,34 +197,66 @@ func (b *CDBDB) Close() error {
 // Populate creates a fresh CDB file and writes dirsize entries to it.
 // This is separate so it can be called alone, but is also used by CreateFolder.
 func (b *CDBDB) Populate() error {
-	writer, err := cdb.Create(b.filename)
+	return b.build()
+}
+
+// build writes a fresh CDB file with the generated entries.
+func (b *CDBDB) build() error {
+	return b.publish(b.populateWithWriter)
+}
+
+// publish writes a fresh CDB file next to the target and atomically renames it into place,
+// so concurrent readers see either the previous generation or the complete new one.
+// Unless durability is off, the file and its directory are fsynced around the rename.
+func (b *CDBDB) publish(fill func(writer *cdb.Writer) error) error {
+	f, err := atomicfile.Create(b.filename, b.mode != durability.None)
 	if err != nil {
 		return fmt.Errorf("create cdbdb: %w", err)
 	}
+	writer, err := cdb.NewWriter(f.File, nil)
+	if err != nil {
+		f.Abort()
+		return fmt.Errorf("create cdbdb: %w", err)
+	}
 
-	if err := b.populateWithWriter(writer); err != nil {
-		writer.Close()
+	if err := fill(writer); err != nil {
+		f.Abort()
 		return fmt.Errorf("populate: %w", err)
 	}
 
-	// Freeze and close.
+	// Freeze the database (finalize the file). Freeze returns a handle for reading,
+	// which also owns f, but we close it as soon as the file is published.
+	start := time.Now()
 	db, err := writer.Freeze()
 	if err != nil {
+		f.Abort()
 		return fmt.Errorf("freeze: %w", err)
 	}
+	if err := f.Commit(); err != nil {
+		// closing db closes f
+		_ = db.Close()
+		f.Remove()
+		return fmt.Errorf("publish: %w", err)
+	}
 	_ = db.Close()
+	b.stats.Publish = time.Since(start)
 
 	return nil
 }
 
 // populateWithWriter writes the generated key/value pairs to the given cdbdb.Writer.
 func (b *CDBDB) populateWithWriter(writer *cdb.Writer) error {
-	for i := 0; i < b.dirsize; i++ {
-		key := []byte(keyset.GenerateKey(i))
-		val := []byte(keyset.GenerateRandomContent(64))
-		if err := writer.Put(key, val); err != nil {
-			return fmt.Errorf("put: %w", err)
-		}
+	b.stats = BuildStats{}
+	var timing keyset.Timing
+	var err error
+	if b.data != nil {
+		timing, err = b.data.Feed(b.dirsize, writer.Put)
+	} else {
+		timing, err = keyset.Feed(b.dirsize, b.workers, writer.Put)
+	}
+	b.stats.Generate, b.stats.Store = timing.Generate, timing.Store
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
 	}
 	// reset current index after populating
 	b.current = 0
@@ -116,6 +265,9 @@ func (b *CDBDB) populateWithWriter(writer *cdb.Writer) error {
 
 // Next returns the next key in sequence using the iterator for true sequential access.
 func (b *CDBDB) Next() (string, bool, error) {
+	if b.delta != nil {
+		return b.nextOverlay()
+	}
 	if b.current >= b.dirsize {
 		return "", false, nil
 	}
@@ -140,6 +292,153 @@ func (b *CDBDB) Next() (string, bool, error) {
 	return key, true, nil
 }
 
+// PrefixScan returns the keys starting with prefix. A CDB has no key order to seek in, so
+// this scans every key, in file order, followed by matching keys only in the delta.
+func (b *CDBDB) PrefixScan(prefix string) ([]string, error) {
+	if b.db == nil {
+		return nil, fmt.Errorf("database is not open")
+	}
+	var keys []string
+	iter := b.db.Iter()
+	for iter.Next() {
+		key := iter.Key()
+		if !bytes.HasPrefix(key, []byte(prefix)) {
+			continue
+		}
+		if b.delta != nil {
+			if _, removed, ok := b.delta.Get(string(key)); ok && removed {
+				continue
+			}
+		}
+		keys = append(keys, string(key))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("iterator error: %w", err)
+	}
+	if b.delta == nil {
+		return keys, nil
+	}
+	err := b.delta.Each(func(key, _ string, removed bool) error {
+		if removed || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		val, err := b.db.Get([]byte(key))
+		if err != nil {
+			return fmt.Errorf("get: %w", err)
+		}
+		if val == nil {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// ReadPage returns up to limit keys after cursor in file order, and the cursor of the next
+// page. The first call walks the records to find where each one starts, and the cursor is
+// a record number, so a page reads on from where the previous one stopped, like an
+// iterator saved between calls. With the overlay, removed keys are skipped and the keys
+// only in the delta follow the file. The next cursor is empty after the last page.
+func (b *CDBDB) ReadPage(cursor string, limit int) ([]string, string, error) {
+	if b.db == nil {
+		return nil, "", fmt.Errorf("database is not open")
+	}
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	if after, ok := strings.CutPrefix(cursor, deltaCursor); ok {
+		return b.readAdded(after, limit)
+	}
+	pos, err := keyset.ParsePositionCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if b.records == nil {
+		if err := b.loadRecords(); err != nil {
+			return nil, "", err
+		}
+	}
+	count := len(b.records) - 1
+	keys := make([]string, 0, limit)
+	for i := int(min(pos, int64(count))); i < count; i++ {
+		key, err := b.readKey(i)
+		if err != nil {
+			return nil, "", err
+		}
+		if b.delta != nil {
+			if _, removed, ok := b.delta.Get(key); ok && removed {
+				continue
+			}
+		}
+		// only now is there a key for another page
+		if len(keys) == limit {
+			return keys, keyset.PositionCursor(int64(i)), nil
+		}
+		keys = append(keys, key)
+	}
+	if b.delta == nil {
+		return keys, "", nil
+	}
+	added, next, err := b.readAdded("", limit-len(keys))
+	if err != nil {
+		return nil, "", err
+	}
+	return append(keys, added...), next, nil
+}
+
+// loadRecords reads the length header of every record to find where each one starts, and
+// checks that each ends within the records.
+func (b *CDBDB) loadRecords() error {
+	var header [4]byte
+	if _, err := b.file.ReadAt(header[:], 0); err != nil {
+		return fmt.Errorf("read header: %w", err)
+	}
+	// the first hash table follows the last record
+	end := int64(binary.LittleEndian.Uint32(header[:]))
+	if end < headerSize {
+		return fmt.Errorf("records end at %d, inside the header: %w", end, io.ErrUnexpectedEOF)
+	}
+	r := bufio.NewReader(io.NewSectionReader(b.file, headerSize, end-headerSize))
+	records := make([]int64, 0, b.dirsize+1)
+	var lengths [8]byte
+	for pos := int64(headerSize); pos < end; {
+		if _, err := io.ReadFull(r, lengths[:]); err != nil {
+			return fmt.Errorf("read record at %d: %w", pos, err)
+		}
+		size := 8 + int64(binary.LittleEndian.Uint32(lengths[:4])) + int64(binary.LittleEndian.Uint32(lengths[4:]))
+		if pos+size > end {
+			return fmt.Errorf("record at %d overruns the records by %d bytes: %w", pos, pos+size-end, io.ErrUnexpectedEOF)
+		}
+		if _, err := r.Discard(int(size - 8)); err != nil {
+			return fmt.Errorf("read record at %d: %w", pos, err)
+		}
+		records = append(records, pos)
+		pos += size
+	}
+	b.records = append(records, end)
+	return nil
+}
+
+// readKey reads the key of record i, checking that the record fills the space the
+// record table gives it before allocating the key.
+func (b *CDBDB) readKey(i int) (string, error) {
+	pos, size := b.records[i], b.records[i+1]-b.records[i]
+	var lengths [8]byte
+	if _, err := b.file.ReadAt(lengths[:], pos); err != nil {
+		return "", fmt.Errorf("read record: %w", err)
+	}
+	klen := int64(binary.LittleEndian.Uint32(lengths[:4]))
+	vlen := int64(binary.LittleEndian.Uint32(lengths[4:]))
+	if 8+klen+vlen != size {
+		return "", fmt.Errorf("record at %d: %d bytes, want %d", pos, 8+klen+vlen, size)
+	}
+	key := make([]byte, klen)
+	if _, err := b.file.ReadAt(key, pos+8); err != nil {
+		return "", fmt.Errorf("read record: %w", err)
+	}
+	return string(key), nil
+}
+
 // LookupValid retrieves content for the generated key at the given index.
 func (b *CDBDB) Lookup(index int, valid bool) (string, error) {
 	if b.db == nil {
@@ -155,6 +454,14 @@ func (b *CDBDB) Lookup(index int, valid bool) (string, error) {
 	case false:
 		filename = keyset.GenerateInvalidKey(index)
 	}
+	if b.delta != nil {
+		if value, removed, ok := b.delta.Get(filename); ok {
+			if removed {
+				return "", fmt.Errorf("no row found")
+			}
+			return value, nil
+		}
+	}
 	val, err := b.db.Get([]byte(filename))
 	if err != nil {
 		return "", fmt.Errorf("get: %w", err)
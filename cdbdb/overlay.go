@@ -0,0 +1,221 @@
+package cdbdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/colinmarc/cdb"
+	"github.com/perbu/db-shootout/durability"
+	"github.com/perbu/db-shootout/overlay"
+)
+
+// WithOverlay makes the CDB writable. Put and Remove append to a delta log next to the
+// file, which is consulted before the CDB and merged into a new generation of it once
+// the delta holds threshold keys.
+func WithOverlay(threshold int) Option {
+	return func(b *CDBDB) {
+		b.threshold = threshold
+	}
+}
+
+func (b *CDBDB) deltaPath() string {
+	return b.filename + ".delta"
+}
+
+func (b *CDBDB) openDelta(writable bool) error {
+	delta, err := overlay.Open(b.deltaPath(), writable, b.mode != durability.None)
+	if err != nil {
+		return fmt.Errorf("open delta: %w", err)
+	}
+	b.delta = delta
+	return nil
+}
+
+// clearDelta drops any changes on top of a CDB file that is being replaced.
+func (b *CDBDB) clearDelta() error {
+	if b.delta != nil {
+		return b.delta.Reset()
+	}
+	if err := os.Remove(b.deltaPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove delta: %w", err)
+	}
+	return nil
+}
+
+// OpenReadWrite opens the CDB file and its delta for updates via Put and Remove.
+func (b *CDBDB) OpenReadWrite() error {
+	if b.threshold <= 0 {
+		return fmt.Errorf("cdb is read-only without an overlay")
+	}
+	if err := b.openBase(); err != nil {
+		return err
+	}
+	if err := b.openDelta(true); err != nil {
+		b.closeBase()
+		return err
+	}
+	return nil
+}
+
+// Put sets the value of key in the delta.
+func (b *CDBDB) Put(key, value string) error {
+	if b.delta == nil {
+		return fmt.Errorf("overlay is not open")
+	}
+	if err := b.delta.Put(key, value); err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	return b.maybeCompact()
+}
+
+// Remove deletes key by writing a tombstone to the delta.
+func (b *CDBDB) Remove(key string) error {
+	if b.delta == nil {
+		return fmt.Errorf("overlay is not open")
+	}
+	if err := b.delta.Remove(key); err != nil {
+		return fmt.Errorf("remove: %w", err)
+	}
+	return b.maybeCompact()
+}
+
+func (b *CDBDB) maybeCompact() error {
+	if b.delta.Len() < b.threshold {
+		return nil
+	}
+	return b.Compact()
+}
+
+// Compact merges the delta into a new generation of the CDB file and empties the delta.
+// A crash between the two leaves a delta that is replayed onto the new generation,
+// which gives the same result.
+func (b *CDBDB) Compact() error {
+	if b.delta == nil || b.db == nil {
+		return fmt.Errorf("overlay is not open")
+	}
+	err := b.publish(func(writer *cdb.Writer) error {
+		iter := b.db.Iter()
+		for iter.Next() {
+			if _, _, ok := b.delta.Get(string(iter.Key())); ok {
+				continue
+			}
+			if err := writer.Put(iter.Key(), iter.Value()); err != nil {
+				return fmt.Errorf("put: %w", err)
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return fmt.Errorf("iterator error: %w", err)
+		}
+		return b.delta.Each(func(key, value string, removed bool) error {
+			if removed {
+				return nil
+			}
+			if err := writer.Put([]byte(key), []byte(value)); err != nil {
+				return fmt.Errorf("put: %w", err)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	if err := b.delta.Reset(); err != nil {
+		return fmt.Errorf("reset delta: %w", err)
+	}
+	// switch over to the new generation
+	if err := b.closeBase(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+	return b.openBase()
+}
+
+// nextOverlay lists the CDB file without the removed keys, followed by the keys
+// that only exist in the delta.
+func (b *CDBDB) nextOverlay() (string, bool, error) {
+	if b.iter == nil {
+		return "", false, fmt.Errorf("database is not open or iterator not initialized")
+	}
+	for !b.baseDone {
+		if !b.iter.Next() {
+			if err := b.iter.Err(); err != nil {
+				return "", false, fmt.Errorf("iterator error: %w", err)
+			}
+			b.baseDone = true
+			if err := b.collectAdded(); err != nil {
+				return "", false, err
+			}
+			break
+		}
+		key := string(b.iter.Key())
+		if _, removed, ok := b.delta.Get(key); ok && removed {
+			continue
+		}
+		b.current++
+		return key, true, nil
+	}
+	if len(b.pending) == 0 {
+		return "", false, nil
+	}
+	key := b.pending[0]
+	b.pending = b.pending[1:]
+	b.current++
+	return key, true, nil
+}
+
+// collectAdded finds the keys the delta adds to the CDB file.
+func (b *CDBDB) collectAdded() error {
+	b.pending = nil
+	return b.delta.Each(func(key, _ string, removed bool) error {
+		if removed {
+			return nil
+		}
+		val, err := b.db.Get([]byte(key))
+		if err != nil {
+			return fmt.Errorf("get: %w", err)
+		}
+		if val == nil {
+			b.pending = append(b.pending, key)
+		}
+		return nil
+	})
+}
+
+// deltaCursor marks a ReadPage cursor that has gone past the CDB file into the keys only
+// in the delta. The last key returned follows it.
+const deltaCursor = "delta:"
+
+// readAdded returns up to limit of the keys the delta adds to the CDB file, in key order
+// from after key on, and the cursor of the next page.
+func (b *CDBDB) readAdded(after string, limit int) ([]string, string, error) {
+	if b.delta == nil {
+		return nil, "", fmt.Errorf("invalid cursor %q", deltaCursor+after)
+	}
+	var keys []string
+	more := false
+	err := b.delta.Each(func(key, _ string, removed bool) error {
+		if removed || more || key <= after {
+			return nil
+		}
+		val, err := b.db.Get([]byte(key))
+		if err != nil {
+			return fmt.Errorf("get: %w", err)
+		}
+		if val != nil {
+			return nil
+		}
+		if len(keys) == limit {
+			more = true
+			return nil
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil || !more {
+		return keys, "", err
+	}
+	if len(keys) > 0 {
+		after = keys[len(keys)-1]
+	}
+	return keys, deltaCursor + after, nil
+}
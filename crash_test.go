@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perbu/db-shootout/badgerdb"
+	"github.com/perbu/db-shootout/boltdb"
+	"github.com/perbu/db-shootout/keyset"
+	"github.com/perbu/db-shootout/pebbledb"
+	"github.com/perbu/db-shootout/sqlite"
+)
+
+const (
+	crashDirsize    = 200
+	crashIterations = 5
+	crashBackendEnv = "SHOOTOUT_CRASH_BACKEND"
+	crashPathEnv    = "SHOOTOUT_CRASH_PATH"
+	crashKillEnv    = "SHOOTOUT_CRASH_KILL"
+	crashSeedEnv    = "SHOOTOUT_CRASH_SEED"
+)
+
+// crashDB is the part of a writable backend the crash harness needs.
+type crashDB interface {
+	CreateFolder() error
+	OpenReadWrite() error
+	OpenReadOnly() error
+	Close() error
+	Put(key, value string) error
+	Lookup(index int, valid bool) (string, error)
+}
+
+var crashBackends = []struct {
+	name string
+	open func(path string, data *keyset.Dataset, tb testing.TB) crashDB
+}{
+	{"sqlite", func(path string, data *keyset.Dataset, tb testing.TB) crashDB {
+		return sqlite.New(path, crashDirsize, sqlite.WithDataset(data))
+	}},
+	{"bolt", func(path string, data *keyset.Dataset, tb testing.TB) crashDB {
+		return boltdb.New(path, crashDirsize, boltdb.WithDataset(data))
+	}},
+	{"pebble", func(path string, data *keyset.Dataset, tb testing.TB) crashDB {
+		return pebbledb.New(path, crashDirsize, tb, pebbledb.WithDataset(data))
+	}},
+	{"badger", func(path string, data *keyset.Dataset, tb testing.TB) crashDB {
+		return badgerdb.New(path, crashDirsize, badgerdb.WithDataset(data))
+	}},
+}
+
+// crashKill is where the child kills itself: after the given number of writes inside
+// CreateFolder, or after the given number of acknowledged updates.
+type crashKill struct {
+	create bool
+	writes int
+}
+
+func (k crashKill) String() string {
+	if k.create {
+		return fmt.Sprintf("create:%d", k.writes)
+	}
+	return fmt.Sprintf("update:%d", k.writes)
+}
+
+func parseCrashKill(s string) (crashKill, error) {
+	var k crashKill
+	phase, writes, ok := strings.Cut(s, ":")
+	if !ok {
+		return k, fmt.Errorf("invalid kill point %q", s)
+	}
+	k.create = phase == "create"
+	if !k.create && phase != "update" {
+		return k, fmt.Errorf("invalid kill point %q", s)
+	}
+	n, err := strconv.Atoi(writes)
+	if err != nil {
+		return k, fmt.Errorf("invalid kill point %q", s)
+	}
+	k.writes = n
+	return k, nil
+}
+
+// killSelf SIGKILLs the current process, so nothing gets to flush or clean up.
+func killSelf() {
+	p, err := os.FindProcess(os.Getpid())
+	if err == nil {
+		_ = p.Kill()
+	}
+	select {}
+}
+
+// crashValue is the content written for key in update generation gen. CreateFolder is generation 0.
+func crashValue(gen int, key string) string {
+	return fmt.Sprintf("gen%d:%s", gen, key)
+}
+
+// crashGeneration recovers the generation from a value. Random content from CreateFolder is generation 0.
+func crashGeneration(value string) int {
+	var gen int
+	if _, err := fmt.Sscanf(value, "gen%d:", &gen); err != nil {
+		return 0
+	}
+	return gen
+}
+
+// TestCrashChild is the population process TestCrashConsistency crashes. It kills itself
+// at the kill point it is given, and reports every write that has returned successfully
+// on stdout.
+func TestCrashChild(t *testing.T) {
+	name := os.Getenv(crashBackendEnv)
+	if name == "" {
+		t.Skip("only run as a child of TestCrashConsistency")
+	}
+	kill, err := parseCrashKill(os.Getenv(crashKillEnv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data *keyset.Dataset
+	if kill.create {
+		// stop inside the write after the last one let through
+		writes := 0
+		data = data.Visit(func(int) {
+			if writes == kill.writes {
+				killSelf()
+			}
+			writes++
+		})
+	}
+	var db crashDB
+	for _, backend := range crashBackends {
+		if backend.name == name {
+			db = backend.open(os.Getenv(crashPathEnv), data, t)
+		}
+	}
+	if db == nil {
+		t.Fatalf("unknown backend %q", name)
+	}
+	if err := db.CreateFolder(); err != nil {
+		t.Fatalf("create folder: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	fmt.Println("created")
+	if err := db.OpenReadWrite(); err != nil {
+		t.Fatalf("open read-write: %v", err)
+	}
+	acks := 0
+	for gen := 1; gen < 100; gen++ {
+		for i := 0; i < crashDirsize; i++ {
+			key := keyset.GenerateKey(i)
+			if err := db.Put(key, crashValue(gen, key)); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			fmt.Printf("ack %d %d\n", i, gen)
+			if acks++; acks == kill.writes {
+				killSelf()
+			}
+		}
+	}
+	_ = db.Close()
+}
+
+func TestCrashConsistency(t *testing.T) {
+	if testing.Short() {
+		t.Skip("crash testing spawns child processes")
+	}
+	seed := time.Now().UnixNano()
+	if s := os.Getenv(crashSeedEnv); s != "" {
+		var err error
+		if seed, err = strconv.ParseInt(s, 10, 64); err != nil {
+			t.Fatalf("parse %s: %v", crashSeedEnv, err)
+		}
+	}
+	t.Logf("kill points from seed %d, set %s to repeat them", seed, crashSeedEnv)
+	for i, backend := range crashBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			// every backend draws its own kill points, so a single one can be repeated
+			rng := rand.New(rand.NewSource(seed + int64(i)))
+			var duringCreate, unopenable, verified int
+			for run := 0; run < crashIterations; run++ {
+				// a quarter of the runs die inside CreateFolder, the rest after some updates
+				kill := crashKill{writes: 1 + rng.Intn(2*crashDirsize)}
+				if rng.Intn(4) == 0 {
+					kill = crashKill{create: true, writes: rng.Intn(crashDirsize)}
+				}
+				path := filepath.Join(t.TempDir(), backend.name)
+				created, acked := crashOnce(t, backend.name, path, kill)
+				if !created {
+					duringCreate++
+				}
+				n, opened := verifyCrash(t, backend.open(path, nil, t), created, acked)
+				if !opened {
+					unopenable++
+				}
+				verified += n
+			}
+			t.Logf("%s: %d runs, %d killed during CreateFolder (%d of them unopenable), %d acknowledged writes verified",
+				backend.name, crashIterations, duringCreate, unopenable, verified)
+		})
+	}
+}
+
+// crashOnce starts a child populating the named backend at path, which kills itself at kill.
+// It returns whether CreateFolder completed and the last acknowledged generation per index.
+func crashOnce(t *testing.T, name, path string, kill crashKill) (bool, map[int]int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCrashChild$")
+	cmd.Env = append(os.Environ(), crashBackendEnv+"="+name, crashPathEnv+"="+path, crashKillEnv+"="+kill.String())
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("stdout pipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start child: %v", err)
+	}
+	created := false
+	acked := make(map[int]int)
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "created":
+			created = true
+		case strings.HasPrefix(line, "ack "):
+			var index, gen int
+			if _, err := fmt.Sscanf(line, "ack %d %d", &index, &gen); err != nil {
+				t.Fatalf("parse %q: %v", line, err)
+			}
+			acked[index] = gen
+		}
+	}
+	err = cmd.Wait()
+	if err == nil || !strings.Contains(err.Error(), "killed") {
+		t.Fatalf("child at kill point %s was not killed: %v\n%s", kill, err, stderr.String())
+	}
+	return created, acked
+}
+
+// verifyCrash reopens a crashed store and checks that every acknowledged write survived.
+// It returns the number of entries verified and whether the store could be opened. A store
+// killed inside its first CreateFolder has acknowledged nothing, so it may be left unopenable.
+func verifyCrash(t *testing.T, db crashDB, created bool, acked map[int]int) (int, bool) {
+	t.Helper()
+	// a normal open gets to run recovery (journal rollback, WAL replay) first
+	if err := db.OpenReadWrite(); err != nil {
+		if !created {
+			t.Logf("open after crash in CreateFolder: %v", err)
+			return 0, false
+		}
+		t.Fatalf("open after crash: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close after crash: %v", err)
+	}
+	if err := db.OpenReadOnly(); err != nil {
+		if !created {
+			t.Logf("open readonly after crash in CreateFolder: %v", err)
+			return 0, false
+		}
+		t.Fatalf("open readonly after crash: %v", err)
+	}
+	defer db.Close()
+	if !created {
+		return 0, true
+	}
+	for i := 0; i < crashDirsize; i++ {
+		value, err := db.Lookup(i, true)
+		if err != nil {
+			t.Fatalf("lookup %d after crash: %v", i, err)
+		}
+		if gen := crashGeneration(value); gen < acked[i] {
+			t.Fatalf("index %d: found generation %d, but generation %d was acknowledged", i, gen, acked[i])
+		}
+	}
+	return crashDirsize, true
+}
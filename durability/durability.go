@@ -0,0 +1,32 @@
+// Package durability defines how hard a backend works to get writes onto stable storage,
+// so that CreateFolder numbers can be compared between backends like for like.
+package durability
+
+import "fmt"
+
+// Mode selects when a backend fsyncs.
+type Mode int
+
+const (
+	// PerBatch commits a whole batch of writes with a single fsync. This is the default.
+	PerBatch Mode = iota
+	// None never fsyncs and leaves writeback to the OS.
+	None
+	// PerOp commits and fsyncs every write on its own.
+	PerOp
+)
+
+// Modes lists every durability mode, weakest first.
+var Modes = []Mode{None, PerBatch, PerOp}
+
+func (m Mode) String() string {
+	switch m {
+	case None:
+		return "none"
+	case PerBatch:
+		return "per-batch"
+	case PerOp:
+		return "per-op"
+	}
+	return fmt.Sprintf("mode(%d)", int(m))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/perbu/db-shootout/badgerdb"
+	"github.com/perbu/db-shootout/bitcask"
+	"github.com/perbu/db-shootout/boltdb"
+	"github.com/perbu/db-shootout/btree"
+	cdbdb64 "github.com/perbu/db-shootout/cdb64"
+	cdbdb "github.com/perbu/db-shootout/cdbdb"
+	"github.com/perbu/db-shootout/durability"
+	"github.com/perbu/db-shootout/fsdir"
+	"github.com/perbu/db-shootout/memdb"
+	"github.com/perbu/db-shootout/pebbledb"
+	"github.com/perbu/db-shootout/sqlite"
+)
+
+// creator is the part of a backend needed to benchmark CreateFolder.
+type creator interface {
+	CreateFolder() error
+	Delete() error
+}
+
+var durabilityBackends = []struct {
+	name string
+	new  func(mode durability.Mode, b *testing.B) creator
+}{
+	{"Sqlite", func(mode durability.Mode, b *testing.B) creator {
+		return sqlite.New(filepath.Join(b.TempDir(), "test.db"), dirsize, sqlite.WithDurability(mode), sqlite.WithDataset(dataset))
+	}},
+	{"Bolt", func(mode durability.Mode, b *testing.B) creator {
+		return boltdb.New(filepath.Join(b.TempDir(), "test.db"), dirsize, boltdb.WithDurability(mode), boltdb.WithDataset(dataset))
+	}},
+	{"Pebble", func(mode durability.Mode, b *testing.B) creator {
+		return pebbledb.New(filepath.Join(b.TempDir(), "test.pebble"), dirsize, b, pebbledb.WithDurability(mode), pebbledb.WithDataset(dataset))
+	}},
+	{"Badger", func(mode durability.Mode, b *testing.B) creator {
+		return badgerdb.New(filepath.Join(b.TempDir(), "test.badger"), dirsize, badgerdb.WithDurability(mode), badgerdb.WithDataset(dataset))
+	}},
+	{"CDB", func(mode durability.Mode, b *testing.B) creator {
+		return cdbdb.New(filepath.Join(b.TempDir(), "test.cdbdb"), dirsize, cdbdb.WithDurability(mode), cdbdb.WithDataset(dataset))
+	}},
+	{"CDB64", func(mode durability.Mode, b *testing.B) creator {
+		return cdbdb64.New(filepath.Join(b.TempDir(), "test.cdb64"), dirsize, cdbdb64.WithDurability(mode), cdbdb64.WithDataset(dataset))
+	}},
+	{"Bitcask", func(mode durability.Mode, b *testing.B) creator {
+		return bitcask.New(filepath.Join(b.TempDir(), "test.bitcask"), dirsize, bitcask.WithDurability(mode), bitcask.WithDataset(dataset))
+	}},
+	{"BTree", func(mode durability.Mode, b *testing.B) creator {
+		return btree.New(filepath.Join(b.TempDir(), "test.btree"), dirsize, btree.WithDurability(mode), btree.WithDataset(dataset))
+	}},
+	{"MemDB", func(mode durability.Mode, b *testing.B) creator {
+		return memdb.New(filepath.Join(b.TempDir(), "test.memdb"), dirsize, memdb.WithDurability(mode), memdb.WithDataset(dataset))
+	}},
+	{"FSDir", func(mode durability.Mode, b *testing.B) creator {
+		return fsdir.New(filepath.Join(b.TempDir(), "test.fsdir"), dirsize, fsdir.WithDurability(mode), fsdir.WithDataset(dataset))
+	}},
+}
+
+// BenchmarkCreateFolderDurability runs CreateFolder for every backend under every durability mode.
+func BenchmarkCreateFolderDurability(b *testing.B) {
+	for _, backend := range durabilityBackends {
+		for _, mode := range durability.Modes {
+			b.Run(fmt.Sprintf("%s/%s", backend.name, mode), func(b *testing.B) {
+				db := backend.new(mode, b)
+				for i := 0; i < b.N; i++ {
+					if err := db.CreateFolder(); err != nil {
+						b.Fatalf("create folder: %v", err)
+					}
+					if err := db.Delete(); err != nil {
+						b.Fatalf("delete: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,143 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/perbu/db-shootout/badgerdb"
+	cdbdb64 "github.com/perbu/db-shootout/cdb64"
+	cdbdb "github.com/perbu/db-shootout/cdbdb"
+)
+
+const (
+	fsizeBackendEnv = "SHOOTOUT_FSIZE_BACKEND"
+	fsizePathEnv    = "SHOOTOUT_FSIZE_PATH"
+)
+
+// fsizePublisher is the part of a backend the file size test needs.
+type fsizePublisher interface {
+	CreateFolder() error
+	OpenReadOnly() error
+	Close() error
+	Lookup(index int, valid bool) (string, error)
+}
+
+// fsizeBackends lists whether the previous generation survives a failed CreateFolder.
+// Badger leaves an empty memtable file behind that it cannot open again, read-only or not.
+var fsizeBackends = []struct {
+	name     string
+	new      func(path string) fsizePublisher
+	survives bool
+}{
+	{"cdb", func(path string) fsizePublisher { return cdbdb.New(path, faultDirsize) }, true},
+	{"cdb64", func(path string) fsizePublisher { return cdbdb64.New(path, faultDirsize) }, true},
+	{"badger", func(path string) fsizePublisher { return badgerFsize{badgerdb.New(path, faultDirsize)} }, false},
+}
+
+// badgerFsize restores the errno badger formats into the message of a failed truncate
+// instead of wrapping it.
+type badgerFsize struct {
+	*badgerdb.BadgerDB
+}
+
+func (b badgerFsize) CreateFolder() error {
+	err := b.BadgerDB.CreateFolder()
+	if err != nil && strings.Contains(err.Error(), syscall.EFBIG.Error()) {
+		return fmt.Errorf("%w: %w", err, syscall.EFBIG)
+	}
+	return err
+}
+
+// TestFaultFileSizeLimitChild rebuilds the store under a lowered RLIMIT_FSIZE. The limit
+// covers every file the process writes, the test log included, so it runs in a child of
+// TestFaultFileSizeLimit.
+func TestFaultFileSizeLimitChild(t *testing.T) {
+	name := os.Getenv(fsizeBackendEnv)
+	if name == "" {
+		t.Skip("only run as a child of TestFaultFileSizeLimit")
+	}
+	var db fsizePublisher
+	for _, backend := range fsizeBackends {
+		if backend.name == name {
+			db = backend.new(os.Getenv(fsizePathEnv))
+		}
+	}
+	if db == nil {
+		t.Fatalf("unknown backend %q", name)
+	}
+	// the default action for SIGXFSZ is to kill the process
+	signal.Ignore(syscall.SIGXFSZ)
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &limit); err != nil {
+		t.Fatalf("getrlimit: %v", err)
+	}
+	// both formats need more than 5 KiB for faultDirsize entries
+	lowered := syscall.Rlimit{Cur: 5 << 10, Max: limit.Max}
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &lowered); err != nil {
+		fmt.Println("skip:", err)
+		return
+	}
+	if err := db.CreateFolder(); !errors.Is(err, syscall.EFBIG) {
+		t.Fatalf("expected a wrapped EFBIG, got %v", err)
+	}
+}
+
+// TestFaultFileSizeLimit makes writes fail with EFBIG halfway through CreateFolder, and
+// checks that the previous generation survives where the backend promises it. Unlike
+// TestFaultReadOnlyDir this works as root.
+func TestFaultFileSizeLimit(t *testing.T) {
+	for _, backend := range fsizeBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), backend.name)
+			db := backend.new(path)
+			if err := db.CreateFolder(); err != nil {
+				t.Fatalf("create folder: %v", err)
+			}
+			// some stores keep the handle CreateFolder wrote through
+			if err := db.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+			cmd := exec.Command(os.Args[0], "-test.run=^TestFaultFileSizeLimitChild$")
+			cmd.Env = append(os.Environ(), fsizeBackendEnv+"="+backend.name, fsizePathEnv+"="+path)
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("child failed: %v\n%s", err, out)
+			}
+			if reason, ok := cutLine(string(out), "skip: "); ok {
+				t.Skipf("setrlimit: %s", reason)
+			}
+			if !backend.survives {
+				return
+			}
+			// the previous generation is still complete
+			if err := db.OpenReadOnly(); err != nil {
+				t.Fatalf("open readonly: %v", err)
+			}
+			defer db.Close()
+			for i := 0; i < faultDirsize; i++ {
+				if _, err := db.Lookup(i, true); err != nil {
+					t.Fatalf("lookup after failed publish: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// cutLine returns the rest of the first line of out starting with prefix.
+func cutLine(out, prefix string) (string, bool) {
+	for _, line := range strings.Split(out, "\n") {
+		if rest, ok := strings.CutPrefix(line, prefix); ok {
+			return rest, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/perbu/db-shootout/badgerdb"
+	"github.com/perbu/db-shootout/boltdb"
+	cdbdb64 "github.com/perbu/db-shootout/cdb64"
+	cdbdb "github.com/perbu/db-shootout/cdbdb"
+	"github.com/perbu/db-shootout/faultfs"
+	"github.com/perbu/db-shootout/pebbledb"
+	"github.com/perbu/db-shootout/sqlite"
+	zsqlite "zombiezen.com/go/sqlite"
+)
+
+const faultDirsize = 100
+
+// faultPoints spreads injection points over the total number of operations seen in a clean run.
+func faultPoints(total int) []int {
+	points := []int{0, total / 4, total / 2, total - 1}
+	var uniq []int
+	for i, p := range points {
+		if i == 0 || p > uniq[len(uniq)-1] {
+			uniq = append(uniq, p)
+		}
+	}
+	return uniq
+}
+
+// countOps runs fn against an injector that never fires and returns how many ops it saw.
+func countOps(t *testing.T, ops faultfs.Op, fn func(inj *faultfs.Injector)) int {
+	t.Helper()
+	inj := faultfs.NewInjector(faultfs.IOError, ops, math.MaxInt)
+	fn(inj)
+	return inj.Seen()
+}
+
+// fatalLogger turns pebble's fatal errors into a panic the test can recover from.
+// Pebble deliberately stops on failed WAL and MANIFEST writes instead of returning them.
+type fatalLogger struct{}
+
+type pebbleFatal struct {
+	err error
+}
+
+func (fatalLogger) Infof(format string, args ...interface{})  {}
+func (fatalLogger) Errorf(format string, args ...interface{}) {}
+func (fatalLogger) Fatalf(format string, args ...interface{}) {
+	err := errors.New("no cause")
+	for _, arg := range args {
+		if e, ok := arg.(error); ok {
+			err = e
+		}
+	}
+	panic(pebbleFatal{err: fmt.Errorf("pebble fatal: %s: %w", fmt.Sprintf(format, args...), err)})
+}
+
+// recoverFatal converts a pebbleFatal panic into *err and re-panics anything else.
+func recoverFatal(err *error) {
+	if r := recover(); r != nil {
+		fatal, ok := r.(pebbleFatal)
+		if !ok {
+			panic(r)
+		}
+		*err = fatal.err
+	}
+}
+
+// requireFault checks that err is the injected fault, wrapped.
+func requireFault(t *testing.T, fault faultfs.Fault, err error) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("%s injected, but no error surfaced", fault)
+	}
+	if !errors.Is(err, fault.Err()) {
+		t.Fatalf("%s injected, got unrelated error: %v", fault, err)
+	}
+}
+
+func TestFaultPebbleCreate(t *testing.T) {
+	createWith := func(t *testing.T, dir string, inj *faultfs.Injector) (err error) {
+		defer recoverFatal(&err)
+		db := pebbledb.New(filepath.Join(dir, "test.pebble"), faultDirsize, t,
+			pebbledb.WithFS(faultfs.Wrap(vfs.Default, inj).Only(".log", ".sst")),
+			pebbledb.WithLogger(fatalLogger{}))
+		err = db.CreateFolder()
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+	for _, fault := range faultfs.Faults {
+		// a short write only fires on writes, so its injection points skip the syncs
+		ops := faultfs.OpWrite | faultfs.OpSync
+		if fault == faultfs.ShortWrite {
+			ops = faultfs.OpWrite
+		}
+		total := countOps(t, ops, func(inj *faultfs.Injector) {
+			if err := createWith(t, t.TempDir(), inj); err != nil {
+				t.Fatalf("clean create: %v", err)
+			}
+		})
+		for _, after := range faultPoints(total) {
+			t.Run(fmt.Sprintf("%s/after-%d", fault, after), func(t *testing.T) {
+				dir := t.TempDir()
+				inj := faultfs.NewInjector(fault, ops, after)
+				requireFault(t, fault, createWith(t, dir, inj))
+				// whatever made it to disk must open without the faults, or fail cleanly
+				db := pebbledb.New(filepath.Join(dir, "test.pebble"), faultDirsize, t)
+				if err := db.OpenReadOnly(); err == nil {
+					for i := 0; i < faultDirsize; i++ {
+						_, _ = db.Lookup(i, true)
+					}
+					_ = db.Close()
+				}
+			})
+		}
+	}
+}
+
+func TestFaultPebbleRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.pebble")
+	db := pebbledb.New(path, faultDirsize, t)
+	if err := db.CreateFolder(); err != nil {
+		t.Fatalf("create folder: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	readWith := func(t *testing.T, inj *faultfs.Injector) (err error) {
+		defer recoverFatal(&err)
+		db := pebbledb.New(path, faultDirsize, t,
+			pebbledb.WithFS(faultfs.Wrap(vfs.Default, inj).Only(".log", ".sst")),
+			pebbledb.WithLogger(fatalLogger{}))
+		if err := db.OpenReadOnly(); err != nil {
+			return err
+		}
+		defer db.Close()
+		for i := 0; i < faultDirsize; i++ {
+			if _, err := db.Lookup(i, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	total := countOps(t, faultfs.OpRead, func(inj *faultfs.Injector) {
+		if err := readWith(t, inj); err != nil {
+			t.Fatalf("clean read: %v", err)
+		}
+	})
+	for _, after := range faultPoints(total) {
+		t.Run(fmt.Sprintf("eio/after-%d", after), func(t *testing.T) {
+			requireFault(t, faultfs.IOError, readWith(t, faultfs.NewInjector(faultfs.IOError, faultfs.OpRead, after)))
+		})
+	}
+}
+
+// TestFaultDiskFull points the single-file backends at /dev/full. The CDB backends write
+// to a temporary file and rename it over the target, see TestFaultFileSizeLimit instead.
+func TestFaultDiskFull(t *testing.T) {
+	backends := []struct {
+		name   string
+		create func(path string) error
+	}{
+		{"sqlite", func(path string) error {
+			err := sqlite.New(path, faultDirsize).CreateFolder()
+			if zsqlite.ErrCode(err) == zsqlite.ResultFull {
+				// sqlite reports its own SQLITE_FULL rather than the errno
+				return fmt.Errorf("%w: %w", err, syscall.ENOSPC)
+			}
+			return err
+		}},
+		{"bolt", func(path string) error {
+			db := boltdb.New(path, faultDirsize)
+			defer db.Close()
+			return db.CreateFolder()
+		}},
+	}
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			path, err := faultfs.DiskFull(t.TempDir(), backend.name)
+			if err != nil {
+				t.Skipf("disk full: %v", err)
+			}
+			requireFault(t, faultfs.NoSpace, backend.create(path))
+		})
+	}
+}
+
+// TestFaultReadOnlyDir creates the directory based backends in a directory that cannot be written.
+func TestFaultReadOnlyDir(t *testing.T) {
+	dir, err := faultfs.ReadOnlyDir(t.TempDir(), "readonly")
+	if err != nil {
+		t.Skipf("read-only dir: %v", err)
+	}
+	db := badgerdb.New(filepath.Join(dir, "test.badger"), faultDirsize)
+	if err := db.CreateFolder(); err == nil {
+		t.Fatalf("create folder in read-only dir succeeded")
+	}
+	pdb := pebbledb.New(filepath.Join(dir, "test.pebble"), faultDirsize, t)
+	if err := pdb.CreateFolder(); err == nil {
+		t.Fatalf("create folder in read-only dir succeeded")
+	}
+}
+
+// TestFaultTruncated cuts the single-file backends in half after creation, the closest
+// a plain scratch directory gets to a failing read, and checks reads fail with the error
+// the store reports for a short file instead of panicking or reporting a miss.
+func TestFaultTruncated(t *testing.T) {
+	type reader interface {
+		CreateFolder() error
+		OpenReadOnly() error
+		Close() error
+		Lookup(index int, valid bool) (string, error)
+	}
+	backends := []struct {
+		name    string
+		new     func(path string) reader
+		corrupt func(err error) bool
+	}{
+		{"sqlite", func(path string) reader { return sqlite.New(path, faultDirsize) }, func(err error) bool {
+			return zsqlite.ErrCode(err) == zsqlite.ResultCorrupt
+		}},
+		{"bolt", func(path string) reader { return boltdb.New(path, faultDirsize) }, func(err error) bool {
+			return errors.Is(err, io.ErrUnexpectedEOF)
+		}},
+		// the stream reader runs into the end of the file reading a hash table
+		{"cdb", func(path string) reader { return cdbdb.New(path, faultDirsize) }, func(err error) bool {
+			return errors.Is(err, io.EOF)
+		}},
+		{"cdb64", func(path string) reader { return cdbdb64.New(path, faultDirsize) }, func(err error) bool {
+			return errors.Is(err, io.ErrUnexpectedEOF)
+		}},
+	}
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), backend.name)
+			db := backend.new(path)
+			if err := db.CreateFolder(); err != nil {
+				t.Fatalf("create folder: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("stat: %v", err)
+			}
+			if err := os.Truncate(path, info.Size()/2); err != nil {
+				t.Fatalf("truncate: %v", err)
+			}
+			err = db.OpenReadOnly()
+			if err == nil {
+				defer db.Close()
+				for i := 0; i < faultDirsize && err == nil; i++ {
+					_, err = db.Lookup(i, true)
+				}
+			}
+			if err == nil {
+				t.Fatalf("every lookup succeeded on a truncated file")
+			}
+			if !backend.corrupt(err) {
+				t.Fatalf("truncated file, got unrelated error: %v", err)
+			}
+		})
+	}
+}
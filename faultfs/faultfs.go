@@ -0,0 +1,250 @@
+// Package faultfs injects I/O faults into the storage backends so their error
+// paths can be exercised. Pebble takes a vfs.FS, which is wrapped directly by FS.
+// The file based backends are pointed at scratch locations that fail instead.
+package faultfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// Fault is the kind of failure to inject.
+type Fault int
+
+const (
+	NoSpace    Fault = iota // writes fail with ENOSPC
+	IOError                 // reads and writes fail with EIO
+	ShortWrite              // writes persist half the buffer and fail with io.ErrShortWrite
+)
+
+// Faults lists every fault kind, for building test matrices.
+var Faults = []Fault{NoSpace, IOError, ShortWrite}
+
+func (f Fault) String() string {
+	switch f {
+	case NoSpace:
+		return "enospc"
+	case IOError:
+		return "eio"
+	case ShortWrite:
+		return "short-write"
+	}
+	return fmt.Sprintf("fault(%d)", int(f))
+}
+
+// Err returns the error a backend should surface (wrapped) when the fault fires.
+func (f Fault) Err() error {
+	switch f {
+	case NoSpace:
+		return syscall.ENOSPC
+	case IOError:
+		return syscall.EIO
+	case ShortWrite:
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// Op is a set of file operations an Injector interferes with.
+type Op int
+
+const (
+	OpWrite Op = 1 << iota
+	OpSync
+	OpRead
+)
+
+// Injector lets the first `after` matching operations through and fails every one after that.
+type Injector struct {
+	fault    Fault
+	ops      Op
+	after    int64
+	seen     atomic.Int64
+	injected atomic.Int64
+}
+
+// NewInjector creates an Injector failing ops with fault once after operations have succeeded.
+// A short write only applies to writes; other operations are let through uncounted.
+func NewInjector(fault Fault, ops Op, after int) *Injector {
+	return &Injector{fault: fault, ops: ops, after: int64(after)}
+}
+
+// Injected returns the number of faults injected so far.
+func (i *Injector) Injected() int {
+	return int(i.injected.Load())
+}
+
+// Seen returns the number of matching operations so far, failed or not.
+func (i *Injector) Seen() int {
+	return int(i.seen.Load())
+}
+
+// check returns the error to fail op with, or nil to let it through.
+func (i *Injector) check(op Op) error {
+	if i.ops&op == 0 || i.fault == ShortWrite && op != OpWrite {
+		return nil
+	}
+	if i.seen.Add(1) <= i.after {
+		return nil
+	}
+	i.injected.Add(1)
+	return i.fault.Err()
+}
+
+// FS wraps a pebble vfs.FS and injects faults into the files it opens.
+type FS struct {
+	vfs.FS
+	inj      *Injector
+	suffixes []string
+}
+
+// Wrap returns fs with faults from inj injected into its files.
+func Wrap(fs vfs.FS, inj *Injector) *FS {
+	return &FS{FS: fs, inj: inj}
+}
+
+// Only restricts injection to files whose names end in one of suffixes.
+// Pebble treats a failing MANIFEST as fatal and exits, so tests aim at the WAL and sstables.
+func (fs *FS) Only(suffixes ...string) *FS {
+	fs.suffixes = suffixes
+	return fs
+}
+
+func (fs *FS) Create(name string) (vfs.File, error) {
+	f, err := fs.FS.Create(name)
+	return fs.wrap(name, f, err)
+}
+
+func (fs *FS) Open(name string, opts ...vfs.OpenOption) (vfs.File, error) {
+	f, err := fs.FS.Open(name, opts...)
+	return fs.wrap(name, f, err)
+}
+
+func (fs *FS) OpenReadWrite(name string, opts ...vfs.OpenOption) (vfs.File, error) {
+	f, err := fs.FS.OpenReadWrite(name, opts...)
+	return fs.wrap(name, f, err)
+}
+
+func (fs *FS) ReuseForWrite(oldname, newname string) (vfs.File, error) {
+	f, err := fs.FS.ReuseForWrite(oldname, newname)
+	return fs.wrap(newname, f, err)
+}
+
+func (fs *FS) wrap(name string, f vfs.File, err error) (vfs.File, error) {
+	if err != nil {
+		return nil, err
+	}
+	if !fs.matches(name) {
+		return f, nil
+	}
+	return &file{File: f, inj: fs.inj}, nil
+}
+
+func (fs *FS) matches(name string) bool {
+	if len(fs.suffixes) == 0 {
+		return true
+	}
+	for _, suffix := range fs.suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// file injects faults into reads, writes and syncs of a vfs.File.
+type file struct {
+	vfs.File
+	inj *Injector
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if err := f.inj.check(OpRead); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.inj.check(OpRead); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	if err := f.inj.check(OpWrite); err != nil {
+		if errors.Is(err, io.ErrShortWrite) {
+			n, _ := f.File.Write(p[:len(p)/2])
+			return n, err
+		}
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *file) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.inj.check(OpWrite); err != nil {
+		if errors.Is(err, io.ErrShortWrite) {
+			n, _ := f.File.WriteAt(p[:len(p)/2], off)
+			return n, err
+		}
+		return 0, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *file) Sync() error {
+	if err := f.inj.check(OpSync); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func (f *file) SyncData() error {
+	if err := f.inj.check(OpSync); err != nil {
+		return err
+	}
+	return f.File.SyncData()
+}
+
+func (f *file) SyncTo(length int64) (bool, error) {
+	if err := f.inj.check(OpSync); err != nil {
+		return false, err
+	}
+	return f.File.SyncTo(length)
+}
+
+// DiskFull returns a path in dir where every write fails with ENOSPC.
+// It is a symlink to /dev/full, so it only works for backends storing a single file.
+func DiskFull(dir, name string) (string, error) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		return "", fmt.Errorf("no /dev/full: %w", err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.Symlink("/dev/full", path); err != nil {
+		return "", fmt.Errorf("symlink: %w", err)
+	}
+	return path, nil
+}
+
+// ReadOnlyDir creates a directory in dir that cannot be written to.
+// Permissions are not enforced for root, in which case an error is returned.
+func ReadOnlyDir(dir, name string) (string, error) {
+	if os.Geteuid() == 0 {
+		return "", errors.New("permissions are not enforced for root")
+	}
+	path := filepath.Join(dir, name)
+	if err := os.Mkdir(path, 0o555); err != nil {
+		return "", fmt.Errorf("mkdir: %w", err)
+	}
+	return path, nil
+}
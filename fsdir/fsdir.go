@@ -0,0 +1,281 @@
+// Package fsdir stores the folder as a real directory, one file per entry, as the
+// baseline the other backends are meant to replace.
+package fsdir
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/perbu/db-shootout/atomicfile"
+	"github.com/perbu/db-shootout/durability"
+	"github.com/perbu/db-shootout/keyset"
+)
+
+// Storage selects where the content of an entry is kept.
+type Storage int
+
+const (
+	// StorageFile keeps the content as the file's data. This is the default.
+	StorageFile Storage = iota
+	// StorageXattr keeps the content in a user.content extended attribute of an empty file.
+	StorageXattr
+)
+
+func (s Storage) String() string {
+	switch s {
+	case StorageFile:
+		return "file"
+	case StorageXattr:
+		return "xattr"
+	default:
+		return fmt.Sprintf("storage(%d)", int(s))
+	}
+}
+
+// xattrName is the extended attribute holding the content with StorageXattr.
+const xattrName = "user.content"
+
+// defaultBatch is the number of entries Next reads from the directory at a time.
+const defaultBatch = 128
+
+// FSDir implements the BenchmarkDB interface on top of the filesystem.
+type FSDir struct {
+	dirname string
+	dirsize int
+	storage Storage
+	batch   int
+	mode    durability.Mode
+	data    *keyset.Dataset
+
+	dir     *os.File      // open directory, read by Next
+	entries []os.DirEntry // entries read from dir but not returned yet
+	done    bool
+}
+
+// Option configures an FSDir.
+type Option func(*FSDir)
+
+// WithStorage selects where the content of an entry is kept.
+func WithStorage(storage Storage) Option {
+	return func(d *FSDir) {
+		d.storage = storage
+	}
+}
+
+// WithBatch sets the number of entries Next reads from the directory at a time.
+func WithBatch(n int) Option {
+	return func(d *FSDir) {
+		d.batch = n
+	}
+}
+
+// WithDurability selects when files and the directory are fsynced. A directory has no
+// batch commit, so per-batch, the default, still fsyncs every file and then the directory
+// once at the end. Per-op also fsyncs the directory after every file.
+func WithDurability(mode durability.Mode) Option {
+	return func(d *FSDir) {
+		d.mode = mode
+	}
+}
+
+// WithDataset populates the directory from a pre-generated dataset instead of generating
+// entries while writing.
+func WithDataset(data *keyset.Dataset) Option {
+	return func(d *FSDir) {
+		d.data = data
+	}
+}
+
+// New creates a new FSDir keeping its entries in the directory dirname.
+func New(dirname string, dirsize int, opts ...Option) *FSDir {
+	d := &FSDir{
+		dirname: dirname,
+		dirsize: dirsize,
+		batch:   defaultBatch,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// OpenReadOnly opens the directory for Next.
+func (d *FSDir) OpenReadOnly() error {
+	dir, err := os.Open(d.dirname)
+	if err != nil {
+		return fmt.Errorf("open directory: %w", err)
+	}
+	d.dir = dir
+	d.entries = nil
+	d.done = false
+	return nil
+}
+
+// CreateFolder creates the directory and one file per entry.
+func (d *FSDir) CreateFolder() error {
+	if err := os.MkdirAll(d.dirname, 0o755); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+	if err := d.Populate(); err != nil {
+		return fmt.Errorf("populate: %w", err)
+	}
+	return nil
+}
+
+// Populate writes dirsize files into the directory.
+func (d *FSDir) Populate() error {
+	for i := 0; i < d.dirsize; i++ {
+		if err := d.writeEntry(d.data.Key(i), d.data.Value(i)); err != nil {
+			return err
+		}
+		if d.mode == durability.PerOp {
+			if err := atomicfile.SyncDir(d.dirname); err != nil {
+				return fmt.Errorf("sync directory: %w", err)
+			}
+		}
+	}
+	if d.mode == durability.PerBatch {
+		if err := atomicfile.SyncDir(d.dirname); err != nil {
+			return fmt.Errorf("sync directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// writeEntry creates the file for one entry.
+func (d *FSDir) writeEntry(name, value string) error {
+	f, err := os.Create(filepath.Join(d.dirname, name))
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	switch d.storage {
+	case StorageXattr:
+		err = setxattr(f, xattrName, []byte(value))
+	default:
+		_, err = io.WriteString(f, value)
+	}
+	if err == nil && d.mode != durability.None {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+	return nil
+}
+
+// Delete removes the directory and every file in it.
+func (d *FSDir) Delete() error {
+	if err := d.Close(); err != nil {
+		return err
+	}
+	return os.RemoveAll(d.dirname)
+}
+
+// Close closes the directory opened for Next.
+func (d *FSDir) Close() error {
+	if d.dir != nil {
+		err := d.dir.Close()
+		d.dir = nil
+		d.entries = nil
+		return err
+	}
+	return nil
+}
+
+// Next returns the next file name, in directory order, reading the directory in batches.
+func (d *FSDir) Next() (string, bool, error) {
+	if d.done {
+		return "", false, nil
+	}
+	if d.dir == nil {
+		return "", false, fmt.Errorf("directory is not open")
+	}
+	if len(d.entries) == 0 {
+		entries, err := d.dir.ReadDir(d.batch)
+		if errors.Is(err, io.EOF) || (err == nil && len(entries) == 0) {
+			d.done = true
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("read directory: %w", err)
+		}
+		d.entries = entries
+	}
+	name := d.entries[0].Name()
+	d.entries = d.entries[1:]
+	return name, true, nil
+}
+
+// PrefixScan returns the names starting with prefix in directory order. A directory can
+// only be listed whole, so this reads every name, the way a shell expands a glob.
+func (d *FSDir) PrefixScan(prefix string) ([]string, error) {
+	dir, err := os.Open(d.dirname)
+	if err != nil {
+		return nil, fmt.Errorf("open directory: %w", err)
+	}
+	defer dir.Close()
+	var names []string
+	for {
+		batch, err := dir.Readdirnames(d.batch)
+		for _, name := range batch {
+			if strings.HasPrefix(name, prefix) {
+				names = append(names, name)
+			}
+		}
+		if errors.Is(err, io.EOF) || (err == nil && len(batch) == 0) {
+			return names, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read directory: %w", err)
+		}
+	}
+}
+
+// ReadPage returns up to limit names after cursor, and the cursor of the next page. Like an
+// NFS server, it opens the directory for every page and resumes from the cursor: a
+// directory offset on Linux, the last name elsewhere. The next cursor is empty after the
+// last page.
+func (d *FSDir) ReadPage(cursor string, limit int) ([]string, string, error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	return readPage(d.dirname, cursor, limit)
+}
+
+// Lookup reads the content of the entry at the given index.
+func (d *FSDir) Lookup(index int, valid bool) (string, error) {
+	if index < 0 || index >= d.dirsize {
+		return "", fmt.Errorf("index out of bounds")
+	}
+	var filename string
+	switch valid {
+	case true:
+		filename = keyset.GenerateKey(index)
+	case false:
+		filename = keyset.GenerateInvalidKey(index)
+	}
+	path := filepath.Join(d.dirname, filename)
+	var content []byte
+	var err error
+	switch d.storage {
+	case StorageXattr:
+		content, err = getxattr(path, xattrName)
+	default:
+		content, err = os.ReadFile(path)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("no row found")
+	}
+	if err != nil {
+		return "", fmt.Errorf("read %s: %w", filename, err)
+	}
+	return string(content), nil
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+
+package fsdir
+
+import (
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/perbu/db-shootout/keyset"
+)
+
+// readPage reads up to limit names after the name in cursor, in name order. Without
+// directory offsets to seek to, every page lists and sorts the whole directory.
+func readPage(dirname, cursor string, limit int) ([]string, string, error) {
+	dir, err := os.Open(dirname)
+	if err != nil {
+		return nil, "", fmt.Errorf("open directory: %w", err)
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil, "", fmt.Errorf("read directory: %w", err)
+	}
+	slices.Sort(names)
+	i, _ := slices.BinarySearch(names, keyset.KeyAfter(cursor))
+	end := min(i+limit, len(names))
+	if end == len(names) {
+		return names[i:end], "", nil
+	}
+	return names[i:end], names[end-1], nil
+}
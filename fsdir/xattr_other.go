@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+
+package fsdir
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoXattr = errors.New("extended attributes are not supported on this platform")
+
+func setxattr(f *os.File, name string, value []byte) error {
+	return errNoXattr
+}
+
+func getxattr(path, name string) ([]byte, error) {
+	return nil, errNoXattr
+}
@@ -0,0 +1,33 @@
+//go:build linux || darwin
+
+package fsdir
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func setxattr(f *os.File, name string, value []byte) error {
+	return unix.Fsetxattr(int(f.Fd()), name, value, 0)
+}
+
+func getxattr(path, name string) ([]byte, error) {
+	// the content is 64 bytes, so a small buffer usually avoids asking for the size first
+	buf := make([]byte, 128)
+	for {
+		n, err := unix.Getxattr(path, name, buf)
+		if err == unix.ERANGE {
+			size, err := unix.Getxattr(path, name, nil)
+			if err != nil {
+				return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+			}
+			buf = make([]byte, size)
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+		return buf[:n], nil
+	}
+}
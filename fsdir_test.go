@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/perbu/db-shootout/durability"
+	"github.com/perbu/db-shootout/fsdir"
+)
+
+var fsdirStorages = []fsdir.Storage{fsdir.StorageFile, fsdir.StorageXattr}
+
+// newFSDir creates a populated directory, skipping when the filesystem has no user xattrs.
+func newFSDir(tb testing.TB, storage fsdir.Storage, opts ...fsdir.Option) *fsdir.FSDir {
+	opts = append([]fsdir.Option{fsdir.WithStorage(storage), fsdir.WithDataset(dataset)}, opts...)
+	db := fsdir.New(filepath.Join(tb.TempDir(), "test.fsdir"), dirsize, opts...)
+	if err := db.CreateFolder(); err != nil {
+		if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP) {
+			tb.Skipf("%s storage: %v", storage, err)
+		}
+		tb.Fatalf("create folder: %v", err)
+	}
+	return db
+}
+
+// BenchmarkCreateFolderFSDir creates and deletes the directory in the default durability
+// mode, like the CreateFolder benchmarks of the other backends.
+func BenchmarkCreateFolderFSDir(b *testing.B) {
+	for _, storage := range fsdirStorages {
+		b.Run(storage.String(), func(b *testing.B) {
+			// the first create skips storages the filesystem doesn't support
+			db := newFSDir(b, storage)
+			if err := db.Delete(); err != nil {
+				b.Fatalf("delete: %v", err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := db.CreateFolder(); err != nil {
+					b.Fatalf("create folder: %v", err)
+				}
+				if err := db.Delete(); err != nil {
+					b.Fatalf("delete: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkLookupFSDir(b *testing.B) {
+	for _, storage := range fsdirStorages {
+		b.Run(storage.String(), func(b *testing.B) {
+			db := newFSDir(b, storage, fsdir.WithDurability(durability.None))
+			defer db.Delete()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Lookup(rand.Intn(dirsize), true); err != nil {
+					b.Fatalf("lookup valid: %v", err)
+				}
+			}
+			b.StopTimer()
+		})
+	}
+}
+
+// BenchmarkReaddirFSDir reads the directory with a few ReadDir batch sizes.
+func BenchmarkReaddirFSDir(b *testing.B) {
+	for _, batch := range []struct {
+		name string
+		size int
+	}{{"batch=16", 16}, {"batch=128", 128}, {"batch=1024", 1024}} {
+		b.Run(batch.name, func(b *testing.B) {
+			db := newFSDir(b, fsdir.StorageFile, fsdir.WithDurability(durability.None), fsdir.WithBatch(batch.size))
+			defer db.Delete()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := db.OpenReadOnly(); err != nil {
+					b.Fatalf("open readonly: %v", err)
+				}
+				for entry := 0; entry < dirsize; entry++ {
+					if _, _, err := db.Next(); err != nil {
+						b.Fatalf("next: %v", err)
+					}
+				}
+				if err := db.Close(); err != nil {
+					b.Fatalf("close: %v", err)
+				}
+			}
+			b.StopTimer()
+		})
+	}
+}
+
+// TestFSDir checks lookups and a full directory listing for both storages.
+func TestFSDir(t *testing.T) {
+	for _, storage := range fsdirStorages {
+		t.Run(storage.String(), func(t *testing.T) {
+			db := newFSDir(t, storage, fsdir.WithDurability(durability.None), fsdir.WithBatch(7))
+			defer db.Delete()
+			for _, i := range []int{0, dirsize / 2, dirsize - 1} {
+				if value, err := db.Lookup(i, true); err != nil || value != dataset.Value(i) {
+					t.Fatalf("lookup %d got %q, %v, want %q", i, value, err, dataset.Value(i))
+				}
+			}
+			if _, err := db.Lookup(0, false); err == nil {
+				t.Fatalf("lookup of an invalid key succeeded")
+			}
+			if err := db.OpenReadOnly(); err != nil {
+				t.Fatalf("open readonly: %v", err)
+			}
+			seen := make(map[string]bool)
+			for {
+				name, ok, err := db.Next()
+				if err != nil {
+					t.Fatalf("next: %v", err)
+				}
+				if !ok {
+					break
+				}
+				seen[name] = true
+			}
+			if len(seen) != dirsize {
+				t.Fatalf("listed %d entries, want %d", len(seen), dirsize)
+			}
+			for i := 0; i < dirsize; i++ {
+				if !seen[dataset.Key(i)] {
+					t.Fatalf("entry %q missing from listing", dataset.Key(i))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+// Package offsettable reads and writes the entry layout shared by the static file stores:
+// a table of count+1 little-endian offsets, the start of every entry relative to the first
+// and the end of the last, followed by the entries, each a key length, the key and the
+// value, which runs to the next entry. The stores differ only in how wide the offsets and
+// key lengths are, and in what comes before the table.
+package offsettable
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/perbu/db-shootout/keyset"
+)
+
+// Width is the size in bytes of an offset. A key length is half as wide.
+type Width int
+
+const (
+	// Narrow has uint32 offsets and uint16 key lengths.
+	Narrow Width = 4
+	// Wide has uint64 offsets and uint32 key lengths.
+	Wide Width = 8
+)
+
+// readUint reads a little-endian integer of size bytes.
+func readUint(b []byte, size int) uint64 {
+	if size == 8 {
+		return binary.LittleEndian.Uint64(b)
+	}
+	if size == 4 {
+		return uint64(binary.LittleEndian.Uint32(b))
+	}
+	return uint64(binary.LittleEndian.Uint16(b))
+}
+
+// Table is the offset table and the entries it points into. The zero Table is empty.
+type Table struct {
+	width   Width
+	count   int
+	offsets []byte
+	entries []byte
+}
+
+// Parse splits b into an offset table of count entries and the entries after it, and
+// checks that the last offset ends at the end of b. Entry checks every other offset as
+// it reads it.
+func (w Width) Parse(b []byte, count uint64) (Table, error) {
+	if count >= uint64(len(b))/uint64(w) {
+		return Table{}, fmt.Errorf("offset table truncated")
+	}
+	tableSize := (int(count) + 1) * int(w)
+	offsets, entries := b[:tableSize], b[tableSize:]
+	if end := readUint(offsets[tableSize-int(w):], int(w)); end != uint64(len(entries)) {
+		return Table{}, fmt.Errorf("entries truncated: want %d bytes, have %d", end, len(entries))
+	}
+	return Table{width: w, count: int(count), offsets: offsets, entries: entries}, nil
+}
+
+// Len returns the number of entries.
+func (t *Table) Len() int {
+	return t.count
+}
+
+// Size returns the bytes taken up by the offset table.
+func (t *Table) Size() int {
+	return len(t.offsets)
+}
+
+// Entry returns the key and value of the i'th entry.
+func (t *Table) Entry(i int) ([]byte, []byte, error) {
+	w, klen := int(t.width), int(t.width)/2
+	start := readUint(t.offsets[i*w:], w)
+	end := readUint(t.offsets[i*w+w:], w)
+	if start > end || end > uint64(len(t.entries)) || end-start < uint64(klen) {
+		return nil, nil, fmt.Errorf("entry %d: bad offsets %d-%d", i, start, end)
+	}
+	e := t.entries[start:end]
+	keyLen := readUint(e, klen)
+	if keyLen > uint64(len(e)-klen) {
+		return nil, nil, fmt.Errorf("entry %d: key length %d overruns the entry", i, keyLen)
+	}
+	return e[klen : uint64(klen)+keyLen], e[uint64(klen)+keyLen:], nil
+}
+
+// Keys returns the keys of entries i up to end.
+func (t *Table) Keys(i, end int) ([]string, error) {
+	keys := make([]string, 0, end-i)
+	for ; i < end; i++ {
+		key, _, err := t.Entry(i)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, string(key))
+	}
+	return keys, nil
+}
+
+// The methods below expect the entries to be in key order.
+
+// LowerBound binary-searches for the first entry whose key is not below key.
+func (t *Table) LowerBound(key []byte) (int, error) {
+	lo, hi := 0, t.count
+	for lo < hi {
+		mid := int(uint64(lo+hi) >> 1)
+		k, _, err := t.Entry(mid)
+		if err != nil {
+			return 0, err
+		}
+		if bytes.Compare(k, key) < 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// Get binary-searches for key and returns its value, or nil if the key doesn't exist.
+func (t *Table) Get(key []byte) ([]byte, error) {
+	i, err := t.LowerBound(key)
+	if err != nil || i == t.count {
+		return nil, err
+	}
+	k, v, err := t.Entry(i)
+	if err != nil || !bytes.Equal(k, key) {
+		return nil, err
+	}
+	return v, nil
+}
+
+// PrefixScan returns the keys starting with prefix in key order, binary-searching for
+// the first one and reading on from there.
+func (t *Table) PrefixScan(prefix string) ([]string, error) {
+	i, err := t.LowerBound([]byte(prefix))
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for ; i < t.count; i++ {
+		key, _, err := t.Entry(i)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(key, []byte(prefix)) {
+			break
+		}
+		keys = append(keys, string(key))
+	}
+	return keys, nil
+}
+
+// ReadPage returns up to limit keys after cursor in key order, and the cursor of the next
+// page, which is the last key returned. Each page binary-searches for its first key, so a
+// deep page costs the same as the first. The next cursor is empty after the last page.
+func (t *Table) ReadPage(cursor string, limit int) ([]string, string, error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	i, err := t.LowerBound([]byte(keyset.KeyAfter(cursor)))
+	if err != nil {
+		return nil, "", err
+	}
+	end := min(i+limit, t.count)
+	keys, err := t.Keys(i, end)
+	if err != nil {
+		return nil, "", err
+	}
+	if end == t.count {
+		return keys, "", nil
+	}
+	return keys, keys[len(keys)-1], nil
+}
+
+// Write writes the offset table and the entries of data in the given order. Every key
+// and value is read from data once, so a nil dataset generates each value once and a
+// Visit hook sees each index once. It fails before writing any entry if a key is too
+// long for the key length, or the entries too large for the offsets. The bufio.Writer
+// keeps the first write error, the caller's Flush reports it.
+func (w Width) Write(bw *bufio.Writer, data *keyset.Dataset, order []int) error {
+	var buf [8]byte
+	put := func(v uint64, size int) {
+		switch size {
+		case 8:
+			binary.LittleEndian.PutUint64(buf[:], v)
+		case 4:
+			binary.LittleEndian.PutUint32(buf[:], uint32(v))
+		default:
+			binary.LittleEndian.PutUint16(buf[:], uint16(v))
+		}
+		bw.Write(buf[:size])
+	}
+	klen := int(w) / 2
+	maxOffset, maxKey := ^uint64(0)>>(64-8*w), ^uint64(0)>>(64-4*w)
+	// the offsets come first, so hold on to the entries until they are written
+	keys, values := make([]string, len(order)), make([]string, len(order))
+	var offset uint64
+	for n, i := range order {
+		put(offset, int(w))
+		keys[n], values[n] = data.Key(i), data.Value(i)
+		if uint64(len(keys[n])) > maxKey {
+			return fmt.Errorf("key %d is %d bytes, more than %d", i, len(keys[n]), maxKey)
+		}
+		offset += uint64(klen) + uint64(len(keys[n])) + uint64(len(values[n]))
+		if offset > maxOffset {
+			return fmt.Errorf("entries take more than %d bytes", maxOffset)
+		}
+	}
+	put(offset, int(w))
+	for n := range order {
+		put(uint64(len(keys[n])), klen)
+		bw.WriteString(keys[n])
+		bw.WriteString(values[n])
+	}
+	return nil
+}
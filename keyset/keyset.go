@@ -2,13 +2,15 @@ package keyset
 
 import (
 	"fmt"
-	"math/rand"
+	"math/rand/v2"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 	"unsafe"
 )
 
-var src = rand.NewSource(time.Now().UnixNano())
-
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 const (
 	letterIdxBits = 6                    // 6 bits to represent a letter index
@@ -20,10 +22,11 @@ const (
 // stupidly fast.
 func RandString(n int) string {
 	b := make([]byte, n)
-	// A src.Int63() generates 63 random bits, enough for letterIdxMax characters!
-	for i, cache, remain := n-1, src.Int63(), letterIdxMax; i >= 0; {
+	// A rand.Int64() generates 63 random bits, enough for letterIdxMax characters!
+	// Unlike a rand.Source it is safe to call from parallel generators.
+	for i, cache, remain := n-1, rand.Int64(), letterIdxMax; i >= 0; {
 		if remain == 0 {
-			cache, remain = src.Int63(), letterIdxMax
+			cache, remain = rand.Int64(), letterIdxMax
 		}
 		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
 			b[i] = letterBytes[idx]
@@ -49,3 +52,273 @@ func GenerateInvalidKey(index int) string {
 func GenerateRandomContent(size int) string {
 	return RandString(size)
 }
+
+// Entry is one generated directory entry.
+type Entry struct {
+	Key   []byte
+	Value []byte
+}
+
+// ChunkSize is the number of entries in each chunk delivered by Generate.
+const ChunkSize = 128
+
+// GenerateChunk generates the entries for the indexes [from, to), with 64-byte random content.
+func GenerateChunk(from, to int) []Entry {
+	chunk := make([]Entry, 0, to-from)
+	for i := from; i < to; i++ {
+		chunk = append(chunk, Entry{
+			Key:   []byte(GenerateKey(i)),
+			Value: []byte(GenerateRandomContent(64)),
+		})
+	}
+	return chunk
+}
+
+// Generate generates the entries for the indexes [0, n) on workers goroutines and
+// delivers them in index order, ChunkSize entries at a time. The consumer must drain
+// the channel, which is closed after the last chunk.
+func Generate(n, workers int) <-chan []Entry {
+	if workers < 1 {
+		workers = 1
+	}
+	// chunk c is generated by worker c % workers, so reading the workers round robin
+	// gives the chunks back in order
+	outputs := make([]chan []Entry, workers)
+	for w := range outputs {
+		outputs[w] = make(chan []Entry, 2)
+		go func(w int) {
+			defer close(outputs[w])
+			for from := w * ChunkSize; from < n; from += workers * ChunkSize {
+				outputs[w] <- GenerateChunk(from, min(from+ChunkSize, n))
+			}
+		}(w)
+	}
+	chunks := make(chan []Entry, workers)
+	go func() {
+		defer close(chunks)
+		for c := 0; c*ChunkSize < n; c++ {
+			chunks <- <-outputs[c%workers]
+		}
+	}()
+	return chunks
+}
+
+// Timing splits the time spent filling a store into generating entries and storing them.
+// With parallel generation, Generate is only the time the store sat waiting for entries.
+type Timing struct {
+	Generate time.Duration
+	Store    time.Duration
+}
+
+// Feed passes the entries for the indexes [0, n) to put in index order and times both sides.
+// With more than one worker the entries are generated in the background by Generate,
+// otherwise inline, a chunk at a time. Feed stops at the first error returned by put.
+func Feed(n, workers int, put func(key, value []byte) error) (Timing, error) {
+	var timing Timing
+	store := func(chunk []Entry) error {
+		start := time.Now()
+		defer func() { timing.Store += time.Since(start) }()
+		for _, e := range chunk {
+			if err := put(e.Key, e.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if workers <= 1 {
+		for from := 0; from < n; from += ChunkSize {
+			start := time.Now()
+			chunk := GenerateChunk(from, min(from+ChunkSize, n))
+			timing.Generate += time.Since(start)
+			if err := store(chunk); err != nil {
+				return timing, err
+			}
+		}
+		return timing, nil
+	}
+
+	chunks := Generate(n, workers)
+	for {
+		start := time.Now()
+		chunk, ok := <-chunks
+		timing.Generate += time.Since(start)
+		if !ok {
+			return timing, nil
+		}
+		if err := store(chunk); err != nil {
+			// let the generators finish so they don't block forever
+			for range chunks {
+			}
+			return timing, err
+		}
+	}
+}
+
+// Dataset holds the keys and values of a directory, generated ahead of time so that
+// populating a store doesn't pay for generating them. A nil *Dataset, or an index outside
+// it, generates the entry on demand, with fresh random content. Every entry is kept both
+// as a string and as a byte slice, so stores taking either don't convert while writing.
+type Dataset struct {
+	keys       []string
+	values     []string
+	keyBytes   [][]byte
+	valueBytes [][]byte
+	visit      func(index int) // called by Value and ValueBytes, see Visit
+}
+
+// NewDataset generates the keys and 64-byte values for the indexes [0, n) on all CPUs.
+func NewDataset(n int) *Dataset {
+	d := &Dataset{
+		keys:       make([]string, 0, n),
+		values:     make([]string, 0, n),
+		keyBytes:   make([][]byte, 0, n),
+		valueBytes: make([][]byte, 0, n),
+	}
+	for chunk := range Generate(n, runtime.GOMAXPROCS(0)) {
+		for _, e := range chunk {
+			d.keys = append(d.keys, string(e.Key))
+			d.values = append(d.values, string(e.Value))
+			d.keyBytes = append(d.keyBytes, e.Key)
+			d.valueBytes = append(d.valueBytes, e.Value)
+		}
+	}
+	return d
+}
+
+// Len returns the number of pre-generated entries.
+func (d *Dataset) Len() int {
+	if d == nil {
+		return 0
+	}
+	return len(d.keys)
+}
+
+// has reports whether the entry at index was pre-generated.
+func (d *Dataset) has(index int) bool {
+	return index >= 0 && index < d.Len()
+}
+
+// Key returns the key at the given index, the same as GenerateKey.
+func (d *Dataset) Key(index int) string {
+	if !d.has(index) {
+		return GenerateKey(index)
+	}
+	return d.keys[index]
+}
+
+// KeyBytes returns the key at the given index as a byte slice, which must not be modified.
+func (d *Dataset) KeyBytes(index int) []byte {
+	if !d.has(index) {
+		return []byte(GenerateKey(index))
+	}
+	return d.keyBytes[index]
+}
+
+// Visit returns a copy of d that calls fn with the index of every value it hands out,
+// before returning it. Stores read one value per write, so the crash tests use it to stop
+// a process at an exact write.
+func (d *Dataset) Visit(fn func(index int)) *Dataset {
+	v := &Dataset{visit: fn}
+	if d != nil {
+		v.keys, v.values = d.keys, d.values
+		v.keyBytes, v.valueBytes = d.keyBytes, d.valueBytes
+	}
+	return v
+}
+
+// Value returns the content at the given index.
+func (d *Dataset) Value(index int) string {
+	if d != nil && d.visit != nil {
+		d.visit(index)
+	}
+	if !d.has(index) {
+		return GenerateRandomContent(64)
+	}
+	return d.values[index]
+}
+
+// ValueBytes returns the content at the given index as a byte slice, which must not be
+// modified.
+func (d *Dataset) ValueBytes(index int) []byte {
+	if d != nil && d.visit != nil {
+		d.visit(index)
+	}
+	if !d.has(index) {
+		return []byte(GenerateRandomContent(64))
+	}
+	return d.valueBytes[index]
+}
+
+// Sorted returns the indexes [0, n) in key order, for bulk loaders that need sorted input.
+// Keys only sort like their indexes while they fit the %04d format.
+func (d *Dataset) Sorted(n int) []int {
+	indexes := make([]int, n)
+	for i := range indexes {
+		indexes[i] = i
+	}
+	if n > 10000 {
+		keys := make([]string, n)
+		for i := range keys {
+			keys[i] = d.Key(i)
+		}
+		slices.SortFunc(indexes, func(a, b int) int {
+			return strings.Compare(keys[a], keys[b])
+		})
+	}
+	return indexes
+}
+
+// Feed passes the entries for the indexes [0, n) to put in index order. Unlike the
+// package-level Feed nothing is generated, so all of the time is counted as Store. put
+// must not modify or keep the slices.
+func (d *Dataset) Feed(n int, put func(key, value []byte) error) (Timing, error) {
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		if err := put(d.KeyBytes(i), d.ValueBytes(i)); err != nil {
+			return Timing{Store: time.Since(start)}, err
+		}
+	}
+	return Timing{Store: time.Since(start)}, nil
+}
+
+// PrefixEnd returns the smallest key above every key starting with prefix, the exclusive
+// upper bound of a prefix scan. It returns "" if there is none, when prefix is empty or
+// all 0xff bytes.
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// KeyAfter returns the smallest key above key, the inclusive lower bound for resuming a
+// listing after it. The empty key, which starts a listing, is returned as is.
+func KeyAfter(key string) string {
+	if key == "" {
+		return ""
+	}
+	return key + "\x00"
+}
+
+// PositionCursor encodes a position in a store's own listing order as a ReadPage cursor.
+func PositionCursor(pos int64) string {
+	return strconv.FormatInt(pos, 10)
+}
+
+// ParsePositionCursor decodes a cursor made by PositionCursor. The empty cursor is
+// position 0.
+func ParsePositionCursor(cursor string) (int64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	pos, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil || pos < 0 {
+		return 0, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return pos, nil
+}
@@ -16,6 +16,8 @@ type BenchmarkDB interface {
 	Close() error
 	Populate() error
 	Next() (string, bool, error)
+	ReadPage(cursor string, limit int) ([]string, string, error)
+	PrefixScan(prefix string) ([]string, error)
 	Lookup(index int, valid bool) (string, error)
 }
 
@@ -6,6 +6,7 @@ import (
 
 	cdbdb64 "github.com/perbu/db-shootout/cdb64"
 	cdbdb "github.com/perbu/db-shootout/cdbdb"
+	"github.com/perbu/db-shootout/keyset"
 	"github.com/perbu/db-shootout/sqlite"
 )
 
@@ -13,8 +14,20 @@ const (
 	dirsize = 1000
 )
 
+// dataset is generated once, so the CreateFolder benchmarks only measure the store.
+var dataset = keyset.NewDataset(dirsize)
+
+// BenchmarkGenerateDataset measures generating the keys and values the stores are populated with.
+func BenchmarkGenerateDataset(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if d := keyset.NewDataset(dirsize); d.Len() != dirsize {
+			b.Fatalf("generated %d entries, want %d", d.Len(), dirsize)
+		}
+	}
+}
+
 func BenchmarkCreateFolderSqlite(b *testing.B) {
-	db := sqlite.New("test.db", dirsize)
+	db := sqlite.New("test.db", dirsize, sqlite.WithDataset(dataset))
 	for i := 0; i < b.N; i++ {
 		if err := db.CreateFolder(); err != nil {
 			b.Fatalf("create folder: %v", err)
@@ -26,7 +39,7 @@ func BenchmarkCreateFolderSqlite(b *testing.B) {
 }
 
 func BenchmarkCreateFolderCDB(b *testing.B) {
-	db := cdbdb.New("test.cdbdb", dirsize)
+	db := cdbdb.New("test.cdbdb", dirsize, cdbdb.WithDataset(dataset))
 	for i := 0; i < b.N; i++ {
 		if err := db.CreateFolder(); err != nil {
 			b.Fatalf("create folder: %v", err)
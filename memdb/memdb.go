@@ -0,0 +1,294 @@
+// Package memdb keeps the folder in a Go map, with a sorted slice of keys for iteration,
+// as the lower bound for the other backends. The map is persisted to a snapshot file on
+// Close and loaded back in full on OpenReadOnly.
+package memdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/perbu/db-shootout/atomicfile"
+	"github.com/perbu/db-shootout/durability"
+	"github.com/perbu/db-shootout/keyset"
+)
+
+// magic starts every snapshot file.
+const magic = "memdb1\n"
+
+// MemDB implements the BenchmarkDB interface on top of a map.
+type MemDB struct {
+	filename string
+	dirsize  int
+	mode     durability.Mode
+	data     *keyset.Dataset
+
+	entries map[string]string
+	keys    []string // sorted, for Next
+	current int
+	dirty   bool // entries have changed since the snapshot was written
+}
+
+// Option configures a MemDB.
+type Option func(*MemDB)
+
+// WithDurability selects whether the snapshot is fsynced. The snapshot is always written
+// as one batch, so per-op durability is the same as per-batch.
+func WithDurability(mode durability.Mode) Option {
+	return func(m *MemDB) {
+		m.mode = mode
+	}
+}
+
+// WithDataset populates the map from a pre-generated dataset instead of generating
+// entries while writing.
+func WithDataset(data *keyset.Dataset) Option {
+	return func(m *MemDB) {
+		m.data = data
+	}
+}
+
+// New creates a new MemDB persisting its snapshot to filename.
+func New(filename string, dirsize int, opts ...Option) *MemDB {
+	m := &MemDB{
+		filename: filename,
+		dirsize:  dirsize,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// OpenReadOnly loads the snapshot into memory.
+func (m *MemDB) OpenReadOnly() error {
+	buf, err := os.ReadFile(m.filename)
+	if err != nil {
+		return fmt.Errorf("open snapshot: %w", err)
+	}
+	entries, keys, err := load(string(buf))
+	if err != nil {
+		return fmt.Errorf("load snapshot: %w", err)
+	}
+	m.entries, m.keys = entries, keys
+	m.current = 0
+	m.dirty = false
+	return nil
+}
+
+// CreateFolder fills the map and writes the snapshot.
+func (m *MemDB) CreateFolder() error {
+	if err := m.Populate(); err != nil {
+		return fmt.Errorf("populate: %w", err)
+	}
+	if err := m.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+	return nil
+}
+
+// Populate replaces the contents of the map with dirsize entries.
+func (m *MemDB) Populate() error {
+	m.entries = make(map[string]string, m.dirsize)
+	m.keys = make([]string, 0, m.dirsize)
+	for i := 0; i < m.dirsize; i++ {
+		key := m.data.Key(i)
+		if _, ok := m.entries[key]; !ok {
+			m.keys = append(m.keys, key)
+		}
+		m.entries[key] = m.data.Value(i)
+	}
+	slices.Sort(m.keys)
+	m.current = 0
+	m.dirty = true
+	return nil
+}
+
+// Delete drops the map and removes the snapshot.
+func (m *MemDB) Delete() error {
+	m.entries, m.keys = nil, nil
+	m.dirty = false
+	return os.Remove(m.filename)
+}
+
+// Close writes the snapshot if the map has changed, and drops the map.
+func (m *MemDB) Close() error {
+	var err error
+	if m.dirty {
+		err = m.save()
+	}
+	m.entries, m.keys = nil, nil
+	m.dirty = false
+	return err
+}
+
+// save atomically replaces the snapshot with the contents of the map.
+func (m *MemDB) save() error {
+	f, err := atomicfile.Create(m.filename, m.mode != durability.None)
+	if err != nil {
+		return fmt.Errorf("create snapshot: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	err = write(w, m.entries, m.keys)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Commit()
+	}
+	if err != nil {
+		f.Abort()
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	return f.Close()
+}
+
+// write writes the magic, the number of entries and then every key and value in key
+// order, each preceded by its length as a uvarint.
+func write(w *bufio.Writer, entries map[string]string, keys []string) error {
+	var buf [binary.MaxVarintLen64]byte
+	if _, err := w.WriteString(magic); err != nil {
+		return err
+	}
+	if _, err := w.Write(binary.AppendUvarint(buf[:0], uint64(len(keys)))); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		for _, s := range []string{key, entries[key]} {
+			if _, err := w.Write(binary.AppendUvarint(buf[:0], uint64(len(s)))); err != nil {
+				return err
+			}
+			if _, err := w.WriteString(s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// load parses a snapshot written by write. The keys and values it returns are substrings
+// of snapshot, which saves an allocation per string.
+func load(snapshot string) (map[string]string, []string, error) {
+	rest, ok := strings.CutPrefix(snapshot, magic)
+	if !ok {
+		return nil, nil, fmt.Errorf("not a snapshot")
+	}
+	n, rest, err := readUvarint(rest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read count: %w", err)
+	}
+	// every entry takes at least two bytes, so a corrupt count can't make us allocate much
+	if n > uint64(len(rest))/2 {
+		return nil, nil, fmt.Errorf("read count: %w", io.ErrUnexpectedEOF)
+	}
+	entries := make(map[string]string, n)
+	keys := make([]string, 0, n)
+	for i := uint64(0); i < n; i++ {
+		var key, value string
+		if key, rest, err = readString(rest); err != nil {
+			return nil, nil, fmt.Errorf("read key %d: %w", i, err)
+		}
+		if value, rest, err = readString(rest); err != nil {
+			return nil, nil, fmt.Errorf("read value %d: %w", i, err)
+		}
+		entries[key] = value
+		keys = append(keys, key)
+	}
+	return entries, keys, nil
+}
+
+// readUvarint returns the uvarint at the start of s and the rest of s.
+func readUvarint(s string) (uint64, string, error) {
+	var x uint64
+	for i := 0; i < len(s) && i < binary.MaxVarintLen64; i++ {
+		c := s[i]
+		x |= uint64(c&0x7f) << (7 * i)
+		if c < 0x80 {
+			return x, s[i+1:], nil
+		}
+	}
+	return 0, "", io.ErrUnexpectedEOF
+}
+
+// readString returns the length-prefixed string at the start of s and the rest of s.
+func readString(s string) (string, string, error) {
+	n, rest, err := readUvarint(s)
+	if err != nil {
+		return "", "", err
+	}
+	if n > uint64(len(rest)) {
+		return "", "", io.ErrUnexpectedEOF
+	}
+	return rest[:n], rest[n:], nil
+}
+
+// Next returns the keys in sorted order.
+func (m *MemDB) Next() (string, bool, error) {
+	if m.keys == nil {
+		return "", false, fmt.Errorf("database is not open")
+	}
+	if m.current >= len(m.keys) {
+		return "", false, nil
+	}
+	key := m.keys[m.current]
+	m.current++
+	return key, true, nil
+}
+
+// PrefixScan returns the keys starting with prefix in key order, binary-searching the
+// sorted keys for the first one.
+func (m *MemDB) PrefixScan(prefix string) ([]string, error) {
+	if m.keys == nil {
+		return nil, fmt.Errorf("database is not open")
+	}
+	var keys []string
+	i, _ := slices.BinarySearch(m.keys, prefix)
+	for ; i < len(m.keys) && strings.HasPrefix(m.keys[i], prefix); i++ {
+		keys = append(keys, m.keys[i])
+	}
+	return keys, nil
+}
+
+// ReadPage returns up to limit keys after cursor in key order, and the cursor of the next
+// page, which is the last key returned. The next cursor is empty after the last page.
+func (m *MemDB) ReadPage(cursor string, limit int) ([]string, string, error) {
+	if m.keys == nil {
+		return nil, "", fmt.Errorf("database is not open")
+	}
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	i, _ := slices.BinarySearch(m.keys, keyset.KeyAfter(cursor))
+	end := min(i+limit, len(m.keys))
+	keys := slices.Clone(m.keys[i:end])
+	if end == len(m.keys) {
+		return keys, "", nil
+	}
+	return keys, keys[len(keys)-1], nil
+}
+
+// Lookup retrieves the content of the entry at the given index.
+func (m *MemDB) Lookup(index int, valid bool) (string, error) {
+	if m.entries == nil {
+		return "", fmt.Errorf("database is not open")
+	}
+	if index < 0 || index >= m.dirsize {
+		return "", fmt.Errorf("index out of bounds")
+	}
+	var filename string
+	switch valid {
+	case true:
+		filename = keyset.GenerateKey(index)
+	case false:
+		filename = keyset.GenerateInvalidKey(index)
+	}
+	content, ok := m.entries[filename]
+	if !ok {
+		return "", fmt.Errorf("no row found")
+	}
+	return content, nil
+}
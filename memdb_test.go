@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/perbu/db-shootout/durability"
+	"github.com/perbu/db-shootout/keyset"
+	"github.com/perbu/db-shootout/memdb"
+)
+
+func BenchmarkCreateFolderMemDB(b *testing.B) {
+	db := memdb.New(filepath.Join(b.TempDir(), "test.memdb"), dirsize, memdb.WithDataset(dataset))
+	for i := 0; i < b.N; i++ {
+		if err := db.CreateFolder(); err != nil {
+			b.Fatalf("create folder: %v", err)
+		}
+		if err := db.Delete(); err != nil {
+			b.Fatalf("delete: %v", err)
+		}
+	}
+}
+
+func BenchmarkLookupMemDB(b *testing.B) {
+	db := memdb.New(filepath.Join(b.TempDir(), "test.memdb"), dirsize, memdb.WithDataset(dataset))
+	if err := db.CreateFolder(); err != nil {
+		b.Fatalf("create folder: %v", err)
+	}
+	if err := db.OpenReadOnly(); err != nil {
+		b.Fatalf("open readonly: %v", err)
+	}
+	defer db.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Lookup(rand.Intn(dirsize), true); err != nil {
+			b.Fatalf("lookup valid: %v", err)
+		}
+	}
+	b.StopTimer()
+}
+
+// BenchmarkReaddirMemDB only iterates, the snapshot is loaded outside the timer.
+func BenchmarkReaddirMemDB(b *testing.B) {
+	db := memdb.New(filepath.Join(b.TempDir(), "test.memdb"), dirsize, memdb.WithDataset(dataset))
+	if err := db.CreateFolder(); err != nil {
+		b.Fatalf("create folder: %v", err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		if err := db.OpenReadOnly(); err != nil {
+			b.Fatalf("open readonly: %v", err)
+		}
+		b.StartTimer()
+		for entry := 0; entry < dirsize; entry++ {
+			if _, _, err := db.Next(); err != nil {
+				b.Fatalf("next: %v", err)
+			}
+		}
+	}
+	b.StopTimer()
+	if err := db.Close(); err != nil {
+		b.Fatalf("close: %v", err)
+	}
+}
+
+// BenchmarkOpenMemDB measures loading the snapshot, the price memdb pays on every open.
+func BenchmarkOpenMemDB(b *testing.B) {
+	for _, size := range []int{dirsize, 100 * dirsize} {
+		b.Run(fmt.Sprintf("entries=%d", size), func(b *testing.B) {
+			path := filepath.Join(b.TempDir(), "test.memdb")
+			db := memdb.New(path, size, memdb.WithDurability(durability.None), memdb.WithDataset(keyset.NewDataset(size)))
+			if err := db.CreateFolder(); err != nil {
+				b.Fatalf("create folder: %v", err)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				b.Fatalf("stat: %v", err)
+			}
+			b.SetBytes(info.Size())
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := db.OpenReadOnly(); err != nil {
+					b.Fatalf("open readonly: %v", err)
+				}
+				if err := db.Close(); err != nil {
+					b.Fatalf("close: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// TestMemDB round-trips the map through the snapshot and rejects a truncated one.
+func TestMemDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.memdb")
+	db := memdb.New(path, dirsize, memdb.WithDataset(dataset))
+	if err := db.CreateFolder(); err != nil {
+		t.Fatalf("create folder: %v", err)
+	}
+	if err := db.OpenReadOnly(); err != nil {
+		t.Fatalf("open readonly: %v", err)
+	}
+	for _, i := range []int{0, dirsize / 2, dirsize - 1} {
+		if value, err := db.Lookup(i, true); err != nil || value != dataset.Value(i) {
+			t.Fatalf("lookup %d got %q, %v, want %q", i, value, err, dataset.Value(i))
+		}
+	}
+	if _, err := db.Lookup(0, false); err == nil {
+		t.Fatalf("lookup of an invalid key succeeded")
+	}
+	var keys []string
+	for {
+		key, ok, err := db.Next()
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		if !ok {
+			break
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) != dirsize || !slices.IsSorted(keys) {
+		t.Fatalf("listed %d entries, sorted %v, want %d sorted", len(keys), slices.IsSorted(keys), dirsize)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if err := os.Truncate(path, info.Size()/2); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	if err := db.OpenReadOnly(); err == nil {
+		db.Close()
+		t.Fatalf("opened a truncated snapshot")
+	}
+}
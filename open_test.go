@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/perbu/db-shootout/badgerdb"
+	"github.com/perbu/db-shootout/bitcask"
+	"github.com/perbu/db-shootout/boltdb"
+	cdbdb64 "github.com/perbu/db-shootout/cdb64"
+	"github.com/perbu/db-shootout/keyset"
+	"github.com/perbu/db-shootout/memdb"
+	"github.com/perbu/db-shootout/pebbledb"
+	"github.com/perbu/db-shootout/sortedfile"
+	"github.com/perbu/db-shootout/sqlite"
+)
+
+// opener is the part of a backend the open benchmark needs.
+type opener interface {
+	CreateFolder() error
+	OpenReadOnly() error
+	Close() error
+	Delete() error
+	Lookup(index int, valid bool) (string, error)
+}
+
+var openBackends = []struct {
+	name string
+	new  func(path string, size int, data *keyset.Dataset, tb testing.TB) opener
+}{
+	{"Bitcask/hint", func(path string, size int, data *keyset.Dataset, tb testing.TB) opener {
+		return bitcask.New(path, size, bitcask.WithDataset(data))
+	}},
+	{"Bitcask/replay", func(path string, size int, data *keyset.Dataset, tb testing.TB) opener {
+		return bitcask.New(path, size, bitcask.WithDataset(data), bitcask.WithoutHints())
+	}},
+	{"MemDB", func(path string, size int, data *keyset.Dataset, tb testing.TB) opener {
+		return memdb.New(path, size, memdb.WithDataset(data))
+	}},
+	{"CDB64", func(path string, size int, data *keyset.Dataset, tb testing.TB) opener {
+		return cdbdb64.New(path, size, cdbdb64.WithDataset(data))
+	}},
+	{"SortedFile", func(path string, size int, data *keyset.Dataset, tb testing.TB) opener {
+		return sortedfile.New(path, size, sortedfile.WithDataset(data))
+	}},
+	{"Bolt", func(path string, size int, data *keyset.Dataset, tb testing.TB) opener {
+		return boltdb.New(path, size, boltdb.WithDataset(data))
+	}},
+	{"Pebble", func(path string, size int, data *keyset.Dataset, tb testing.TB) opener {
+		return pebbledb.New(path, size, tb, pebbledb.WithDataset(data))
+	}},
+	{"Sqlite", func(path string, size int, data *keyset.Dataset, tb testing.TB) opener {
+		return sqlite.New(path, size, sqlite.WithDataset(data))
+	}},
+	{"Badger", func(path string, size int, data *keyset.Dataset, tb testing.TB) opener {
+		return badgerdb.New(path, size, badgerdb.WithDataset(data))
+	}},
+}
+
+// BenchmarkOpenLarge measures opening a store and serving its first lookup at large
+// dirsizes, where rebuilding an in-memory index on open starts to show.
+func BenchmarkOpenLarge(b *testing.B) {
+	for _, size := range []int{10 * dirsize, 100 * dirsize} {
+		data := keyset.NewDataset(size)
+		for _, backend := range openBackends {
+			b.Run(fmt.Sprintf("entries=%d/%s", size, backend.name), func(b *testing.B) {
+				db := backend.new(filepath.Join(b.TempDir(), "test.db"), size, data, b)
+				if err := db.CreateFolder(); err != nil {
+					b.Fatalf("create folder: %v", err)
+				}
+				// some backends stay open after CreateFolder
+				if err := db.Close(); err != nil {
+					b.Fatalf("close: %v", err)
+				}
+				defer db.Delete()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := db.OpenReadOnly(); err != nil {
+						b.Fatalf("open readonly: %v", err)
+					}
+					if _, err := db.Lookup(rand.Intn(size), true); err != nil {
+						b.Fatalf("lookup valid: %v", err)
+					}
+					if err := db.Close(); err != nil {
+						b.Fatalf("close: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
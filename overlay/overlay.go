@@ -0,0 +1,219 @@
+// Package overlay lets an immutable store take updates. Changes go to a small
+// append-only delta log, indexed in memory, that readers consult before the base.
+// Once the delta grows past a threshold the owner merges it into a new base.
+package overlay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	opPut    byte = 1
+	opRemove byte = 2
+)
+
+// entry is the latest change to a key. A removed key is kept as a tombstone.
+type entry struct {
+	value   string
+	removed bool
+}
+
+// Delta is an append-only log of puts and removals with an in-memory index.
+type Delta struct {
+	f       *os.File
+	sync    bool
+	entries map[string]entry
+}
+
+// Open replays the log at path, creating it if writable is set. A torn record at the
+// end of the log, left by a crash, is cut off. With sync set every change is fsynced.
+func Open(path string, writable, sync bool) (*Delta, error) {
+	flag := os.O_RDONLY
+	if writable {
+		flag = os.O_RDWR | os.O_CREATE
+	}
+	f, err := os.OpenFile(path, flag, 0o644)
+	if errors.Is(err, os.ErrNotExist) && !writable {
+		// nothing has been written on top of the base yet
+		return &Delta{entries: make(map[string]entry)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	d := &Delta{f: f, sync: sync, entries: make(map[string]entry)}
+	valid, err := d.replay()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("replay: %w", err)
+	}
+	if writable {
+		if err := f.Truncate(valid); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("truncate: %w", err)
+		}
+		if _, err := f.Seek(valid, io.SeekStart); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("seek: %w", err)
+		}
+	}
+	return d, nil
+}
+
+// replay loads every complete record and returns the offset just past the last one.
+func (d *Delta) replay() (int64, error) {
+	r := bufio.NewReader(d.f)
+	var valid int64
+	for {
+		op, key, value, n, err := readRecord(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errChecksum) {
+				return valid, nil
+			}
+			return 0, err
+		}
+		d.apply(op, key, value)
+		valid += n
+	}
+}
+
+var errChecksum = errors.New("checksum mismatch")
+
+// A record is the op, the key and value lengths as uvarints, the key, the value and
+// a CRC32 of everything before it.
+func readRecord(r *bufio.Reader) (byte, string, string, int64, error) {
+	op, err := r.ReadByte()
+	if err != nil {
+		return 0, "", "", 0, err
+	}
+	klen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, "", "", 0, io.ErrUnexpectedEOF
+	}
+	vlen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, "", "", 0, io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, klen+vlen+4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, "", "", 0, io.ErrUnexpectedEOF
+	}
+	header := encodeHeader(op, klen, vlen)
+	data := buf[:klen+vlen]
+	sum := crc32.ChecksumIEEE(append(header, data...))
+	if sum != binary.LittleEndian.Uint32(buf[klen+vlen:]) {
+		return 0, "", "", 0, errChecksum
+	}
+	n := int64(len(header) + len(buf))
+	return op, string(data[:klen]), string(data[klen:]), n, nil
+}
+
+func encodeHeader(op byte, klen, vlen uint64) []byte {
+	header := make([]byte, 1, 1+2*binary.MaxVarintLen64)
+	header[0] = op
+	header = binary.AppendUvarint(header, klen)
+	return binary.AppendUvarint(header, vlen)
+}
+
+func (d *Delta) apply(op byte, key, value string) {
+	switch op {
+	case opPut:
+		d.entries[key] = entry{value: value}
+	case opRemove:
+		d.entries[key] = entry{removed: true}
+	}
+}
+
+// append writes one record to the log and then applies it to the index.
+func (d *Delta) append(op byte, key, value string) error {
+	if d.f == nil {
+		return errors.New("delta is not writable")
+	}
+	record := encodeHeader(op, uint64(len(key)), uint64(len(value)))
+	record = append(record, key...)
+	record = append(record, value...)
+	record = binary.LittleEndian.AppendUint32(record, crc32.ChecksumIEEE(record))
+	if _, err := d.f.Write(record); err != nil {
+		return fmt.Errorf("append: %w", err)
+	}
+	if d.sync {
+		if err := d.f.Sync(); err != nil {
+			return fmt.Errorf("sync: %w", err)
+		}
+	}
+	d.apply(op, key, value)
+	return nil
+}
+
+// Put records a new value for key.
+func (d *Delta) Put(key, value string) error {
+	return d.append(opPut, key, value)
+}
+
+// Remove records a tombstone for key.
+func (d *Delta) Remove(key string) error {
+	return d.append(opRemove, key, "")
+}
+
+// Get returns the latest change to key. ok is false if the delta doesn't know the key,
+// in which case the base has the answer.
+func (d *Delta) Get(key string) (value string, removed, ok bool) {
+	e, ok := d.entries[key]
+	return e.value, e.removed, ok
+}
+
+// Len returns the number of keys the delta knows about, tombstones included.
+func (d *Delta) Len() int {
+	return len(d.entries)
+}
+
+// Each calls fn for every key in the delta, in key order.
+func (d *Delta) Each(fn func(key, value string, removed bool) error) error {
+	keys := make([]string, 0, len(d.entries))
+	for key := range d.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		e := d.entries[key]
+		if err := fn(key, e.value, e.removed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reset empties the delta once it has been merged into a new base.
+func (d *Delta) Reset() error {
+	if d.f != nil {
+		if err := d.f.Truncate(0); err != nil {
+			return fmt.Errorf("truncate: %w", err)
+		}
+		if _, err := d.f.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("seek: %w", err)
+		}
+		if d.sync {
+			if err := d.f.Sync(); err != nil {
+				return fmt.Errorf("sync: %w", err)
+			}
+		}
+	}
+	d.entries = make(map[string]entry)
+	return nil
+}
+
+// Close closes the log file.
+func (d *Delta) Close() error {
+	if d.f == nil {
+		return nil
+	}
+	err := d.f.Close()
+	d.f = nil
+	return err
+}
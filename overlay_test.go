@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	cdbdb64 "github.com/perbu/db-shootout/cdb64"
+	cdbdb "github.com/perbu/db-shootout/cdbdb"
+	"github.com/perbu/db-shootout/durability"
+	"github.com/perbu/db-shootout/keyset"
+)
+
+// overlayDB is a CDB backend opened with an overlay.
+type overlayDB interface {
+	CreateFolder() error
+	OpenReadOnly() error
+	OpenReadWrite() error
+	Close() error
+	Delete() error
+	Put(key, value string) error
+	Remove(key string) error
+	Compact() error
+	Next() (string, bool, error)
+	ReadPage(cursor string, limit int) ([]string, string, error)
+	PrefixScan(prefix string) ([]string, error)
+	Lookup(index int, valid bool) (string, error)
+}
+
+var overlayBackends = []struct {
+	name string
+	new  func(path string, threshold int, mode durability.Mode) overlayDB
+}{
+	{"CDB", func(path string, threshold int, mode durability.Mode) overlayDB {
+		return cdbdb.New(path, dirsize, cdbdb.WithOverlay(threshold), cdbdb.WithDurability(mode))
+	}},
+	{"CDB64", func(path string, threshold int, mode durability.Mode) overlayDB {
+		return cdbdb64.New(path, dirsize, cdbdb64.WithOverlay(threshold), cdbdb64.WithDurability(mode))
+	}},
+}
+
+// listAll reads the whole directory through Next.
+func listAll(t *testing.T, db overlayDB) map[string]bool {
+	t.Helper()
+	names := make(map[string]bool)
+	for {
+		name, ok, err := db.Next()
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		if !ok {
+			return names
+		}
+		names[name] = true
+	}
+}
+
+// checkOverlayListing checks that Next, ReadPage and PrefixScan see the changes
+// TestCDBOverlay makes: the key at index 1 removed and new_file added.
+func checkOverlayListing(t *testing.T, db overlayDB) {
+	t.Helper()
+	removed := keyset.GenerateKey(1)
+	names := listAll(t, db)
+	if len(names) != dirsize || !names["new_file"] || names[removed] {
+		t.Fatalf("readdir through overlay: %d entries, new %v, removed %v",
+			len(names), names["new_file"], names[removed])
+	}
+	pages := readAllPages(t, db, 7)
+	if len(pages) != dirsize || !slices.Contains(pages, "new_file") || slices.Contains(pages, removed) {
+		t.Fatalf("pages through overlay: %d entries, new %v, removed %v",
+			len(pages), slices.Contains(pages, "new_file"), slices.Contains(pages, removed))
+	}
+	if keys, err := db.PrefixScan("new_"); err != nil || !slices.Equal(keys, []string{"new_file"}) {
+		t.Fatalf("prefix scan through overlay: %q, %v", keys, err)
+	}
+	if keys, err := db.PrefixScan(removed); err != nil || len(keys) != 0 {
+		t.Fatalf("prefix scan of a removed key: %q, %v", keys, err)
+	}
+}
+
+func TestCDBOverlay(t *testing.T) {
+	const threshold = 50
+	for _, backend := range overlayBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.cdb")
+			db := backend.new(path, threshold, durability.PerBatch)
+			if err := db.CreateFolder(); err != nil {
+				t.Fatalf("create folder: %v", err)
+			}
+			if err := db.OpenReadWrite(); err != nil {
+				t.Fatalf("open read-write: %v", err)
+			}
+			if err := db.Put(keyset.GenerateKey(0), "updated"); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			if err := db.Remove(keyset.GenerateKey(1)); err != nil {
+				t.Fatalf("remove: %v", err)
+			}
+			if err := db.Put("new_file", "added"); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			// the handle that wrote the changes lists them too
+			checkOverlayListing(t, db)
+			if err := db.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+
+			// the delta survives reopening
+			if err := db.OpenReadOnly(); err != nil {
+				t.Fatalf("open readonly: %v", err)
+			}
+			if value, err := db.Lookup(0, true); err != nil || value != "updated" {
+				t.Fatalf("lookup updated: %q, %v", value, err)
+			}
+			if _, err := db.Lookup(1, true); err == nil {
+				t.Fatalf("lookup removed key succeeded")
+			}
+			checkOverlayListing(t, db)
+			if err := db.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+
+			// filling the delta up to the threshold merges it into the CDB file
+			if err := db.OpenReadWrite(); err != nil {
+				t.Fatalf("open read-write: %v", err)
+			}
+			for i := 2; i < threshold-1; i++ {
+				if err := db.Put(keyset.GenerateKey(i), fmt.Sprintf("value %d", i)); err != nil {
+					t.Fatalf("put: %v", err)
+				}
+			}
+			if info, err := os.Stat(path + ".delta"); err != nil || info.Size() != 0 {
+				t.Fatalf("delta after compaction: %v, %v", info, err)
+			}
+			if value, err := db.Lookup(0, true); err != nil || value != "updated" {
+				t.Fatalf("lookup after compaction: %q, %v", value, err)
+			}
+			if value, err := db.Lookup(2, true); err != nil || value != "value 2" {
+				t.Fatalf("lookup after compaction: %q, %v", value, err)
+			}
+			if _, err := db.Lookup(1, true); err == nil {
+				t.Fatalf("lookup removed key succeeded after compaction")
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+			if err := db.Delete(); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+		})
+	}
+}
+
+// BenchmarkLookupCDBOverlay measures lookups through deltas of growing size.
+func BenchmarkLookupCDBOverlay(b *testing.B) {
+	for _, backend := range overlayBackends {
+		for _, deltaSize := range []int{0, 10, 100, 1000} {
+			b.Run(fmt.Sprintf("%s/delta-%d", backend.name, deltaSize), func(b *testing.B) {
+				path := filepath.Join(b.TempDir(), "test.cdb")
+				// never compact, and don't pay for fsync while filling the delta
+				db := backend.new(path, deltaSize+1, durability.None)
+				if err := db.CreateFolder(); err != nil {
+					b.Fatalf("create folder: %v", err)
+				}
+				if err := db.OpenReadWrite(); err != nil {
+					b.Fatalf("open read-write: %v", err)
+				}
+				defer db.Delete()
+				defer db.Close()
+				for i := 0; i < deltaSize; i++ {
+					key := keyset.GenerateKey(i % dirsize)
+					if err := db.Put(key, keyset.GenerateRandomContent(64)); err != nil {
+						b.Fatalf("put: %v", err)
+					}
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := db.Lookup(rand.Intn(dirsize), true); err != nil {
+						b.Fatalf("lookup valid: %v", err)
+					}
+				}
+				b.StopTimer()
+			})
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	cdbdb "github.com/perbu/db-shootout/cdbdb"
+	"github.com/perbu/db-shootout/durability"
+	"github.com/perbu/db-shootout/keyset"
+)
+
+// pager is the part of a backend needed to page through it.
+type pager interface {
+	ReadPage(cursor string, limit int) ([]string, string, error)
+}
+
+// readAllPages pages through a directory, checking that every page but the last is full
+// and that no cursor leads to an empty page.
+func readAllPages(tb testing.TB, db pager, limit int) []string {
+	tb.Helper()
+	var names []string
+	cursor := ""
+	for {
+		page, next, err := db.ReadPage(cursor, limit)
+		if err != nil {
+			tb.Fatalf("read page after %q: %v", cursor, err)
+		}
+		if cursor != "" && len(page) == 0 {
+			tb.Fatalf("cursor %q led to an empty page", cursor)
+		}
+		names = append(names, page...)
+		if next == "" {
+			return names
+		}
+		if len(page) != limit {
+			tb.Fatalf("page after %q has %d entries of %d, but is not the last", cursor, len(page), limit)
+		}
+		cursor = next
+	}
+}
+
+// TestReadPage checks that paging through every backend returns each key exactly once,
+// whatever the page size, and in key order for the ordered ones.
+func TestReadPage(t *testing.T) {
+	want := make([]string, dirsize)
+	for i := range want {
+		want[i] = dataset.Key(i)
+	}
+	slices.Sort(want)
+	for _, backend := range listBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			db := openLister(t, dirsize, dataset, backend.new)
+			for _, limit := range []int{1, 7, dirsize, 2 * dirsize} {
+				got := readAllPages(t, db, limit)
+				if backend.ordered && !slices.IsSorted(got) {
+					t.Errorf("limit %d: keys out of order", limit)
+				}
+				slices.Sort(got)
+				if !slices.Equal(got, want) {
+					t.Errorf("limit %d: got %d keys, want %d", limit, len(got), len(want))
+				}
+			}
+			if _, _, err := db.ReadPage("", 0); err == nil {
+				t.Errorf("read page with limit 0 succeeded")
+			}
+		})
+	}
+}
+
+// TestReadPageOverlay checks that paging through a CDB with an overlay sees the same
+// directory as Next, including the keys only in the delta.
+func TestReadPageOverlay(t *testing.T) {
+	for _, backend := range overlayBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			db := backend.new(filepath.Join(t.TempDir(), "test.cdb"), 50, durability.PerBatch)
+			if err := db.CreateFolder(); err != nil {
+				t.Fatalf("create folder: %v", err)
+			}
+			if err := db.OpenReadWrite(); err != nil {
+				t.Fatalf("open read-write: %v", err)
+			}
+			defer db.Delete()
+			for i := 0; i < 10; i++ {
+				if err := db.Remove(keyset.GenerateKey(i * 7)); err != nil {
+					t.Fatalf("remove: %v", err)
+				}
+				if err := db.Put(fmt.Sprintf("new_%02d", i), "added"); err != nil {
+					t.Fatalf("put: %v", err)
+				}
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+			if err := db.OpenReadOnly(); err != nil {
+				t.Fatalf("open readonly: %v", err)
+			}
+			defer db.Close()
+			names := listAll(t, db)
+			if len(names) != dirsize {
+				t.Fatalf("readdir through overlay: %d entries, want %d", len(names), dirsize)
+			}
+			for _, limit := range []int{1, 7, 10} {
+				got := readAllPages(t, db, limit)
+				if len(got) != len(names) {
+					t.Fatalf("limit %d: got %d keys, want %d", limit, len(got), len(names))
+				}
+				for _, name := range got {
+					if !names[name] {
+						t.Fatalf("limit %d: unexpected key %q", limit, name)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestReadPageRemovedTail removes the keys at the end of the listing and checks that the
+// page before them is the last, rather than one with a cursor to an empty page.
+func TestReadPageRemovedTail(t *testing.T) {
+	const removed = 3
+	for _, backend := range overlayBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			db := backend.new(filepath.Join(t.TempDir(), "test.cdb"), 50, durability.PerBatch)
+			if err := db.CreateFolder(); err != nil {
+				t.Fatalf("create folder: %v", err)
+			}
+			if err := db.OpenReadWrite(); err != nil {
+				t.Fatalf("open read-write: %v", err)
+			}
+			defer db.Delete()
+			defer db.Close()
+			order := readAllPages(t, db, 2*dirsize)
+			for _, key := range order[len(order)-removed:] {
+				if err := db.Remove(key); err != nil {
+					t.Fatalf("remove: %v", err)
+				}
+			}
+			want := len(order) - removed
+			page, next, err := db.ReadPage("", want)
+			if err != nil {
+				t.Fatalf("read page: %v", err)
+			}
+			if len(page) != want || next != "" {
+				t.Fatalf("got %d keys and cursor %q, want %d keys and no cursor", len(page), next, want)
+			}
+		})
+	}
+}
+
+// TestReadPageCDBCorrupt overstates the length of the first record and checks that paging
+// reports the file as truncated instead of allocating what the length claims.
+func TestReadPageCDBCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.cdb")
+	db := cdbdb.New(path, dirsize, cdbdb.WithDataset(dataset))
+	if err := db.CreateFolder(); err != nil {
+		t.Fatalf("create folder: %v", err)
+	}
+	defer db.Delete()
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	// the key length of the first record, right after the 256 hash table positions
+	if _, err := f.WriteAt([]byte{0xff, 0xff, 0xff, 0x7f}, 256*8); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := db.OpenReadOnly(); err != nil {
+		t.Fatalf("open readonly: %v", err)
+	}
+	defer db.Close()
+	if _, _, err := db.ReadPage("", 10); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("read page of a corrupt file: %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+// BenchmarkReadPage measures reading one page at increasing depths into a large directory.
+// A cursor that has to be replayed from the start makes deep pages cost O(n).
+func BenchmarkReadPage(b *testing.B) {
+	const limit = 100
+	size := 10 * dirsize
+	data := keyset.NewDataset(size)
+	for _, backend := range listBackends {
+		b.Run(backend.name, func(b *testing.B) {
+			db := openLister(b, size, data, backend.new)
+			// the cursor at every page, found by paging through once
+			cursors := []string{""}
+			for {
+				_, next, err := db.ReadPage(cursors[len(cursors)-1], limit)
+				if err != nil {
+					b.Fatalf("read page: %v", err)
+				}
+				if next == "" {
+					break
+				}
+				cursors = append(cursors, next)
+			}
+			for _, depth := range []int{0, len(cursors) / 2, len(cursors) - 1} {
+				b.Run(fmt.Sprintf("offset=%d", depth*limit), func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						if _, _, err := db.ReadPage(cursors[depth], limit); err != nil {
+							b.Fatalf("read page: %v", err)
+						}
+					}
+				})
+			}
+		})
+	}
+}
+
+// BenchmarkReadPageReplay serves a page the naive way for comparison: reopen the
+// directory and skip offset entries with Next before reading limit more.
+func BenchmarkReadPageReplay(b *testing.B) {
+	const limit = 100
+	size := 10 * dirsize
+	db := cdbdb.New(filepath.Join(b.TempDir(), "test.cdb"), size, cdbdb.WithDataset(keyset.NewDataset(size)))
+	if err := db.CreateFolder(); err != nil {
+		b.Fatalf("create folder: %v", err)
+	}
+	defer db.Delete()
+	for _, offset := range []int{0, size / 2, size - limit} {
+		b.Run(fmt.Sprintf("offset=%d", offset), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := db.OpenReadOnly(); err != nil {
+					b.Fatalf("open readonly: %v", err)
+				}
+				for entry := 0; entry < offset+limit; entry++ {
+					if _, _, err := db.Next(); err != nil {
+						b.Fatalf("next: %v", err)
+					}
+				}
+				if err := db.Close(); err != nil {
+					b.Fatalf("close: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -6,6 +6,10 @@ import (
 	"testing"
 
 	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/objstorage/objstorageprovider"
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/perbu/db-shootout/durability"
 	"github.com/perbu/db-shootout/keyset"
 )
 
@@ -15,48 +19,154 @@ type PebbleDB struct {
 	current  int
 	db       *pebble.DB
 	logger   pebble.Logger
+	fs       vfs.FS
+	mode     durability.Mode
+	data     *keyset.Dataset
+	bulk     bool
+	profile  Profile
+	iter     *pebble.Iterator // iterator of Next
+	iterDone bool
 }
 
-func New(filename string, dirsize int, b *testing.B) *PebbleDB {
-	return &PebbleDB{
+// Option configures a PebbleDB.
+type Option func(*PebbleDB)
+
+// WithLogger replaces the default logger, which fails the test on fatal errors.
+func WithLogger(logger pebble.Logger) Option {
+	return func(p *PebbleDB) {
+		p.logger = logger
+	}
+}
+
+// WithFS makes pebble store its files through fs instead of the OS filesystem.
+func WithFS(fs vfs.FS) Option {
+	return func(p *PebbleDB) {
+		p.fs = fs
+	}
+}
+
+// WithDurability selects when writes are synced to the WAL on disk.
+func WithDurability(mode durability.Mode) Option {
+	return func(p *PebbleDB) {
+		p.mode = mode
+	}
+}
+
+// WithDataset populates the store from a pre-generated dataset instead of generating
+// entries while writing.
+func WithDataset(data *keyset.Dataset) Option {
+	return func(p *PebbleDB) {
+		p.data = data
+	}
+}
+
+// WithBulkLoad makes CreateFolder write the entries to an sstable in key order and
+// ingest it, instead of going through the WAL and memtable.
+func WithBulkLoad() Option {
+	return func(p *PebbleDB) {
+		p.bulk = true
+	}
+}
+
+func New(filename string, dirsize int, tb testing.TB, opts ...Option) *PebbleDB {
+	p := &PebbleDB{
 		filename: filename,
 		dirsize:  dirsize,
-		logger:   &testLogger{b: b},
+		logger:   &testLogger{tb: tb},
 	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// options returns the pebble options shared by every way of opening the database.
+func (p *PebbleDB) options() *pebble.Options {
+	return &pebble.Options{
+		Logger: p.logger,
+		FS:     p.fs,
+		Levels: p.profile.levels(),
+	}
+}
+
+// open opens the database with the options of the profile.
+func (p *PebbleDB) open(readOnly bool) (*pebble.DB, error) {
+	opts := p.options()
+	opts.ReadOnly = readOnly
+	if p.profile.CacheSize > 0 {
+		cache := pebble.NewCache(p.profile.CacheSize)
+		// the database holds its own reference
+		defer cache.Unref()
+		opts.Cache = cache
+	}
+	return pebble.Open(p.filename, opts)
+}
+
+// writeOptions returns the commit options matching the durability mode.
+func (p *PebbleDB) writeOptions() *pebble.WriteOptions {
+	if p.mode == durability.None {
+		return pebble.NoSync
+	}
+	return pebble.Sync
 }
 
 func (p *PebbleDB) OpenReadOnly() error {
-	opts := &pebble.Options{ReadOnly: true}
-	opts.Logger = p.logger
-	db, err := pebble.Open(p.filename, opts)
+	db, err := p.open(true)
 	if err != nil {
 		return fmt.Errorf("open pebble: %w", err)
 	}
 	p.db = db
+	p.iterDone = false
 	return nil
 }
 
-func (p *PebbleDB) CreateFolder() error {
-	opts := &pebble.Options{}
-	opts.Logger = p.logger
-	db, err := pebble.Open(p.filename, opts)
+func (p *PebbleDB) CreateFolder() (err error) {
+	db, err := p.open(false)
 	if err != nil {
 		return fmt.Errorf("create pebble: %w", err)
 	}
 	p.db = db
+	// a failed create does not leave the database open
+	defer func() {
+		if err != nil {
+			_ = p.Close()
+		}
+	}()
+
+	if p.bulk {
+		if err := p.ingest(); err != nil {
+			return fmt.Errorf("bulk load: %w", err)
+		}
+		p.current = 0
+		return nil
+	}
+
+	if p.mode == durability.PerOp {
+		// every entry is its own synced commit
+		for i := 0; i < p.dirsize; i++ {
+			key := p.data.KeyBytes(i)
+			val := p.data.ValueBytes(i)
+			if err := p.db.Set(key, val, pebble.Sync); err != nil {
+				return fmt.Errorf("set: %w", err)
+			}
+		}
+		p.current = 0
+		return nil
+	}
 
 	batch := p.db.NewBatch()
 	defer batch.Close()
 
 	for i := 0; i < p.dirsize; i++ {
-		key := []byte(keyset.GenerateKey(i))
-		val := []byte(keyset.GenerateRandomContent(64))
-		if err := batch.Set(key, val, pebble.Sync); err != nil {
+		key := p.data.KeyBytes(i)
+		val := p.data.ValueBytes(i)
+		// the write options of Set are ignored, the commit decides
+		if err := batch.Set(key, val, nil); err != nil {
 			return fmt.Errorf("set: %w", err)
 		}
 	}
 
-	if err := batch.Commit(pebble.Sync); err != nil {
+	if err := batch.Commit(p.writeOptions()); err != nil {
 		return fmt.Errorf("commit: %w", err)
 	}
 
@@ -64,17 +174,112 @@ func (p *PebbleDB) CreateFolder() error {
 	return nil
 }
 
+// ingest builds an sstable with every entry next to the database and ingests it.
+// Ingestion syncs the table and the manifest whatever the durability mode.
+func (p *PebbleDB) ingest() error {
+	fs := p.fs
+	if fs == nil {
+		fs = vfs.Default
+	}
+	path := fs.PathJoin(p.filename, "bulk.sst")
+	f, err := fs.Create(path)
+	if err != nil {
+		return fmt.Errorf("create sstable: %w", err)
+	}
+	// ingestion links the table into the database, the original name can go afterwards
+	defer fs.Remove(path)
+
+	opts := p.options().EnsureDefaults()
+	w := sstable.NewWriter(objstorageprovider.NewFileWritable(f),
+		opts.MakeWriterOptions(0, p.db.FormatMajorVersion().MaxTableFormat()))
+	for _, i := range p.data.Sorted(p.dirsize) {
+		if err := w.Set(p.data.KeyBytes(i), p.data.ValueBytes(i)); err != nil {
+			_ = w.Close()
+			return fmt.Errorf("set: %w", err)
+		}
+	}
+	// Close finishes the table and closes f
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("write sstable: %w", err)
+	}
+	if err := p.db.Ingest([]string{path}); err != nil {
+		return fmt.Errorf("ingest: %w", err)
+	}
+	return nil
+}
+
+// OpenReadWrite opens (or creates) the database for incremental updates via Put.
+func (p *PebbleDB) OpenReadWrite() error {
+	db, err := p.open(false)
+	if err != nil {
+		return fmt.Errorf("open pebble: %w", err)
+	}
+	p.db = db
+	return nil
+}
+
+// Put stores a single entry and commits it before returning.
+func (p *PebbleDB) Put(key, value string) error {
+	if p.db == nil {
+		return fmt.Errorf("database is not open")
+	}
+	if err := p.db.Set([]byte(key), []byte(value), p.writeOptions()); err != nil {
+		return fmt.Errorf("set: %w", err)
+	}
+	return nil
+}
+
+// Settle brings a freshly written database into its steady-state shape: the memtable is
+// flushed to an sstable and the whole key range is compacted into the bottom level.
+// It needs the database open for writing.
+func (p *PebbleDB) Settle() error {
+	if p.db == nil {
+		return fmt.Errorf("database is not open")
+	}
+	if err := p.db.Flush(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	iter, err := p.db.NewIter(nil)
+	if err != nil {
+		return fmt.Errorf("new iterator: %w", err)
+	}
+	var start, end []byte
+	if iter.First() {
+		start = append(start, iter.Key()...)
+	}
+	if iter.Last() {
+		// Compact takes an exclusive upper bound
+		end = append(append(end, iter.Key()...), 0)
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("iterate: %w", err)
+	}
+	if start == nil {
+		return nil // empty
+	}
+	if err := p.db.Compact(start, end, true); err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	return nil
+}
+
 func (p *PebbleDB) Delete() error {
+	p.closeIter()
 	if p.db != nil {
 		if err := p.db.Close(); err != nil {
 			return fmt.Errorf("close before delete: %w", err)
 		}
 		p.db = nil
 	}
+	if p.fs != nil {
+		return p.fs.RemoveAll(p.filename)
+	}
 	return os.RemoveAll(p.filename)
 }
 
 func (p *PebbleDB) Close() error {
+	// pebble refuses to close with iterators open
+	p.closeIter()
 	if p.db != nil {
 		err := p.db.Close()
 		p.db = nil
@@ -83,13 +288,112 @@ func (p *PebbleDB) Close() error {
 	return nil
 }
 
+// Next returns the next key of the database, walking it with an iterator in key order.
 func (p *PebbleDB) Next() (string, bool, error) {
-	if p.current >= p.dirsize {
+	if p.iterDone {
+		return "", false, nil
+	}
+	if p.db == nil {
+		return "", false, fmt.Errorf("database is not open")
+	}
+	var valid bool
+	if p.iter == nil {
+		iter, err := p.db.NewIter(nil)
+		if err != nil {
+			return "", false, fmt.Errorf("new iterator: %w", err)
+		}
+		p.iter = iter
+		valid = iter.First()
+	} else {
+		valid = p.iter.Next()
+	}
+	if !valid {
+		err := p.iter.Error()
+		p.closeIter()
+		p.iterDone = true
+		if err != nil {
+			return "", false, fmt.Errorf("iterate: %w", err)
+		}
 		return "", false, nil
 	}
-	entry := keyset.GenerateKey(p.current)
 	p.current++
-	return entry, true, nil
+	return string(p.iter.Key()), true, nil
+}
+
+// PrefixScan returns the keys starting with prefix in key order, with an iterator bounded
+// to the prefix.
+func (p *PebbleDB) PrefixScan(prefix string) ([]string, error) {
+	if p.db == nil {
+		return nil, fmt.Errorf("database is not open")
+	}
+	opts := &pebble.IterOptions{LowerBound: []byte(prefix)}
+	if end := keyset.PrefixEnd(prefix); end != "" {
+		opts.UpperBound = []byte(end)
+	}
+	iter, err := p.db.NewIter(opts)
+	if err != nil {
+		return nil, fmt.Errorf("new iterator: %w", err)
+	}
+	var keys []string
+	for valid := iter.First(); valid; valid = iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	err = iter.Error()
+	if closeErr := iter.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("iterate: %w", err)
+	}
+	return keys, nil
+}
+
+// ReadPage returns up to limit keys after cursor in key order, and the cursor of the next
+// page, which is the last key returned. Each page starts an iterator bounded below by the
+// cursor. The next cursor is empty after the last page.
+func (p *PebbleDB) ReadPage(cursor string, limit int) ([]string, string, error) {
+	if p.db == nil {
+		return nil, "", fmt.Errorf("database is not open")
+	}
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	iter, err := p.db.NewIter(&pebble.IterOptions{LowerBound: []byte(keyset.KeyAfter(cursor))})
+	if err != nil {
+		return nil, "", fmt.Errorf("new iterator: %w", err)
+	}
+	keys := make([]string, 0, limit)
+	var next string
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if len(keys) == limit {
+			next = keys[limit-1]
+			break
+		}
+		keys = append(keys, string(iter.Key()))
+	}
+	err = iter.Error()
+	if closeErr := iter.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("iterate: %w", err)
+	}
+	return keys, next, nil
+}
+
+// Rewind makes Next start over from the first key, without reopening the database.
+func (p *PebbleDB) Rewind() {
+	p.closeIter()
+	p.iterDone = false
+}
+
+// closeIter closes the iterator of Next, if any.
+func (p *PebbleDB) closeIter() {
+	if p.iter != nil {
+		_ = p.iter.Close()
+		p.iter = nil
+	}
+	p.current = 0
 }
 
 func (p *PebbleDB) Lookup(index int, valid bool) (string, error) {
@@ -113,30 +417,30 @@ func (p *PebbleDB) Lookup(index int, valid bool) (string, error) {
 		return "", fmt.Errorf("no row found")
 	}
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("get: %w", err)
 	}
 	defer closer.Close()
 
 	return string(value), nil
 }
 
-// testLogger wraps testing.T and implements the pebble.Logger interface
+// testLogger wraps testing.TB and implements the pebble.Logger interface
 type testLogger struct {
-	b *testing.B
+	tb testing.TB
 }
 
 // Infof logs to testing.T
 func (l *testLogger) Infof(format string, args ...interface{}) {
 	// Make it quiet for regular logging
-	// l.b.Logf(format, args...)
+	// l.tb.Logf(format, args...)
 }
 
 // Errorf logs to testing.T
 func (l *testLogger) Errorf(format string, args ...interface{}) {
-	// l.b.Logf(format, args...)
+	// l.tb.Logf(format, args...)
 }
 
 // Fatalf logs to testing.T and fails the test
 func (l *testLogger) Fatalf(format string, args ...interface{}) {
-	l.b.Fatalf(format, args...)
+	l.tb.Fatalf(format, args...)
 }
@@ -0,0 +1,58 @@
+package pebbledb
+
+import (
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/bloom"
+)
+
+// Profile is a set of table and cache options. Zero fields keep pebble's defaults:
+// no filters, 4 KiB blocks, snappy compression and an 8 MiB block cache.
+type Profile struct {
+	Name            string
+	BloomBitsPerKey int                // bits per key of a bloom filter on every table, 0 for none
+	BlockSize       int                // target uncompressed size of a data block in bytes
+	Compression     pebble.Compression // block compression
+	CacheSize       int64              // block cache size in bytes
+}
+
+var (
+	// ProfileDefault is what an empty pebble.Options gives you.
+	ProfileDefault = Profile{Name: "default"}
+	// ProfileBloom10 adds a 10 bits-per-key bloom filter, which lets misses skip reading data blocks.
+	ProfileBloom10 = Profile{Name: "bloom10", BloomBitsPerKey: 10}
+	// ProfileSmallBlocks uses 1 KiB blocks, so a point lookup reads and decompresses less.
+	ProfileSmallBlocks = Profile{Name: "small-blocks", BlockSize: 1 << 10}
+	// ProfileLargeCache uses a 256 MiB block cache.
+	ProfileLargeCache = Profile{Name: "large-cache", CacheSize: 256 << 20}
+	// ProfileNoCompression stores blocks uncompressed.
+	ProfileNoCompression = Profile{Name: "no-compression", Compression: pebble.NoCompression}
+	// ProfileZstd compresses blocks with zstd instead of snappy.
+	ProfileZstd = Profile{Name: "zstd", Compression: pebble.ZstdCompression}
+
+	// Profiles lists the predefined profiles, for benchmarks.
+	Profiles = []Profile{ProfileDefault, ProfileBloom10, ProfileSmallBlocks, ProfileLargeCache, ProfileNoCompression, ProfileZstd}
+)
+
+// WithProfile opens the database with the table and cache options of profile.
+// The table options only apply to tables written afterwards.
+func WithProfile(profile Profile) Option {
+	return func(p *PebbleDB) {
+		p.profile = profile
+	}
+}
+
+// levels returns the per-level table options of the profile, or nil for the defaults.
+func (pr Profile) levels() []pebble.LevelOptions {
+	if pr.BloomBitsPerKey == 0 && pr.BlockSize == 0 && pr.Compression == pebble.DefaultCompression {
+		return nil
+	}
+	levels := make([]pebble.LevelOptions, 7)
+	for i := range levels {
+		levels[i].BlockSize = pr.BlockSize
+		levels[i].Compression = pr.Compression
+		if pr.BloomBitsPerKey > 0 {
+			levels[i].FilterPolicy = bloom.FilterPolicy(pr.BloomBitsPerKey)
+		}
+	}
+	return levels
+}
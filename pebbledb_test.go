@@ -2,13 +2,14 @@ package main
 
 import (
 	"math/rand"
+	"path/filepath"
 	"testing"
 
 	"github.com/perbu/db-shootout/pebbledb"
 )
 
 func BenchmarkCreateFolderPebble(b *testing.B) {
-	db := pebbledb.New("test.pebble", dirsize, b)
+	db := pebbledb.New("test.pebble", dirsize, b, pebbledb.WithDataset(dataset))
 	for i := 0; i < b.N; i++ {
 		if err := db.CreateFolder(); err != nil {
 			b.Fatalf("create folder: %v", err)
@@ -74,3 +75,104 @@ func BenchmarkReaddirPebble(b *testing.B) {
 		b.Fatalf("delete: %v", err)
 	}
 }
+
+// pebbleProfiles opens a read-only pebble store for each tuning profile for fn. The store
+// is bulk loaded, so reads go to an sstable written with the profile's table options.
+func pebbleProfiles(b *testing.B, fn func(b *testing.B, db *pebbledb.PebbleDB)) {
+	for _, profile := range pebbledb.Profiles {
+		b.Run(profile.Name, func(b *testing.B) {
+			db := pebbledb.New(filepath.Join(b.TempDir(), "test.pebble"), dirsize, b,
+				pebbledb.WithProfile(profile), pebbledb.WithDataset(dataset), pebbledb.WithBulkLoad())
+			if err := db.CreateFolder(); err != nil {
+				b.Fatalf("create folder: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				b.Fatalf("close: %v", err)
+			}
+			if err := db.OpenReadOnly(); err != nil {
+				b.Fatalf("open readonly: %v", err)
+			}
+			defer db.Close()
+			b.ResetTimer()
+			fn(b, db)
+			b.StopTimer()
+		})
+	}
+}
+
+// BenchmarkLookupPebbleProfile looks up existing and missing keys under every profile.
+func BenchmarkLookupPebbleProfile(b *testing.B) {
+	pebbleProfiles(b, func(b *testing.B, db *pebbledb.PebbleDB) {
+		b.Run("hit", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Lookup(rand.Intn(dirsize), true); err != nil {
+					b.Fatalf("lookup valid: %v", err)
+				}
+			}
+		})
+		b.Run("miss", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Lookup(rand.Intn(dirsize), false); err == nil {
+					b.Fatalf("lookup of an invalid key succeeded")
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkReaddirPebbleProfile iterates the whole store under every profile.
+func BenchmarkReaddirPebbleProfile(b *testing.B) {
+	pebbleProfiles(b, func(b *testing.B, db *pebbledb.PebbleDB) {
+		for i := 0; i < b.N; i++ {
+			for entry := 0; entry < dirsize; entry++ {
+				if _, ok, err := db.Next(); err != nil || !ok {
+					b.Fatalf("next: %v, %v", ok, err)
+				}
+			}
+			if _, ok, err := db.Next(); err != nil || ok {
+				b.Fatalf("next past the end: %v, %v", ok, err)
+			}
+			// reopen to start over, without counting the open
+			b.StopTimer()
+			if err := db.Close(); err != nil {
+				b.Fatalf("close: %v", err)
+			}
+			if err := db.OpenReadOnly(); err != nil {
+				b.Fatalf("open readonly: %v", err)
+			}
+			b.StartTimer()
+		}
+	})
+}
+
+// TestPebbleProfiles checks that every profile reads back what it wrote, in key order.
+func TestPebbleProfiles(t *testing.T) {
+	for _, profile := range pebbledb.Profiles {
+		t.Run(profile.Name, func(t *testing.T) {
+			db := pebbledb.New(filepath.Join(t.TempDir(), "test.pebble"), dirsize, t,
+				pebbledb.WithProfile(profile), pebbledb.WithDataset(dataset))
+			if err := db.CreateFolder(); err != nil {
+				t.Fatalf("create folder: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+			if err := db.OpenReadOnly(); err != nil {
+				t.Fatalf("open readonly: %v", err)
+			}
+			defer db.Close()
+			for i := 0; i < dirsize; i++ {
+				name, ok, err := db.Next()
+				if err != nil || !ok || name != dataset.Key(i) {
+					t.Fatalf("next got %q, %v, %v, want %q", name, ok, err, dataset.Key(i))
+				}
+			}
+			if _, ok, err := db.Next(); err != nil || ok {
+				t.Fatalf("next past the end: %v, %v", ok, err)
+			}
+			if value, err := db.Lookup(3, true); err != nil || value != dataset.Value(3) {
+				t.Fatalf("lookup got %q, %v, want %q", value, err, dataset.Value(3))
+			}
+		})
+	}
+}
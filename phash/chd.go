@@ -0,0 +1,95 @@
+package phash
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// bucketSize is the average number of keys per bucket. Larger buckets make the seed
+// table smaller but take longer to place.
+const bucketSize = 4
+
+// maxSeed bounds the search for a bucket's seed. Running past it means two keys hash
+// identically, which in practice means a duplicate key.
+const maxSeed = 1 << 24
+
+// hashKey is the hash every slot is derived from.
+func hashKey(key []byte) uint64 {
+	return xxhash.Sum64(key)
+}
+
+// bucketOf returns the bucket of a key hash.
+func bucketOf(h uint64, buckets int) int {
+	return int((h >> 32) % uint64(buckets))
+}
+
+// slotOf returns the slot a key hash lands in with the given seed, mixing them with the
+// splitmix64 finalizer.
+func slotOf(h uint64, seed uint32, slots int) int {
+	x := h + uint64(seed)*0x9e3779b97f4a7c15
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return int(x % uint64(slots))
+}
+
+// build finds a seed per bucket so that every key lands in its own slot, with as many
+// slots as keys: the hash-and-displace (CHD) construction without the compression of the
+// seed table. It returns the seeds and the key index in every slot.
+func build(hashes []uint64) ([]uint32, []int, error) {
+	n := len(hashes)
+	nb := (n + bucketSize - 1) / bucketSize
+	if nb == 0 {
+		return nil, nil, nil
+	}
+	members := make([][]int, nb)
+	for i, h := range hashes {
+		b := bucketOf(h, nb)
+		members[b] = append(members[b], i)
+	}
+	// place the largest buckets first, while most slots are still free
+	order := make([]int, nb)
+	for b := range order {
+		order[b] = b
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		return len(members[b]) - len(members[a])
+	})
+
+	seeds := make([]uint32, nb)
+	slots := make([]int, n)
+	for i := range slots {
+		slots[i] = -1
+	}
+	placed := make([]int, 0, bucketSize*4)
+	for _, b := range order {
+		if len(members[b]) == 0 {
+			break
+		}
+		seed, ok := uint32(0), false
+		for ; seed < maxSeed && !ok; seed++ {
+			placed = placed[:0]
+			ok = true
+			for _, i := range members[b] {
+				s := slotOf(hashes[i], seed, n)
+				if slots[s] != -1 || slices.Contains(placed, s) {
+					ok = false
+					break
+				}
+				placed = append(placed, s)
+			}
+		}
+		if !ok {
+			return nil, nil, fmt.Errorf("no seed places bucket %d, are there duplicate keys?", b)
+		}
+		seeds[b] = seed - 1
+		for j, i := range members[b] {
+			slots[placed[j]] = i
+		}
+	}
+	return seeds, slots, nil
+}
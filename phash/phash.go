@@ -0,0 +1,311 @@
+// Package phash stores the folder in a static file indexed by a minimal perfect hash. A
+// lookup hashes the key once, picks the seed of its bucket and reads the one slot the key
+// can be in, then compares the key stored there to reject keys that aren't in the set.
+// The file is read through a memory map, the way cdb64 reads its file.
+//
+// The file is little-endian:
+//
+//	magic   [8]byte          "phash01\n"
+//	count   uint64           number of entries, and of slots
+//	buckets uint64           number of buckets
+//	seeds   [buckets]uint32  seed of every bucket
+//	offsets [count+1]uint64  start of every slot's entry relative to the first, and the end of the last
+//	entries                  uint32 key length, key, value, in slot order
+package phash
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/perbu/db-shootout/atomicfile"
+	"github.com/perbu/db-shootout/durability"
+	"github.com/perbu/db-shootout/internal/offsettable"
+	"github.com/perbu/db-shootout/keyset"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	magic      = "phash01\n"
+	headerSize = len(magic) + 16
+)
+
+// PerfectHash implements the BenchmarkDB interface on top of a perfect-hash indexed file.
+type PerfectHash struct {
+	filename string
+	dirsize  int
+	mode     durability.Mode
+	data     *keyset.Dataset
+
+	mapped  []byte // the whole file, nil when closed
+	buckets int
+	seeds   []byte // the seed table within mapped
+	table   offsettable.Table
+	current int
+}
+
+// Option configures a PerfectHash.
+type Option func(*PerfectHash)
+
+// WithDurability selects whether the published file is fsynced. The hash is built over
+// the whole key set before anything is written, so there is nothing to sync per op.
+func WithDurability(mode durability.Mode) Option {
+	return func(p *PerfectHash) {
+		p.mode = mode
+	}
+}
+
+// WithDataset populates the file from a pre-generated dataset instead of generating
+// entries while writing.
+func WithDataset(data *keyset.Dataset) Option {
+	return func(p *PerfectHash) {
+		p.data = data
+	}
+}
+
+// New creates a new PerfectHash stored in filename.
+func New(filename string, dirsize int, opts ...Option) *PerfectHash {
+	p := &PerfectHash{
+		filename: filename,
+		dirsize:  dirsize,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// OpenReadOnly maps the file and checks its header and tables.
+func (p *PerfectHash) OpenReadOnly() error {
+	f, err := os.Open(p.filename)
+	if err != nil {
+		return fmt.Errorf("open phash: %w", err)
+	}
+	// the mapping outlives the descriptor
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat phash: %w", err)
+	}
+	if info.Size() < int64(headerSize) {
+		return fmt.Errorf("open phash: file too short")
+	}
+	mapped, err := unix.Mmap(int(f.Fd()), 0, int(info.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	}
+	if err := p.parse(mapped); err != nil {
+		_ = unix.Munmap(mapped)
+		return fmt.Errorf("open phash: %w", err)
+	}
+	p.mapped = mapped
+	p.current = 0
+	return nil
+}
+
+// parse points the tables into mapped.
+func (p *PerfectHash) parse(mapped []byte) error {
+	if string(mapped[:len(magic)]) != magic {
+		return fmt.Errorf("not a phash file")
+	}
+	count := binary.LittleEndian.Uint64(mapped[len(magic):])
+	buckets := binary.LittleEndian.Uint64(mapped[len(magic)+8:])
+	rest := mapped[headerSize:]
+	if buckets > uint64(len(rest))/4 || (count > 0) != (buckets > 0) {
+		return fmt.Errorf("tables truncated")
+	}
+	table, err := offsettable.Wide.Parse(rest[buckets*4:], count)
+	if err != nil {
+		return err
+	}
+	p.buckets, p.seeds, p.table = int(buckets), rest[:buckets*4], table
+	return nil
+}
+
+// CreateFolder writes the file.
+func (p *PerfectHash) CreateFolder() error {
+	if err := p.Populate(); err != nil {
+		return fmt.Errorf("populate: %w", err)
+	}
+	return nil
+}
+
+// Populate builds a perfect hash over dirsize keys, writes a fresh file and atomically
+// renames it into place. Unless durability is off, it is fsynced around the rename.
+func (p *PerfectHash) Populate() error {
+	hashes := make([]uint64, p.dirsize)
+	for i := range hashes {
+		hashes[i] = hashKey(p.data.KeyBytes(i))
+	}
+	seeds, slots, err := build(hashes)
+	if err != nil {
+		return fmt.Errorf("build perfect hash: %w", err)
+	}
+	f, err := atomicfile.Create(p.filename, p.mode != durability.None)
+	if err != nil {
+		return fmt.Errorf("create phash: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	if err := p.write(w, seeds, slots); err != nil {
+		f.Abort()
+		return fmt.Errorf("write phash: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		f.Abort()
+		return fmt.Errorf("write phash: %w", err)
+	}
+	if err := f.Commit(); err != nil {
+		f.Abort()
+		return fmt.Errorf("publish: %w", err)
+	}
+	return f.Close()
+}
+
+// write writes the header, the seed and offset tables and the entries in slot order.
+// bufio.Writer keeps the first write error, the caller's Flush reports it.
+func (p *PerfectHash) write(w *bufio.Writer, seeds []uint32, slots []int) error {
+	var buf [8]byte
+	w.WriteString(magic)
+	binary.LittleEndian.PutUint64(buf[:], uint64(len(slots)))
+	w.Write(buf[:])
+	binary.LittleEndian.PutUint64(buf[:], uint64(len(seeds)))
+	w.Write(buf[:])
+	for _, seed := range seeds {
+		binary.LittleEndian.PutUint32(buf[:4], seed)
+		w.Write(buf[:4])
+	}
+	return offsettable.Wide.Write(w, p.data, slots)
+}
+
+// IndexSize returns the bytes of the open file taken up by the seed and offset tables.
+func (p *PerfectHash) IndexSize() int {
+	return len(p.seeds) + p.table.Size()
+}
+
+// Delete removes the file.
+func (p *PerfectHash) Delete() error {
+	if err := p.Close(); err != nil {
+		return err
+	}
+	return os.Remove(p.filename)
+}
+
+// Close unmaps the file. Slices returned by Get are invalid afterwards.
+func (p *PerfectHash) Close() error {
+	if p.mapped != nil {
+		err := unix.Munmap(p.mapped)
+		p.mapped, p.seeds, p.table = nil, nil, offsettable.Table{}
+		p.buckets = 0
+		return err
+	}
+	return nil
+}
+
+// Get returns the value of key without copying, or nil if the key doesn't exist. The
+// value points into the mapping and is only valid until Close.
+func (p *PerfectHash) Get(key []byte) ([]byte, error) {
+	if p.mapped == nil {
+		return nil, fmt.Errorf("database is not open")
+	}
+	count := p.table.Len()
+	if count == 0 {
+		return nil, nil
+	}
+	h := hashKey(key)
+	seed := binary.LittleEndian.Uint32(p.seeds[bucketOf(h, p.buckets)*4:])
+	k, v, err := p.table.Entry(slotOf(h, seed, count))
+	if err != nil {
+		return nil, err
+	}
+	// a key outside the set still lands in some slot
+	if !bytes.Equal(k, key) {
+		return nil, nil
+	}
+	return v, nil
+}
+
+// Next returns the keys in slot order, straight from the file.
+func (p *PerfectHash) Next() (string, bool, error) {
+	if p.mapped == nil {
+		return "", false, fmt.Errorf("database is not open")
+	}
+	if p.current >= p.table.Len() {
+		return "", false, nil
+	}
+	key, _, err := p.table.Entry(p.current)
+	if err != nil {
+		return "", false, err
+	}
+	p.current++
+	return string(key), true, nil
+}
+
+// PrefixScan returns the keys starting with prefix in slot order. A perfect hash only
+// answers exact keys, so this scans every slot.
+func (p *PerfectHash) PrefixScan(prefix string) ([]string, error) {
+	if p.mapped == nil {
+		return nil, fmt.Errorf("database is not open")
+	}
+	var keys []string
+	for i := 0; i < p.table.Len(); i++ {
+		key, _, err := p.table.Entry(i)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(key, []byte(prefix)) {
+			keys = append(keys, string(key))
+		}
+	}
+	return keys, nil
+}
+
+// ReadPage returns up to limit keys after cursor in slot order, and the cursor of the
+// next page. The cursor is a slot number, and the offset table finds any slot directly.
+// The next cursor is empty after the last page.
+func (p *PerfectHash) ReadPage(cursor string, limit int) ([]string, string, error) {
+	if p.mapped == nil {
+		return nil, "", fmt.Errorf("database is not open")
+	}
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	pos, err := keyset.ParsePositionCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	count := p.table.Len()
+	i := int(min(pos, int64(count)))
+	end := min(i+limit, count)
+	keys, err := p.table.Keys(i, end)
+	if err != nil {
+		return nil, "", err
+	}
+	if end == count {
+		return keys, "", nil
+	}
+	return keys, keyset.PositionCursor(int64(end)), nil
+}
+
+// Lookup retrieves the content of the entry at the given index.
+func (p *PerfectHash) Lookup(index int, valid bool) (string, error) {
+	if index < 0 || index >= p.dirsize {
+		return "", fmt.Errorf("index out of bounds")
+	}
+	var filename string
+	switch valid {
+	case true:
+		filename = keyset.GenerateKey(index)
+	case false:
+		filename = keyset.GenerateInvalidKey(index)
+	}
+	val, err := p.Get([]byte(filename))
+	if err != nil {
+		return "", fmt.Errorf("get: %w", err)
+	}
+	if val == nil {
+		return "", fmt.Errorf("no row found")
+	}
+	return string(val), nil
+}
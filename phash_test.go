@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	cdbdb64 "github.com/perbu/db-shootout/cdb64"
+	"github.com/perbu/db-shootout/keyset"
+	"github.com/perbu/db-shootout/phash"
+)
+
+// staticBackends are the read-only hash files compared by the perfect-hash benchmarks.
+var staticBackends = []struct {
+	name string
+	new  func(path string) BenchmarkDB
+}{
+	{"CDB64", func(path string) BenchmarkDB { return cdbdb64.New(path, dirsize, cdbdb64.WithDataset(dataset)) }},
+	{"PerfectHash", func(path string) BenchmarkDB { return phash.New(path, dirsize, phash.WithDataset(dataset)) }},
+}
+
+func BenchmarkCreateFolderPerfectHash(b *testing.B) {
+	for _, backend := range staticBackends {
+		b.Run(backend.name, func(b *testing.B) {
+			db := backend.new(filepath.Join(b.TempDir(), "test.db"))
+			for i := 0; i < b.N; i++ {
+				if err := db.CreateFolder(); err != nil {
+					b.Fatalf("create folder: %v", err)
+				}
+				if err := db.Delete(); err != nil {
+					b.Fatalf("delete: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkLookupPerfectHash looks up existing and missing keys in cdb64 and the perfect hash.
+func BenchmarkLookupPerfectHash(b *testing.B) {
+	for _, backend := range staticBackends {
+		for _, valid := range []bool{true, false} {
+			name := backend.name + "/hit"
+			if !valid {
+				name = backend.name + "/miss"
+			}
+			b.Run(name, func(b *testing.B) {
+				db := backend.new(filepath.Join(b.TempDir(), "test.db"))
+				if err := db.CreateFolder(); err != nil {
+					b.Fatalf("create folder: %v", err)
+				}
+				if err := db.OpenReadOnly(); err != nil {
+					b.Fatalf("open readonly: %v", err)
+				}
+				defer db.Delete()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_, err := db.Lookup(rand.Intn(dirsize), valid)
+					if valid && err != nil {
+						b.Fatalf("lookup valid: %v", err)
+					}
+					if !valid && err == nil {
+						b.Fatalf("lookup invalid succeeded")
+					}
+				}
+				b.StopTimer()
+				if db, ok := db.(*phash.PerfectHash); ok {
+					b.ReportMetric(float64(db.IndexSize())/dirsize, "index-B/key")
+				}
+			})
+		}
+	}
+}
+
+// TestPerfectHash checks the entries at a few sizes, down to a single key.
+func TestPerfectHash(t *testing.T) {
+	for _, size := range []int{1, 7, dirsize, 20 * dirsize} {
+		t.Run(fmt.Sprintf("entries=%d", size), func(t *testing.T) {
+			data := dataset
+			if size != dirsize {
+				data = keyset.NewDataset(size)
+			}
+			db := phash.New(filepath.Join(t.TempDir(), "test.phash"), size, phash.WithDataset(data))
+			defer db.Delete()
+			checkEntries(t, db, data, size, false)
+		})
+	}
+}
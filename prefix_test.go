@@ -0,0 +1,173 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/perbu/db-shootout/badgerdb"
+	"github.com/perbu/db-shootout/bitcask"
+	"github.com/perbu/db-shootout/boltdb"
+	"github.com/perbu/db-shootout/btree"
+	cdbdb64 "github.com/perbu/db-shootout/cdb64"
+	cdbdb "github.com/perbu/db-shootout/cdbdb"
+	"github.com/perbu/db-shootout/fsdir"
+	"github.com/perbu/db-shootout/keyset"
+	"github.com/perbu/db-shootout/memdb"
+	"github.com/perbu/db-shootout/pebbledb"
+	"github.com/perbu/db-shootout/phash"
+	"github.com/perbu/db-shootout/shardcdb"
+	"github.com/perbu/db-shootout/sortedfile"
+	"github.com/perbu/db-shootout/sqlite"
+	"github.com/perbu/db-shootout/sqlitesql"
+	"github.com/perbu/db-shootout/zblob"
+	"github.com/perbu/db-shootout/zipdb"
+)
+
+// lister is the part of a backend needed to benchmark prefix scans and paging.
+type lister interface {
+	CreateFolder() error
+	OpenReadOnly() error
+	PrefixScan(prefix string) ([]string, error)
+	ReadPage(cursor string, limit int) ([]string, string, error)
+	Close() error
+	Delete() error
+}
+
+// listBackends are all of the backends. The ordered ones list keys in key order.
+var listBackends = []struct {
+	name    string
+	ordered bool
+	new     func(path string, size int, data *keyset.Dataset, tb testing.TB) lister
+}{
+	{"Sqlite", true, func(path string, size int, data *keyset.Dataset, tb testing.TB) lister {
+		return sqlite.New(path, size, sqlite.WithDataset(data))
+	}},
+	{"SqliteSQL", true, func(path string, size int, data *keyset.Dataset, tb testing.TB) lister {
+		return sqlitesql.New(path, size, sqlitesql.WithDataset(data))
+	}},
+	{"Bolt", true, func(path string, size int, data *keyset.Dataset, tb testing.TB) lister {
+		return boltdb.New(path, size, boltdb.WithDataset(data))
+	}},
+	{"Pebble", true, func(path string, size int, data *keyset.Dataset, tb testing.TB) lister {
+		return pebbledb.New(path, size, tb, pebbledb.WithDataset(data))
+	}},
+	{"Badger", true, func(path string, size int, data *keyset.Dataset, tb testing.TB) lister {
+		return badgerdb.New(path, size, badgerdb.WithDataset(data))
+	}},
+	{"CDB", false, func(path string, size int, data *keyset.Dataset, tb testing.TB) lister {
+		return cdbdb.New(path, size, cdbdb.WithDataset(data))
+	}},
+	{"CDB64", false, func(path string, size int, data *keyset.Dataset, tb testing.TB) lister {
+		return cdbdb64.New(path, size, cdbdb64.WithDataset(data))
+	}},
+	{"ShardCDB", false, func(path string, size int, data *keyset.Dataset, tb testing.TB) lister {
+		return shardcdb.New(path, size, 8, shardcdb.WithDataset(data))
+	}},
+	{"PerfectHash", false, func(path string, size int, data *keyset.Dataset, tb testing.TB) lister {
+		return phash.New(path, size, phash.WithDataset(data))
+	}},
+	{"SortedFile", true, func(path string, size int, data *keyset.Dataset, tb testing.TB) lister {
+		return sortedfile.New(path, size, sortedfile.WithDataset(data))
+	}},
+	{"BTree", true, func(path string, size int, data *keyset.Dataset, tb testing.TB) lister {
+		return btree.New(path, size, btree.WithDataset(data))
+	}},
+	{"Bitcask", false, func(path string, size int, data *keyset.Dataset, tb testing.TB) lister {
+		return bitcask.New(path, size, bitcask.WithDataset(data))
+	}},
+	{"MemDB", true, func(path string, size int, data *keyset.Dataset, tb testing.TB) lister {
+		return memdb.New(path, size, memdb.WithDataset(data))
+	}},
+	{"FSDir", false, func(path string, size int, data *keyset.Dataset, tb testing.TB) lister {
+		return fsdir.New(path, size, fsdir.WithDataset(data))
+	}},
+	{"ZBlob", true, func(path string, size int, data *keyset.Dataset, tb testing.TB) lister {
+		return zblob.New(path, size, zblob.WithDataset(data))
+	}},
+	{"Zip", false, func(path string, size int, data *keyset.Dataset, tb testing.TB) lister {
+		return zipdb.New(path, size, zipdb.WithDataset(data))
+	}},
+}
+
+// prefixes go from matching one key of the directory to all of them, and none.
+var prefixes = []struct {
+	name   string
+	prefix string
+}{
+	{"none", "file_x"},
+	{"1", "file_0123"},
+	{"10", "file_012"},
+	{"100", "file_01"},
+	{"1000", "file_"},
+}
+
+// openLister creates a backend's directory of size entries and opens it for reading.
+func openLister(tb testing.TB, size int, data *keyset.Dataset, new func(path string, size int, data *keyset.Dataset, tb testing.TB) lister) lister {
+	tb.Helper()
+	db := new(filepath.Join(tb.TempDir(), "test.db"), size, data, tb)
+	if err := db.CreateFolder(); err != nil {
+		tb.Fatalf("create folder: %v", err)
+	}
+	// some stores keep the handle CreateFolder wrote through
+	if err := db.Close(); err != nil {
+		tb.Fatalf("close: %v", err)
+	}
+	if err := db.OpenReadOnly(); err != nil {
+		tb.Fatalf("open readonly: %v", err)
+	}
+	tb.Cleanup(func() {
+		db.Close()
+		db.Delete()
+	})
+	return db
+}
+
+// BenchmarkPrefixScan measures listing the keys under a prefix as the share of the
+// directory it matches grows.
+func BenchmarkPrefixScan(b *testing.B) {
+	for _, backend := range listBackends {
+		b.Run(backend.name, func(b *testing.B) {
+			db := openLister(b, dirsize, dataset, backend.new)
+			for _, p := range prefixes {
+				b.Run("matches="+p.name, func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						if _, err := db.PrefixScan(p.prefix); err != nil {
+							b.Fatalf("prefix scan: %v", err)
+						}
+					}
+				})
+			}
+		})
+	}
+}
+
+// TestPrefixScan checks that every backend finds exactly the keys under each prefix, in
+// key order for the ordered ones.
+func TestPrefixScan(t *testing.T) {
+	for _, backend := range listBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			db := openLister(t, dirsize, dataset, backend.new)
+			for _, p := range prefixes {
+				var want []string
+				for i := 0; i < dirsize; i++ {
+					if key := dataset.Key(i); strings.HasPrefix(key, p.prefix) {
+						want = append(want, key)
+					}
+				}
+				got, err := db.PrefixScan(p.prefix)
+				if err != nil {
+					t.Fatalf("prefix scan %q: %v", p.prefix, err)
+				}
+				if backend.ordered && !slices.IsSorted(got) {
+					t.Errorf("prefix scan %q: keys out of order", p.prefix)
+				}
+				slices.Sort(got)
+				if !slices.Equal(got, want) {
+					t.Errorf("prefix scan %q: got %d keys, want %d", p.prefix, len(got), len(want))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	cdbdb64 "github.com/perbu/db-shootout/cdb64"
+	cdbdb "github.com/perbu/db-shootout/cdbdb"
+)
+
+// publisher is a CDB backend that is rebuilt and swapped while readers have it open.
+type publisher interface {
+	CreateFolder() error
+	OpenReadOnly() error
+	Close() error
+	Reload() (bool, error)
+	Lookup(index int, valid bool) (string, error)
+}
+
+var publishBackends = []struct {
+	name string
+	new  func(path string) publisher
+}{
+	{"cdb", func(path string) publisher { return cdbdb.New(path, dirsize) }},
+	{"cdb64", func(path string) publisher { return cdbdb64.New(path, dirsize) }},
+}
+
+func TestCDBReload(t *testing.T) {
+	for _, backend := range publishBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), backend.name)
+			writer, reader := backend.new(path), backend.new(path)
+			if err := writer.CreateFolder(); err != nil {
+				t.Fatalf("create folder: %v", err)
+			}
+			if err := reader.OpenReadOnly(); err != nil {
+				t.Fatalf("open readonly: %v", err)
+			}
+			defer reader.Close()
+			old, err := reader.Lookup(0, true)
+			if err != nil {
+				t.Fatalf("lookup: %v", err)
+			}
+			if reloaded, err := reader.Reload(); err != nil || reloaded {
+				t.Fatalf("reload without a new generation: %v, %v", reloaded, err)
+			}
+			if err := writer.CreateFolder(); err != nil {
+				t.Fatalf("create folder: %v", err)
+			}
+			// the reader keeps serving the generation it opened
+			if value, err := reader.Lookup(0, true); err != nil || value != old {
+				t.Fatalf("lookup in old generation: %q, %v", value, err)
+			}
+			if reloaded, err := reader.Reload(); err != nil || !reloaded {
+				t.Fatalf("reload after publish: %v, %v", reloaded, err)
+			}
+			if value, err := reader.Lookup(0, true); err != nil || value == old {
+				t.Fatalf("lookup in new generation: %q, %v", value, err)
+			}
+		})
+	}
+}
+
+// TestCDBConcurrentPublish rebuilds the file while readers keep opening it. A reader
+// must never see a half-written file.
+func TestCDBConcurrentPublish(t *testing.T) {
+	const generations = 20
+	for _, backend := range publishBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), backend.name)
+			writer := backend.new(path)
+			if err := writer.CreateFolder(); err != nil {
+				t.Fatalf("create folder: %v", err)
+			}
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer close(done)
+				for i := 0; i < generations; i++ {
+					if err := writer.CreateFolder(); err != nil {
+						t.Errorf("create folder: %v", err)
+						return
+					}
+				}
+			}()
+			reader := backend.new(path)
+			for {
+				select {
+				case <-done:
+					wg.Wait()
+					return
+				default:
+				}
+				if err := reader.OpenReadOnly(); err != nil {
+					t.Fatalf("open readonly during publish: %v", err)
+				}
+				for i := 0; i < dirsize; i++ {
+					if _, err := reader.Lookup(i, true); err != nil {
+						t.Fatalf("lookup during publish: %v", err)
+					}
+				}
+				if err := reader.Close(); err != nil {
+					t.Fatalf("close: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/perbu/db-shootout/badgerdb"
+	"github.com/perbu/db-shootout/pebbledb"
+)
+
+// settler is an LSM backend that can be compacted into its steady-state shape.
+type settler interface {
+	CreateFolder() error
+	Settle() error
+	Close() error
+	Delete() error
+	Next() (string, bool, error)
+	Rewind()
+	Lookup(index int, valid bool) (string, error)
+}
+
+var settleBackends = []struct {
+	name string
+	new  func(path string, tb testing.TB) settler
+}{
+	{"Pebble", func(path string, tb testing.TB) settler {
+		return pebbledb.New(path, dirsize, tb, pebbledb.WithDataset(dataset))
+	}},
+	{"Badger", func(path string, tb testing.TB) settler {
+		return badgerdb.New(path, dirsize, badgerdb.WithDataset(dataset))
+	}},
+}
+
+// createSettled creates a store and settles it if asked to. The reads go through the
+// handle that did the writes: reopening would flush badger's memtable on close, and
+// "pre" would no longer read from it.
+func createSettled(tb testing.TB, db settler, settle bool) {
+	tb.Helper()
+	if err := db.CreateFolder(); err != nil {
+		tb.Fatalf("create folder: %v", err)
+	}
+	if settle {
+		if err := db.Settle(); err != nil {
+			tb.Fatalf("settle: %v", err)
+		}
+	}
+}
+
+// settlePhases runs fn against every backend, straight after the batch write and after settling.
+func settlePhases(b *testing.B, fn func(b *testing.B, db settler)) {
+	for _, backend := range settleBackends {
+		for _, phase := range []struct {
+			name   string
+			settle bool
+		}{{"pre", false}, {"post", true}} {
+			b.Run(backend.name+"/"+phase.name, func(b *testing.B) {
+				db := backend.new(filepath.Join(b.TempDir(), "test.db"), b)
+				createSettled(b, db, phase.settle)
+				defer db.Delete()
+				b.ResetTimer()
+				fn(b, db)
+				b.StopTimer()
+			})
+		}
+	}
+}
+
+// BenchmarkLookupSettle compares lookups before and after compaction.
+func BenchmarkLookupSettle(b *testing.B) {
+	settlePhases(b, func(b *testing.B, db settler) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.Lookup(rand.Intn(dirsize), true); err != nil {
+				b.Fatalf("lookup valid: %v", err)
+			}
+		}
+	})
+}
+
+// BenchmarkReaddirSettle compares full iterations before and after compaction.
+func BenchmarkReaddirSettle(b *testing.B) {
+	settlePhases(b, func(b *testing.B, db settler) {
+		for i := 0; i < b.N; i++ {
+			for entry := 0; entry < dirsize; entry++ {
+				if _, ok, err := db.Next(); err != nil || !ok {
+					b.Fatalf("next: %v, %v", ok, err)
+				}
+			}
+			// start over on the same handle, which still holds the memtable before settling
+			db.Rewind()
+		}
+	})
+}
+
+// TestSettle checks that settling keeps every entry.
+func TestSettle(t *testing.T) {
+	for _, backend := range settleBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			db := backend.new(filepath.Join(t.TempDir(), "test.db"), t)
+			createSettled(t, db, true)
+			defer db.Delete()
+			for i := 0; i < dirsize; i++ {
+				name, ok, err := db.Next()
+				if err != nil || !ok || name != dataset.Key(i) {
+					t.Fatalf("next got %q, %v, %v, want %q", name, ok, err, dataset.Key(i))
+				}
+			}
+			if _, ok, err := db.Next(); err != nil || ok {
+				t.Fatalf("next past the end: %v, %v", ok, err)
+			}
+			for _, i := range []int{0, dirsize / 2, dirsize - 1} {
+				if value, err := db.Lookup(i, true); err != nil || value != dataset.Value(i) {
+					t.Fatalf("lookup %d got %q, %v, want %q", i, value, err, dataset.Value(i))
+				}
+			}
+		})
+	}
+}
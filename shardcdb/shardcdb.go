@@ -0,0 +1,407 @@
+package shardcdb
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"iter"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/perbu/cdb"
+	"github.com/perbu/db-shootout/atomicfile"
+	"github.com/perbu/db-shootout/durability"
+	"github.com/perbu/db-shootout/keyset"
+)
+
+// batchSize is the number of entries a generator hands to a shard writer at a time.
+const batchSize = 1024
+
+// ShardedCDB implements the BenchmarkDB interface by hashing keys over a number of
+// github.com/perbu/cdb files, kept in a directory. That lifts the size limit of a single
+// file and lets the shards be built in parallel.
+type ShardedCDB struct {
+	filename string // directory holding the shards
+	dirsize  int
+	shards   int
+	current  int
+	dbs      []*cdb.MmapCDB
+	mode     durability.Mode
+	data     *keyset.Dataset
+
+	// iteration state for Next: the shard being read and a pull iterator over its keys
+	shard    int
+	nextKey  func() ([]byte, bool)
+	stopKeys func()
+
+	positions [][]byte // keys of all shards in listing order for ReadPage, built on the first call
+}
+
+// Option configures a ShardedCDB.
+type Option func(*ShardedCDB)
+
+// WithDurability selects whether the shard files are fsynced. Like a single CDB,
+// every shard is written as one batch.
+func WithDurability(mode durability.Mode) Option {
+	return func(s *ShardedCDB) {
+		s.mode = mode
+	}
+}
+
+// WithDataset populates the store from a pre-generated dataset instead of generating
+// entries while writing.
+func WithDataset(data *keyset.Dataset) Option {
+	return func(s *ShardedCDB) {
+		s.data = data
+	}
+}
+
+// New creates a new ShardedCDB with the given directory, directory size and number of shards.
+func New(filename string, dirsize, shards int, opts ...Option) *ShardedCDB {
+	s := &ShardedCDB{
+		filename: filename,
+		dirsize:  dirsize,
+		shards:   shards,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *ShardedCDB) shardPath(shard int) string {
+	return filepath.Join(s.filename, fmt.Sprintf("shard-%04d.cdb", shard))
+}
+
+// countPath is the file recording how many shards the directory was built with.
+func (s *ShardedCDB) countPath() string {
+	return filepath.Join(s.filename, "shards")
+}
+
+// checkShards rejects a shard count keys cannot be routed with.
+func (s *ShardedCDB) checkShards() error {
+	if s.shards <= 0 {
+		return fmt.Errorf("invalid shard count %d", s.shards)
+	}
+	return nil
+}
+
+// readCount returns the shard count the directory was built with.
+func (s *ShardedCDB) readCount() (int, error) {
+	data, err := os.ReadFile(s.countPath())
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("parse shard count: %w", err)
+	}
+	return n, nil
+}
+
+// writeCount publishes the shard count after the shards themselves.
+func (s *ShardedCDB) writeCount() error {
+	f, err := atomicfile.Create(s.countPath(), s.mode != durability.None)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%d\n", s.shards); err != nil {
+		f.Abort()
+		return err
+	}
+	if err := f.Commit(); err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Close()
+}
+
+// shardOf routes a key to its shard.
+func (s *ShardedCDB) shardOf(key []byte) int {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	return int(h.Sum64() % uint64(s.shards))
+}
+
+// OpenReadOnly maps every shard. The directory must have been built with as many shards
+// as configured, or keys would be looked up in the wrong shard.
+func (s *ShardedCDB) OpenReadOnly() error {
+	if err := s.checkShards(); err != nil {
+		return err
+	}
+	n, err := s.readCount()
+	if err != nil {
+		return fmt.Errorf("open shardcdb: %w", err)
+	}
+	if n != s.shards {
+		return fmt.Errorf("open shardcdb: built with %d shards, configured for %d", n, s.shards)
+	}
+	s.dbs = make([]*cdb.MmapCDB, s.shards)
+	for shard := range s.dbs {
+		db, err := cdb.OpenMmap(s.shardPath(shard))
+		if err != nil {
+			s.Close()
+			return fmt.Errorf("open shard %d: %w", shard, err)
+		}
+		s.dbs[shard] = db
+	}
+	s.current = 0
+	s.shard = 0
+	return nil
+}
+
+// CreateFolder builds all shards in parallel. Generators split the index range between
+// them and route each entry to the writer goroutine owning its shard.
+func (s *ShardedCDB) CreateFolder() error {
+	if err := s.checkShards(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.filename, 0o755); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+	files := make([]*atomicfile.File, s.shards)
+	writers := make([]*cdb.Writer, s.shards)
+	abort := func() {
+		for _, f := range files {
+			if f != nil {
+				f.Abort()
+			}
+		}
+	}
+	for shard := range writers {
+		f, err := atomicfile.Create(s.shardPath(shard), s.mode != durability.None)
+		if err != nil {
+			abort()
+			return fmt.Errorf("create shard %d: %w", shard, err)
+		}
+		files[shard] = f
+		writer, err := cdb.NewWriter(f.File)
+		if err != nil {
+			abort()
+			return fmt.Errorf("create shard %d: %w", shard, err)
+		}
+		writers[shard] = writer
+	}
+
+	type entry struct {
+		key, val []byte
+	}
+	inputs := make([]chan []entry, s.shards)
+	errs := make([]error, s.shards)
+	var writersDone sync.WaitGroup
+	for shard := range inputs {
+		inputs[shard] = make(chan []entry, 4)
+		writersDone.Add(1)
+		go func(shard int) {
+			defer writersDone.Done()
+			for batch := range inputs[shard] {
+				if errs[shard] != nil {
+					continue // keep draining so the generators don't block
+				}
+				for _, e := range batch {
+					if err := writers[shard].Put(e.key, e.val); err != nil {
+						errs[shard] = fmt.Errorf("put: %w", err)
+						break
+					}
+				}
+			}
+		}(shard)
+	}
+
+	generators := runtime.GOMAXPROCS(0)
+	var generatorsDone sync.WaitGroup
+	for g := 0; g < generators; g++ {
+		generatorsDone.Add(1)
+		go func(from, to int) {
+			defer generatorsDone.Done()
+			batches := make([][]entry, s.shards)
+			for i := from; i < to; i++ {
+				key := s.data.KeyBytes(i)
+				shard := s.shardOf(key)
+				batches[shard] = append(batches[shard], entry{key: key, val: s.data.ValueBytes(i)})
+				if len(batches[shard]) == batchSize {
+					inputs[shard] <- batches[shard]
+					batches[shard] = nil
+				}
+			}
+			for shard, batch := range batches {
+				if len(batch) > 0 {
+					inputs[shard] <- batch
+				}
+			}
+		}(s.dirsize*g/generators, s.dirsize*(g+1)/generators)
+	}
+	generatorsDone.Wait()
+	for _, input := range inputs {
+		close(input)
+	}
+	writersDone.Wait()
+	for shard, err := range errs {
+		if err != nil {
+			abort()
+			return fmt.Errorf("populate shard %d: %w", shard, err)
+		}
+	}
+
+	// finalize and publish the shards in parallel as well
+	var publishDone sync.WaitGroup
+	for shard := range writers {
+		publishDone.Add(1)
+		go func(shard int) {
+			defer publishDone.Done()
+			db, err := writers[shard].Freeze()
+			if err != nil {
+				files[shard].Abort()
+				errs[shard] = fmt.Errorf("freeze: %w", err)
+				return
+			}
+			err = files[shard].Commit()
+			// closing db closes the file
+			_ = db.Close()
+			if err != nil {
+				files[shard].Remove()
+				errs[shard] = fmt.Errorf("publish: %w", err)
+			}
+		}(shard)
+	}
+	publishDone.Wait()
+	for shard, err := range errs {
+		if err != nil {
+			// every shard has been published or cleaned up by now
+			return fmt.Errorf("shard %d: %w", shard, err)
+		}
+	}
+	if err := s.writeCount(); err != nil {
+		return fmt.Errorf("publish shard count: %w", err)
+	}
+	s.current = 0
+	return nil
+}
+
+// Delete removes the shard directory.
+func (s *ShardedCDB) Delete() error {
+	return os.RemoveAll(s.filename)
+}
+
+// Close unmaps every shard.
+func (s *ShardedCDB) Close() error {
+	if s.stopKeys != nil {
+		s.stopKeys()
+		s.nextKey, s.stopKeys = nil, nil
+	}
+	var err error
+	for shard, db := range s.dbs {
+		if db == nil {
+			continue
+		}
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+		s.dbs[shard] = nil
+	}
+	s.positions = nil
+	s.dbs = nil
+	return err
+}
+
+// Next returns the next key, going through the shards one after the other.
+func (s *ShardedCDB) Next() (string, bool, error) {
+	if s.dbs == nil {
+		return "", false, fmt.Errorf("database is not open")
+	}
+	for s.shard < len(s.dbs) {
+		if s.nextKey == nil {
+			s.nextKey, s.stopKeys = iter.Pull(s.dbs[s.shard].Keys())
+		}
+		key, ok := s.nextKey()
+		if ok {
+			s.current++
+			return string(key), true, nil
+		}
+		s.stopKeys()
+		s.nextKey, s.stopKeys = nil, nil
+		s.shard++
+	}
+	return "", false, nil
+}
+
+// PrefixScan returns the keys starting with prefix. Keys are hashed over the shards, so
+// this scans every shard, one after the other.
+func (s *ShardedCDB) PrefixScan(prefix string) ([]string, error) {
+	if s.dbs == nil {
+		return nil, fmt.Errorf("database is not open")
+	}
+	var keys []string
+	for _, db := range s.dbs {
+		for key := range db.Keys() {
+			if bytes.HasPrefix(key, []byte(prefix)) {
+				keys = append(keys, string(key))
+			}
+		}
+	}
+	return keys, nil
+}
+
+// ReadPage returns up to limit keys after cursor, shard after shard, and the cursor of
+// the next page. The first call collects every shard's keys into a position table, and
+// the cursor is a position in it. The next cursor is empty after the last page.
+func (s *ShardedCDB) ReadPage(cursor string, limit int) ([]string, string, error) {
+	if s.dbs == nil {
+		return nil, "", fmt.Errorf("database is not open")
+	}
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	pos, err := keyset.ParsePositionCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if s.positions == nil {
+		s.positions = make([][]byte, 0, s.dirsize)
+		for _, db := range s.dbs {
+			for key := range db.Keys() {
+				s.positions = append(s.positions, key)
+			}
+		}
+	}
+	i := int(min(pos, int64(len(s.positions))))
+	end := min(i+limit, len(s.positions))
+	keys := make([]string, 0, end-i)
+	for ; i < end; i++ {
+		keys = append(keys, string(s.positions[i]))
+	}
+	if end == len(s.positions) {
+		return keys, "", nil
+	}
+	return keys, keyset.PositionCursor(int64(end)), nil
+}
+
+// Lookup retrieves content for the generated key at the given index from its shard.
+func (s *ShardedCDB) Lookup(index int, valid bool) (string, error) {
+	if s.dbs == nil {
+		return "", fmt.Errorf("database is not open")
+	}
+	if index < 0 || index >= s.dirsize {
+		return "", fmt.Errorf("index out of bounds")
+	}
+	var filename string
+	switch valid {
+	case true:
+		filename = keyset.GenerateKey(index)
+	case false:
+		filename = keyset.GenerateInvalidKey(index)
+	}
+	key := []byte(filename)
+	val, err := s.dbs[s.shardOf(key)].Get(key)
+	if err != nil {
+		return "", fmt.Errorf("get: %w", err)
+	}
+	if val == nil {
+		return "", fmt.Errorf("no row found")
+	}
+	return string(val), nil
+}
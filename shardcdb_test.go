@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/perbu/db-shootout/keyset"
+	"github.com/perbu/db-shootout/shardcdb"
+)
+
+var shardCounts = []int{1, 4, 16}
+
+// largeDirsize returns the directory size for the large-directory benchmarks, set with
+// e.g. SHOOTOUT_LARGE_DIRSIZE=100000000. They are skipped when it is unset.
+func largeDirsize(b *testing.B) int {
+	value := os.Getenv("SHOOTOUT_LARGE_DIRSIZE")
+	if value == "" {
+		b.Skip("set SHOOTOUT_LARGE_DIRSIZE to run large-directory benchmarks")
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		b.Fatalf("bad SHOOTOUT_LARGE_DIRSIZE %q", value)
+	}
+	return n
+}
+
+// benchmarkCreateFolderSharded builds from data, or generates the entries while building if it is nil.
+func benchmarkCreateFolderSharded(b *testing.B, size int, data *keyset.Dataset) {
+	for _, shards := range shardCounts {
+		b.Run(fmt.Sprintf("shards-%d", shards), func(b *testing.B) {
+			db := shardcdb.New("test.shardcdb", size, shards, shardcdb.WithDataset(data))
+			for i := 0; i < b.N; i++ {
+				if err := db.CreateFolder(); err != nil {
+					b.Fatalf("create folder: %v", err)
+				}
+				if err := db.Delete(); err != nil {
+					b.Fatalf("delete: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func benchmarkLookupSharded(b *testing.B, size int) {
+	for _, shards := range shardCounts {
+		b.Run(fmt.Sprintf("shards-%d", shards), func(b *testing.B) {
+			db := shardcdb.New("test.shardcdb", size, shards)
+			if err := db.CreateFolder(); err != nil {
+				b.Fatalf("create folder: %v", err)
+			}
+			if err := db.OpenReadOnly(); err != nil {
+				b.Fatalf("open readonly: %v", err)
+			}
+			defer db.Delete()
+			defer db.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Lookup(rand.Intn(size), true); err != nil {
+					b.Fatalf("lookup valid: %v", err)
+				}
+			}
+			b.StopTimer()
+		})
+	}
+}
+
+func BenchmarkCreateFolderShardedCDB(b *testing.B) {
+	benchmarkCreateFolderSharded(b, dirsize, dataset)
+}
+
+func BenchmarkCreateFolderShardedCDBLarge(b *testing.B) {
+	// a pre-generated dataset of 100M entries wouldn't fit in memory
+	benchmarkCreateFolderSharded(b, largeDirsize(b), nil)
+}
+
+func BenchmarkLookupShardedCDB(b *testing.B) {
+	benchmarkLookupSharded(b, dirsize)
+}
+
+func BenchmarkLookupShardedCDBLarge(b *testing.B) {
+	benchmarkLookupSharded(b, largeDirsize(b))
+}
+
+func BenchmarkReaddirShardedCDB(b *testing.B) {
+	for _, shards := range shardCounts {
+		b.Run(fmt.Sprintf("shards-%d", shards), func(b *testing.B) {
+			db := shardcdb.New("test.shardcdb", dirsize, shards)
+			if err := db.CreateFolder(); err != nil {
+				b.Fatalf("create folder: %v", err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := db.OpenReadOnly(); err != nil {
+					b.Fatalf("open readonly: %v", err)
+				}
+				for entry := 0; entry < dirsize; entry++ {
+					if _, ok, err := db.Next(); err != nil || !ok {
+						b.Fatalf("next: %v, %v", ok, err)
+					}
+				}
+				if err := db.Close(); err != nil {
+					b.Fatalf("close: %v", err)
+				}
+			}
+			b.StopTimer()
+			if err := db.Delete(); err != nil {
+				b.Fatalf("delete: %v", err)
+			}
+		})
+	}
+}
+
+// TestShardedCDB round-trips a directory through every shard count: every key is found in
+// its shard, invalid keys miss, and Next lists each key exactly once across the shards.
+func TestShardedCDB(t *testing.T) {
+	for _, shards := range shardCounts {
+		t.Run(fmt.Sprintf("shards-%d", shards), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.shardcdb")
+			db := shardcdb.New(path, dirsize, shards, shardcdb.WithDataset(dataset))
+			if err := db.CreateFolder(); err != nil {
+				t.Fatalf("create folder: %v", err)
+			}
+			if err := db.OpenReadOnly(); err != nil {
+				t.Fatalf("open readonly: %v", err)
+			}
+			defer db.Close()
+			for i := 0; i < dirsize; i++ {
+				got, err := db.Lookup(i, true)
+				if err != nil {
+					t.Fatalf("lookup %d: %v", i, err)
+				}
+				if want := dataset.Value(i); got != want {
+					t.Fatalf("lookup %d: got %q, want %q", i, got, want)
+				}
+				if _, err := db.Lookup(i, false); err == nil {
+					t.Fatalf("lookup of invalid key %d succeeded", i)
+				}
+			}
+			seen := make(map[string]bool, dirsize)
+			for {
+				name, ok, err := db.Next()
+				if err != nil {
+					t.Fatalf("next: %v", err)
+				}
+				if !ok {
+					break
+				}
+				if seen[name] {
+					t.Fatalf("next returned %q twice", name)
+				}
+				seen[name] = true
+			}
+			if len(seen) != dirsize {
+				t.Fatalf("next returned %d keys, want %d", len(seen), dirsize)
+			}
+		})
+	}
+}
+
+// TestShardedCDBShardCount checks that a shard count keys cannot be routed with is
+// rejected, and that a directory is only opened with the count it was built with.
+func TestShardedCDBShardCount(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.shardcdb")
+	if err := shardcdb.New(path, dirsize, 0).CreateFolder(); err == nil {
+		t.Fatalf("create folder with 0 shards succeeded")
+	}
+	if err := shardcdb.New(path, dirsize, 4, shardcdb.WithDataset(dataset)).CreateFolder(); err != nil {
+		t.Fatalf("create folder: %v", err)
+	}
+	for _, shards := range []int{0, 2, 8} {
+		db := shardcdb.New(path, dirsize, shards)
+		if err := db.OpenReadOnly(); err == nil {
+			db.Close()
+			t.Fatalf("open with %d shards of a directory built with 4 succeeded", shards)
+		}
+	}
+}
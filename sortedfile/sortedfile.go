@@ -0,0 +1,239 @@
+// Package sortedfile stores the folder as a static file of entries sorted by key, read
+// through a memory map. Lookups binary-search an offset table and Next streams the
+// entries in key order, which a hash-ordered CDB can't do.
+//
+// The file is little-endian:
+//
+//	magic   [8]byte  "sorted01"
+//	count   uint64   number of entries
+//	offsets [count+1]uint64  start of every entry relative to the first, and the end of the last
+//	entries          uint32 key length, key, value; the value runs to the next entry
+package sortedfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/perbu/db-shootout/atomicfile"
+	"github.com/perbu/db-shootout/durability"
+	"github.com/perbu/db-shootout/internal/offsettable"
+	"github.com/perbu/db-shootout/keyset"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	magic      = "sorted01"
+	headerSize = len(magic) + 8
+)
+
+// SortedFile implements the BenchmarkDB interface on top of a sorted, memory-mapped file.
+type SortedFile struct {
+	filename string
+	dirsize  int
+	mode     durability.Mode
+	data     *keyset.Dataset
+
+	mapped  []byte // the whole file, nil when closed
+	table   offsettable.Table
+	current int
+}
+
+// Option configures a SortedFile.
+type Option func(*SortedFile)
+
+// WithDurability selects whether Populate fsyncs the file and its directory around the
+// rename. There are no writes after Populate, so every mode but durability.None is alike.
+func WithDurability(mode durability.Mode) Option {
+	return func(s *SortedFile) {
+		s.mode = mode
+	}
+}
+
+// WithDataset populates the file from a pre-generated dataset instead of generating
+// entries while writing.
+func WithDataset(data *keyset.Dataset) Option {
+	return func(s *SortedFile) {
+		s.data = data
+	}
+}
+
+// New creates a new SortedFile stored in filename.
+func New(filename string, dirsize int, opts ...Option) *SortedFile {
+	s := &SortedFile{
+		filename: filename,
+		dirsize:  dirsize,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// OpenReadOnly maps the file and checks its header and offset table.
+func (s *SortedFile) OpenReadOnly() error {
+	f, err := os.Open(s.filename)
+	if err != nil {
+		return fmt.Errorf("open sortedfile: %w", err)
+	}
+	// the mapping outlives the descriptor
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat sortedfile: %w", err)
+	}
+	if info.Size() < int64(headerSize) {
+		return fmt.Errorf("open sortedfile: file too short")
+	}
+	mapped, err := unix.Mmap(int(f.Fd()), 0, int(info.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	}
+	if err := s.parse(mapped); err != nil {
+		_ = unix.Munmap(mapped)
+		return fmt.Errorf("open sortedfile: %w", err)
+	}
+	s.mapped = mapped
+	s.current = 0
+	return nil
+}
+
+// parse checks the header and points the table into mapped.
+func (s *SortedFile) parse(mapped []byte) error {
+	if string(mapped[:len(magic)]) != magic {
+		return fmt.Errorf("not a sorted file")
+	}
+	count := binary.LittleEndian.Uint64(mapped[len(magic):headerSize])
+	table, err := offsettable.Wide.Parse(mapped[headerSize:], count)
+	if err != nil {
+		return err
+	}
+	s.table = table
+	return nil
+}
+
+// CreateFolder writes the file.
+func (s *SortedFile) CreateFolder() error {
+	if err := s.Populate(); err != nil {
+		return fmt.Errorf("populate: %w", err)
+	}
+	return nil
+}
+
+// Populate writes a fresh file with dirsize entries in key order and atomically renames
+// it into place. Unless durability is off, it is fsynced around the rename.
+func (s *SortedFile) Populate() error {
+	order := s.data.Sorted(s.dirsize)
+	f, err := atomicfile.Create(s.filename, s.mode != durability.None)
+	if err != nil {
+		return fmt.Errorf("create sortedfile: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	if err := s.write(w, order); err != nil {
+		f.Abort()
+		return fmt.Errorf("write sortedfile: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		f.Abort()
+		return fmt.Errorf("write sortedfile: %w", err)
+	}
+	if err := f.Commit(); err != nil {
+		f.Abort()
+		return fmt.Errorf("publish: %w", err)
+	}
+	return f.Close()
+}
+
+// write writes the header, the offset table and the entries in the given order.
+// bufio.Writer keeps the first write error, the caller's Flush reports it.
+func (s *SortedFile) write(w *bufio.Writer, order []int) error {
+	var buf [8]byte
+	w.WriteString(magic)
+	binary.LittleEndian.PutUint64(buf[:], uint64(len(order)))
+	w.Write(buf[:])
+	return offsettable.Wide.Write(w, s.data, order)
+}
+
+// Delete removes the file.
+func (s *SortedFile) Delete() error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	return os.Remove(s.filename)
+}
+
+// Close unmaps the file. Slices returned by Get are invalid afterwards.
+func (s *SortedFile) Close() error {
+	if s.mapped != nil {
+		err := unix.Munmap(s.mapped)
+		s.mapped, s.table = nil, offsettable.Table{}
+		return err
+	}
+	return nil
+}
+
+// Get binary-searches for key and returns its value without copying, or nil if the key
+// doesn't exist. The value points into the mapping and is only valid until Close.
+func (s *SortedFile) Get(key []byte) ([]byte, error) {
+	if s.mapped == nil {
+		return nil, fmt.Errorf("database is not open")
+	}
+	return s.table.Get(key)
+}
+
+// Next returns the keys in sorted order, straight from the file.
+func (s *SortedFile) Next() (string, bool, error) {
+	if s.mapped == nil {
+		return "", false, fmt.Errorf("database is not open")
+	}
+	if s.current >= s.table.Len() {
+		return "", false, nil
+	}
+	key, _, err := s.table.Entry(s.current)
+	if err != nil {
+		return "", false, err
+	}
+	s.current++
+	return string(key), true, nil
+}
+
+// PrefixScan returns the keys starting with prefix in key order, binary-searching for the
+// first one and reading on from there.
+func (s *SortedFile) PrefixScan(prefix string) ([]string, error) {
+	if s.mapped == nil {
+		return nil, fmt.Errorf("database is not open")
+	}
+	return s.table.PrefixScan(prefix)
+}
+
+// ReadPage returns up to limit keys after cursor in key order, and the cursor of the next
+// page, which is the last key returned. The next cursor is empty after the last page.
+func (s *SortedFile) ReadPage(cursor string, limit int) ([]string, string, error) {
+	if s.mapped == nil {
+		return nil, "", fmt.Errorf("database is not open")
+	}
+	return s.table.ReadPage(cursor, limit)
+}
+
+// Lookup retrieves the content of the entry at the given index.
+func (s *SortedFile) Lookup(index int, valid bool) (string, error) {
+	if index < 0 || index >= s.dirsize {
+		return "", fmt.Errorf("index out of bounds")
+	}
+	var filename string
+	switch valid {
+	case true:
+		filename = keyset.GenerateKey(index)
+	case false:
+		filename = keyset.GenerateInvalidKey(index)
+	}
+	val, err := s.Get([]byte(filename))
+	if err != nil {
+		return "", fmt.Errorf("get: %w", err)
+	}
+	if val == nil {
+		return "", fmt.Errorf("no row found")
+	}
+	return string(val), nil
+}
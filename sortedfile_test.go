@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/perbu/db-shootout/keyset"
+	"github.com/perbu/db-shootout/sortedfile"
+)
+
+func BenchmarkCreateFolderSortedFile(b *testing.B) {
+	db := sortedfile.New(filepath.Join(b.TempDir(), "test.sorted"), dirsize, sortedfile.WithDataset(dataset))
+	for i := 0; i < b.N; i++ {
+		if err := db.CreateFolder(); err != nil {
+			b.Fatalf("create folder: %v", err)
+		}
+		if err := db.Delete(); err != nil {
+			b.Fatalf("delete: %v", err)
+		}
+	}
+}
+
+func BenchmarkLookupSortedFile(b *testing.B) {
+	db := sortedfile.New(filepath.Join(b.TempDir(), "test.sorted"), dirsize, sortedfile.WithDataset(dataset))
+	if err := db.CreateFolder(); err != nil {
+		b.Fatalf("create folder: %v", err)
+	}
+	if err := db.OpenReadOnly(); err != nil {
+		b.Fatalf("open readonly: %v", err)
+	}
+	defer db.Delete()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Lookup(rand.Intn(dirsize), true); err != nil {
+			b.Fatalf("lookup valid: %v", err)
+		}
+	}
+	b.StopTimer()
+}
+
+// BenchmarkReaddirSortedFile reads one entry per iteration, like BenchmarkReaddirCDB64.
+func BenchmarkReaddirSortedFile(b *testing.B) {
+	db := sortedfile.New(filepath.Join(b.TempDir(), "test.sorted"), dirsize, sortedfile.WithDataset(dataset))
+	if err := db.CreateFolder(); err != nil {
+		b.Fatalf("create folder: %v", err)
+	}
+	if err := db.OpenReadOnly(); err != nil {
+		b.Fatalf("open readonly: %v", err)
+	}
+	defer db.Delete()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%dirsize == 0 {
+			b.StopTimer()
+			db.Close()
+			if err := db.OpenReadOnly(); err != nil {
+				b.Fatalf("open readonly: %v", err)
+			}
+			b.StartTimer()
+		}
+		if _, _, err := db.Next(); err != nil {
+			b.Fatalf("next: %v", err)
+		}
+	}
+}
+
+// checkEntries creates db over the first size entries of data and opens it, then checks
+// that every key is found with its value, that invalid keys are not, and that Next lists
+// every key once, in key order if sorted is set. It leaves db open.
+func checkEntries(t *testing.T, db BenchmarkDB, data *keyset.Dataset, size int, sorted bool) {
+	t.Helper()
+	if err := db.CreateFolder(); err != nil {
+		t.Fatalf("create folder: %v", err)
+	}
+	if err := db.OpenReadOnly(); err != nil {
+		t.Fatalf("open readonly: %v", err)
+	}
+	for i := 0; i < size; i++ {
+		if value, err := db.Lookup(i, true); err != nil || value != data.Value(i) {
+			t.Fatalf("lookup %d got %q, %v, want %q", i, value, err, data.Value(i))
+		}
+		if _, err := db.Lookup(i, false); err == nil {
+			t.Fatalf("lookup of invalid key %d succeeded", i)
+		}
+	}
+	seen := make(map[string]bool)
+	prev := ""
+	for {
+		key, ok, err := db.Next()
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		if !ok {
+			break
+		}
+		if seen[key] {
+			t.Fatalf("next returned %q twice", key)
+		}
+		if sorted && len(seen) > 0 && key <= prev {
+			t.Fatalf("key %q listed after %q", key, prev)
+		}
+		seen[key], prev = true, key
+	}
+	if len(seen) != size {
+		t.Fatalf("listed %d entries, want %d", len(seen), size)
+	}
+}
+
+// TestSortedFile checks the entries, and that a truncated file is rejected on open.
+func TestSortedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sorted")
+	db := sortedfile.New(path, dirsize, sortedfile.WithDataset(dataset))
+	checkEntries(t, db, dataset, dirsize, true)
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if err := os.Truncate(path, info.Size()-1); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	if err := db.OpenReadOnly(); err == nil {
+		db.Close()
+		t.Fatalf("opened a truncated file")
+	}
+}
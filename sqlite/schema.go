@@ -0,0 +1,126 @@
+package sqlite
+
+import (
+	"fmt"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Schema selects how the folder table is laid out.
+type Schema int
+
+const (
+	// SchemaIndexed is a plain table with a separate, non-unique index on key,
+	// so every key is stored twice. This is the default.
+	SchemaIndexed Schema = iota
+	// SchemaCovering indexes (key, content), so lookups are answered from the index alone.
+	SchemaCovering
+	// SchemaPrimaryKey makes key the primary key of a rowid table, which still keeps a
+	// separate unique index next to the table.
+	SchemaPrimaryKey
+	// SchemaWithoutRowid stores the rows in a b-tree keyed on key itself.
+	SchemaWithoutRowid
+	// SchemaBlob is SchemaWithoutRowid with the content stored as a BLOB.
+	SchemaBlob
+)
+
+// Schemas lists every schema variant, for benchmarks.
+var Schemas = []Schema{SchemaIndexed, SchemaCovering, SchemaPrimaryKey, SchemaWithoutRowid, SchemaBlob}
+
+func (s Schema) String() string {
+	switch s {
+	case SchemaIndexed:
+		return "indexed"
+	case SchemaCovering:
+		return "covering"
+	case SchemaPrimaryKey:
+		return "primary-key"
+	case SchemaWithoutRowid:
+		return "without-rowid"
+	case SchemaBlob:
+		return "blob"
+	default:
+		return fmt.Sprintf("schema(%d)", int(s))
+	}
+}
+
+// table returns the statement creating the folder table.
+func (s Schema) table() string {
+	switch s {
+	case SchemaPrimaryKey:
+		return "CREATE TABLE IF NOT EXISTS folder (key TEXT PRIMARY KEY, content TEXT)"
+	case SchemaWithoutRowid:
+		return "CREATE TABLE IF NOT EXISTS folder (key TEXT PRIMARY KEY, content TEXT) WITHOUT ROWID"
+	case SchemaBlob:
+		return "CREATE TABLE IF NOT EXISTS folder (key TEXT PRIMARY KEY, content BLOB) WITHOUT ROWID"
+	default:
+		return "CREATE TABLE IF NOT EXISTS folder (key TEXT, content TEXT)"
+	}
+}
+
+// index returns the statement creating the secondary index, or "" if the schema has none.
+func (s Schema) index() string {
+	switch s {
+	case SchemaIndexed:
+		return "CREATE INDEX IF NOT EXISTS folder_key ON folder (key)"
+	case SchemaCovering:
+		return "CREATE INDEX IF NOT EXISTS folder_key ON folder (key, content)"
+	default:
+		return ""
+	}
+}
+
+// unique reports whether the schema enforces one row per key.
+func (s Schema) unique() bool {
+	return s == SchemaPrimaryKey || s == SchemaWithoutRowid || s == SchemaBlob
+}
+
+// Profile is a set of pragmas applied to every connection. Zero fields keep SQLite's defaults.
+type Profile struct {
+	Name        string
+	JournalMode string // e.g. "WAL", persistent once set
+	Synchronous string // overrides the level picked by the durability mode
+	MmapSize    int64  // bytes of the file to memory-map
+	PageSize    int    // bytes, only takes effect when the database is created
+	CacheSize   int    // pages, or KiB when negative
+}
+
+var (
+	// ProfileDefault leaves everything at SQLite's defaults: rollback journal, 4 KiB pages,
+	// a 2 MiB cache and no mmap.
+	ProfileDefault = Profile{Name: "default"}
+	// ProfileWAL switches to write-ahead logging, which only needs synchronous=NORMAL to stay consistent.
+	ProfileWAL = Profile{Name: "wal", JournalMode: "WAL", Synchronous: "NORMAL"}
+	// ProfileMmap is ProfileWAL reading through a memory map with a 64 MiB cache.
+	ProfileMmap = Profile{Name: "mmap", JournalMode: "WAL", Synchronous: "NORMAL", MmapSize: 256 << 20, CacheSize: -64 << 10}
+	// ProfileLargePage is ProfileMmap with 16 KiB pages, for shallower b-trees.
+	ProfileLargePage = Profile{Name: "large-page", JournalMode: "WAL", Synchronous: "NORMAL", MmapSize: 256 << 20, CacheSize: -64 << 10, PageSize: 16 << 10}
+
+	// Profiles lists the predefined profiles, for benchmarks.
+	Profiles = []Profile{ProfileDefault, ProfileWAL, ProfileMmap, ProfileLargePage}
+)
+
+// apply sets the connection-level pragmas of the profile. The file-level ones, page_size
+// and journal_mode, are only set on writable connections.
+func (p Profile) apply(conn *sqlite.Conn, writable bool) error {
+	var pragmas []string
+	if writable && p.PageSize != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA page_size = %d", p.PageSize))
+	}
+	if writable && p.JournalMode != "" {
+		pragmas = append(pragmas, "PRAGMA journal_mode = "+p.JournalMode)
+	}
+	if p.MmapSize != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA mmap_size = %d", p.MmapSize))
+	}
+	if p.CacheSize != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA cache_size = %d", p.CacheSize))
+	}
+	for _, pragma := range pragmas {
+		if err := sqlitex.Execute(conn, pragma, nil); err != nil {
+			return fmt.Errorf("%s: %w", pragma, err)
+		}
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package sqlite
 
 import (
 	"fmt"
+	"github.com/perbu/db-shootout/durability"
 	"github.com/perbu/db-shootout/keyset"
 	"os"
 	"zombiezen.com/go/sqlite"
@@ -14,22 +15,79 @@ type SQLiteDB struct {
 	dirsize    int
 	selectStmt *sqlite.Stmt
 	filename   string
+	mode       durability.Mode
+	data       *keyset.Dataset
+	bulk       bool
+	schema     Schema
+	profile    Profile
 }
 
-func New(filename string, dirsize int) *SQLiteDB {
-	return &SQLiteDB{
+// Option configures a SQLiteDB.
+type Option func(*SQLiteDB)
+
+// WithDurability selects the synchronous pragma and how inserts are grouped into transactions.
+func WithDurability(mode durability.Mode) Option {
+	return func(b *SQLiteDB) {
+		b.mode = mode
+	}
+}
+
+// WithDataset populates the store from a pre-generated dataset instead of generating
+// entries while writing.
+func WithDataset(data *keyset.Dataset) Option {
+	return func(b *SQLiteDB) {
+		b.data = data
+	}
+}
+
+// WithBulkLoad makes CreateFolder insert in key order into a bare table and build the
+// key index afterwards, in one transaction even with per-op durability.
+func WithBulkLoad() Option {
+	return func(b *SQLiteDB) {
+		b.bulk = true
+	}
+}
+
+// WithSchema selects the layout of the folder table.
+func WithSchema(schema Schema) Option {
+	return func(b *SQLiteDB) {
+		b.schema = schema
+	}
+}
+
+// WithProfile applies the pragmas of profile to every connection.
+func WithProfile(profile Profile) Option {
+	return func(b *SQLiteDB) {
+		b.profile = profile
+	}
+}
+
+func New(filename string, dirsize int, opts ...Option) *SQLiteDB {
+	b := &SQLiteDB{
 		filename: filename,
 		dirsize:  dirsize,
 	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
 }
 
-// OpenReadOnly prepares the database for operations.
-func (b *SQLiteDB) OpenReadOnly() error {
-	var err error
+// OpenReadOnly prepares the database for operations. The connection is closed again if
+// that fails.
+func (b *SQLiteDB) OpenReadOnly() (err error) {
 	b.db, err = sqlite.OpenConn(b.filename, sqlite.OpenReadOnly)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err != nil {
+			_ = b.Close()
+		}
+	}()
+	if err := b.profile.apply(b.db, false); err != nil {
+		return fmt.Errorf("pragma: %w", err)
+	}
 	b.selectStmt, err = b.db.Prepare("SELECT content FROM folder WHERE key = ?")
 	if err != nil {
 		return fmt.Errorf("prepare: %w", err)
@@ -38,34 +96,132 @@ func (b *SQLiteDB) OpenReadOnly() error {
 	return nil
 }
 
-// CreateFolder creates a virtual folder database with the given number of entries.
-func (b *SQLiteDB) CreateFolder() error {
-	var err error
+// openWritable opens the database for writing and makes sure the schema exists.
+// The key index is left out when index is false. The connection is closed again if
+// any of that fails.
+func (b *SQLiteDB) openWritable(index bool) (err error) {
 	b.db, err = sqlite.OpenConn(b.filename, sqlite.OpenCreate|sqlite.OpenReadWrite)
 	if err != nil {
 		return err
 	}
-	if err := sqlitex.Execute(b.db, "CREATE TABLE IF NOT EXISTS folder (key TEXT, content TEXT)", nil); err != nil {
+	defer func() {
+		if err != nil {
+			_ = b.db.Close()
+			b.db = nil
+		}
+	}()
+	// page_size has to be set before the table is created
+	if err := b.profile.apply(b.db, true); err != nil {
+		return fmt.Errorf("pragma: %w", err)
+	}
+	synchronous := "FULL"
+	if b.mode == durability.None {
+		synchronous = "OFF"
+	}
+	if b.profile.Synchronous != "" {
+		synchronous = b.profile.Synchronous
+	}
+	if err := sqlitex.Execute(b.db, "PRAGMA synchronous = "+synchronous, nil); err != nil {
+		return fmt.Errorf("pragma: %w", err)
+	}
+	if err := sqlitex.Execute(b.db, b.schema.table(), nil); err != nil {
 		return fmt.Errorf("create table: %w", err)
 	}
-	// create an index on the key column for faster lookups
-	if err := sqlitex.Execute(b.db, "CREATE INDEX IF NOT EXISTS folder_key ON folder (key)", nil); err != nil {
+	if index {
+		return b.createIndex()
+	}
+	return nil
+}
+
+// createIndex creates an index on the key column for faster lookups, unless the
+// schema's primary key already serves as one.
+func (b *SQLiteDB) createIndex() error {
+	index := b.schema.index()
+	if index == "" {
+		return nil
+	}
+	if err := sqlitex.Execute(b.db, index, nil); err != nil {
 		return fmt.Errorf("create index: %w", err)
 	}
+	return nil
+}
+
+// CreateFolder creates a virtual folder database with the given number of entries.
+func (b *SQLiteDB) CreateFolder() error {
+	if err := b.openWritable(!b.bulk); err != nil {
+		return err
+	}
 	if err := b.Populate(); err != nil {
+		_ = b.Close()
 		return fmt.Errorf("populate: %w", err)
 	}
+	if b.bulk {
+		// building the index in one go beats updating it for every row
+		if err := b.createIndex(); err != nil {
+			_ = b.Close()
+			return err
+		}
+	}
 	// done. close the database
-	if err := b.db.Close(); err != nil {
+	err := b.db.Close()
+	b.db = nil
+	if err != nil {
 		return fmt.Errorf("close: %w", err)
 	}
 	return nil
 }
 
+// OpenReadWrite opens (or creates) the database for incremental updates via Put.
+func (b *SQLiteDB) OpenReadWrite() error {
+	return b.openWritable(true)
+}
+
+// Put replaces the content of the given key in its own transaction.
+// Unless the schema makes the key unique, we delete any existing row first.
+func (b *SQLiteDB) Put(key, value string) (err error) {
+	if b.db == nil {
+		return fmt.Errorf("database is not open")
+	}
+	if b.schema.unique() {
+		if err := sqlitex.Execute(b.db, "INSERT OR REPLACE INTO folder (key, content) VALUES (?, ?)", &sqlitex.ExecOptions{
+			Args: []any{key, b.content(value)},
+		}); err != nil {
+			return fmt.Errorf("insert: %w", err)
+		}
+		return nil
+	}
+	defer sqlitex.Save(b.db)(&err)
+	if err := sqlitex.Execute(b.db, "DELETE FROM folder WHERE key = ?", &sqlitex.ExecOptions{
+		Args: []any{key},
+	}); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	if err := sqlitex.Execute(b.db, "INSERT INTO folder (key, content) VALUES (?, ?)", &sqlitex.ExecOptions{
+		Args: []any{key, b.content(value)},
+	}); err != nil {
+		return fmt.Errorf("insert: %w", err)
+	}
+	return nil
+}
+
 func (b *SQLiteDB) Delete() error {
+	// a WAL database normally removes these on close, but not after a crash
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(b.filename + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	return os.Remove(b.filename)
 }
 
+// content converts a value to what the schema stores in the content column.
+func (b *SQLiteDB) content(value string) any {
+	if b.schema == SchemaBlob {
+		return []byte(value)
+	}
+	return value
+}
+
 // Close closes the database connection.
 func (b *SQLiteDB) Close() error {
 	if b.selectStmt != nil {
@@ -73,7 +229,9 @@ func (b *SQLiteDB) Close() error {
 		b.selectStmt = nil
 	}
 	if b.db != nil {
-		return b.db.Close()
+		err := b.db.Close()
+		b.db = nil
+		return err
 	}
 	return nil
 }
@@ -81,15 +239,31 @@ func (b *SQLiteDB) Close() error {
 // Populate generates n random entries resembling filenames and 64-byte random content.
 func (b *SQLiteDB) Populate() error {
 	insert := b.db.Prep("INSERT INTO folder (key, content) VALUES (?, ?)")
-	// start a transaction:
-	txFunc := sqlitex.Transaction(b.db)
+	// start a transaction, unless every insert should commit on its own:
+	txFunc := func(*error) {}
+	if b.mode != durability.PerOp || b.bulk {
+		txFunc = sqlitex.Transaction(b.db)
+	}
+	// a bulk load appends to the key b-tree in order
+	var sorted []int
+	if b.bulk {
+		sorted = b.data.Sorted(b.dirsize)
+	}
 
 	defer insert.Finalize()
-	for i := 0; i < b.dirsize; i++ {
+	for n := 0; n < b.dirsize; n++ {
+		i := n
+		if sorted != nil {
+			i = sorted[n]
+		}
 		_ = insert.Reset()
 		_ = insert.ClearBindings()
-		insert.BindText(1, keyset.GenerateKey(i))
-		insert.BindText(2, keyset.GenerateRandomContent(64))
+		insert.BindText(1, b.data.Key(i))
+		if b.schema == SchemaBlob {
+			insert.BindBytes(2, b.data.ValueBytes(i))
+		} else {
+			insert.BindText(2, b.data.Value(i))
+		}
 		_, err := insert.Step()
 		if err != nil {
 			txFunc(&err)
@@ -97,8 +271,11 @@ func (b *SQLiteDB) Populate() error {
 		}
 	}
 	b.current = 0
-	var dummy error
-	txFunc(&dummy) // commit
+	var err error
+	txFunc(&err) // commit
+	if err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
 	return nil
 }
 
@@ -112,6 +289,58 @@ func (b *SQLiteDB) Next() (string, bool, error) {
 	return entry, true, nil
 }
 
+// PrefixScan returns the keys starting with prefix in key order, as a range query on the
+// key index.
+func (b *SQLiteDB) PrefixScan(prefix string) ([]string, error) {
+	if b.db == nil {
+		return nil, fmt.Errorf("database is not open")
+	}
+	query, args := "SELECT key FROM folder WHERE key >= ? ORDER BY key", []any{prefix}
+	if end := keyset.PrefixEnd(prefix); end != "" {
+		query, args = "SELECT key FROM folder WHERE key >= ? AND key < ? ORDER BY key", []any{prefix, end}
+	}
+	var keys []string
+	err := sqlitex.Execute(b.db, query, &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			keys = append(keys, stmt.ColumnText(0))
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	return keys, nil
+}
+
+// ReadPage returns up to limit keys after cursor in key order, and the cursor of the next
+// page, which is the last key returned. Each page is a range query on the key index,
+// reading one key more than asked for to tell whether another page follows.
+func (b *SQLiteDB) ReadPage(cursor string, limit int) ([]string, string, error) {
+	if b.db == nil {
+		return nil, "", fmt.Errorf("database is not open")
+	}
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	keys := make([]string, 0, limit+1)
+	err := sqlitex.Execute(b.db, "SELECT key FROM folder WHERE key > ? ORDER BY key LIMIT ?", &sqlitex.ExecOptions{
+		Args: []any{cursor, limit + 1},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			keys = append(keys, stmt.ColumnText(0))
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("query: %w", err)
+	}
+	if len(keys) <= limit {
+		return keys, "", nil
+	}
+	keys = keys[:limit]
+	return keys, keys[limit-1], nil
+}
+
 // LookupValid retrieves the content of the entry at the given index.
 // We use a number between 0 and dirsize to generate a key. This should always succeed.
 func (b *SQLiteDB) Lookup(index int, valid bool) (string, error) {
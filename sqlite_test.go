@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/perbu/db-shootout/sqlite"
+)
+
+// BenchmarkLookupSqliteSchema looks up valid keys for every schema variant and pragma profile.
+func BenchmarkLookupSqliteSchema(b *testing.B) {
+	for _, schema := range sqlite.Schemas {
+		for _, profile := range sqlite.Profiles {
+			b.Run(fmt.Sprintf("%s/%s", schema, profile.Name), func(b *testing.B) {
+				db := sqlite.New(filepath.Join(b.TempDir(), "test.db"), dirsize,
+					sqlite.WithSchema(schema), sqlite.WithProfile(profile), sqlite.WithDataset(dataset))
+				if err := db.CreateFolder(); err != nil {
+					b.Fatalf("create folder: %v", err)
+				}
+				if err := db.OpenReadOnly(); err != nil {
+					b.Fatalf("open readonly: %v", err)
+				}
+				defer db.Close()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := db.Lookup(rand.Intn(dirsize), true); err != nil {
+						b.Fatalf("lookup valid: %v", err)
+					}
+				}
+				b.StopTimer()
+			})
+		}
+	}
+}
+
+// BenchmarkCreateFolderSqliteSchema populates every schema variant under every pragma profile.
+func BenchmarkCreateFolderSqliteSchema(b *testing.B) {
+	for _, schema := range sqlite.Schemas {
+		for _, profile := range sqlite.Profiles {
+			b.Run(fmt.Sprintf("%s/%s", schema, profile.Name), func(b *testing.B) {
+				db := sqlite.New(filepath.Join(b.TempDir(), "test.db"), dirsize,
+					sqlite.WithSchema(schema), sqlite.WithProfile(profile), sqlite.WithDataset(dataset))
+				for i := 0; i < b.N; i++ {
+					if err := db.CreateFolder(); err != nil {
+						b.Fatalf("create folder: %v", err)
+					}
+					if err := db.Delete(); err != nil {
+						b.Fatalf("delete: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestSqliteSchemas checks lookups and replacing Puts for every schema and profile.
+func TestSqliteSchemas(t *testing.T) {
+	for _, schema := range sqlite.Schemas {
+		for _, profile := range sqlite.Profiles {
+			t.Run(fmt.Sprintf("%s/%s", schema, profile.Name), func(t *testing.T) {
+				db := sqlite.New(filepath.Join(t.TempDir(), "test.db"), dirsize,
+					sqlite.WithSchema(schema), sqlite.WithProfile(profile), sqlite.WithDataset(dataset))
+				if err := db.CreateFolder(); err != nil {
+					t.Fatalf("create folder: %v", err)
+				}
+				if err := db.OpenReadWrite(); err != nil {
+					t.Fatalf("open read-write: %v", err)
+				}
+				key := dataset.Key(7)
+				for _, value := range []string{"first", "second"} {
+					if err := db.Put(key, value); err != nil {
+						t.Fatalf("put: %v", err)
+					}
+				}
+				if err := db.Close(); err != nil {
+					t.Fatalf("close: %v", err)
+				}
+				if err := db.OpenReadOnly(); err != nil {
+					t.Fatalf("open readonly: %v", err)
+				}
+				defer db.Close()
+				for _, i := range []int{0, 7, dirsize - 1} {
+					want := dataset.Value(i)
+					if i == 7 {
+						want = "second"
+					}
+					value, err := db.Lookup(i, true)
+					if err != nil {
+						t.Fatalf("lookup %d: %v", i, err)
+					}
+					if value != want {
+						t.Fatalf("index %d holds %q, want %q", i, value, want)
+					}
+				}
+				if _, err := db.Lookup(7, false); err == nil {
+					t.Fatalf("lookup of an invalid key succeeded")
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// Package sqlitesql stores the folder in SQLite through database/sql and the
+// modernc.org/sqlite driver, the way application code usually talks to SQLite. It uses
+// the same schema as package sqlite, so the two measure the cost of database/sql.
+package sqlitesql
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/perbu/db-shootout/keyset"
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+type SQLDB struct {
+	db         *sql.DB
+	current    int
+	dirsize    int
+	selectStmt *sql.Stmt
+	filename   string
+	conns      int
+	data       *keyset.Dataset
+}
+
+// Option configures a SQLDB.
+type Option func(*SQLDB)
+
+// WithMaxConns sets the size of the connection pool used by read-only handles.
+// The default of 0 leaves it to database/sql, which grows the pool on demand.
+func WithMaxConns(n int) Option {
+	return func(b *SQLDB) {
+		b.conns = n
+	}
+}
+
+// WithDataset populates the store from a pre-generated dataset instead of generating
+// entries while writing.
+func WithDataset(data *keyset.Dataset) Option {
+	return func(b *SQLDB) {
+		b.data = data
+	}
+}
+
+func New(filename string, dirsize int, opts ...Option) *SQLDB {
+	b := &SQLDB{
+		filename: filename,
+		dirsize:  dirsize,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// OpenReadOnly opens a pool of read-only connections and prepares the lookup statement.
+func (b *SQLDB) OpenReadOnly() error {
+	db, err := sql.Open("sqlite", "file:"+b.filename+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	if b.conns > 0 {
+		db.SetMaxOpenConns(b.conns)
+		db.SetMaxIdleConns(b.conns)
+	}
+	// sql.Open is lazy, so this is where a missing file shows up
+	b.selectStmt, err = db.Prepare("SELECT content FROM folder WHERE key = ?")
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("prepare: %w", err)
+	}
+	b.db = db
+	b.current = 0
+	return nil
+}
+
+// CreateFolder creates a virtual folder database with the given number of entries.
+func (b *SQLDB) CreateFolder() error {
+	db, err := sql.Open("sqlite", "file:"+b.filename)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	// writes go through a single connection anyway
+	db.SetMaxOpenConns(1)
+	b.db = db
+	for _, stmt := range []string{
+		"CREATE TABLE IF NOT EXISTS folder (key TEXT, content TEXT)",
+		"CREATE INDEX IF NOT EXISTS folder_key ON folder (key)",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			b.Close()
+			return fmt.Errorf("create schema: %w", err)
+		}
+	}
+	if err := b.Populate(); err != nil {
+		b.Close()
+		return fmt.Errorf("populate: %w", err)
+	}
+	if err := b.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+	return nil
+}
+
+// Populate inserts dirsize entries with a prepared statement in a single transaction.
+func (b *SQLDB) Populate() error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	insert, err := tx.Prepare("INSERT INTO folder (key, content) VALUES (?, ?)")
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("prepare: %w", err)
+	}
+	defer insert.Close()
+	for i := 0; i < b.dirsize; i++ {
+		if _, err := insert.Exec(b.data.Key(i), b.data.Value(i)); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("insert: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	b.current = 0
+	return nil
+}
+
+func (b *SQLDB) Delete() error {
+	return os.Remove(b.filename)
+}
+
+// Close closes the prepared statement and every pooled connection.
+func (b *SQLDB) Close() error {
+	if b.selectStmt != nil {
+		_ = b.selectStmt.Close()
+		b.selectStmt = nil
+	}
+	if b.db != nil {
+		err := b.db.Close()
+		b.db = nil
+		return err
+	}
+	return nil
+}
+
+// Next iterates over all the entries in order. Used by ReadDir()
+func (b *SQLDB) Next() (string, bool, error) {
+	if b.current >= b.dirsize {
+		return "", false, nil
+	}
+	entry := keyset.GenerateKey(b.current)
+	b.current++
+	return entry, true, nil
+}
+
+// PrefixScan returns the keys starting with prefix in key order, as a range query on the
+// key index.
+func (b *SQLDB) PrefixScan(prefix string) ([]string, error) {
+	if b.db == nil {
+		return nil, fmt.Errorf("database is not open")
+	}
+	query, args := "SELECT key FROM folder WHERE key >= ? ORDER BY key", []any{prefix}
+	if end := keyset.PrefixEnd(prefix); end != "" {
+		query, args = "SELECT key FROM folder WHERE key >= ? AND key < ? ORDER BY key", []any{prefix, end}
+	}
+	rows, err := b.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	return keys, nil
+}
+
+// ReadPage returns up to limit keys after cursor in key order, and the cursor of the next
+// page, which is the last key returned. Each page is a range query on the key index,
+// reading one key more than asked for to tell whether another page follows.
+func (b *SQLDB) ReadPage(cursor string, limit int) ([]string, string, error) {
+	if b.db == nil {
+		return nil, "", fmt.Errorf("database is not open")
+	}
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	rows, err := b.db.Query("SELECT key FROM folder WHERE key > ? ORDER BY key LIMIT ?", cursor, limit+1)
+	if err != nil {
+		return nil, "", fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+	keys := make([]string, 0, limit+1)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, "", fmt.Errorf("scan: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("query: %w", err)
+	}
+	if len(keys) <= limit {
+		return keys, "", nil
+	}
+	keys = keys[:limit]
+	return keys, keys[limit-1], nil
+}
+
+// Lookup retrieves the content of the entry at the given index. It is safe for
+// concurrent use, every call borrows a connection from the pool.
+func (b *SQLDB) Lookup(index int, valid bool) (string, error) {
+	if b.selectStmt == nil {
+		return "", fmt.Errorf("database is not open")
+	}
+	if index < 0 || index >= b.dirsize {
+		return "", fmt.Errorf("index out of bounds")
+	}
+	var filename string
+	switch valid {
+	case true:
+		filename = keyset.GenerateKey(index)
+	case false:
+		filename = keyset.GenerateInvalidKey(index)
+	}
+	var content string
+	err := b.selectStmt.QueryRow(filename).Scan(&content)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("no row found")
+	}
+	if err != nil {
+		return "", fmt.Errorf("query: %w", err)
+	}
+	return content, nil
+}
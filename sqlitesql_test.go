@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/perbu/db-shootout/sqlite"
+	"github.com/perbu/db-shootout/sqlitesql"
+)
+
+// lookuper is the read side of a backend.
+type lookuper interface {
+	CreateFolder() error
+	OpenReadOnly() error
+	Close() error
+	Lookup(index int, valid bool) (string, error)
+}
+
+// sqliteAPIs are the same schema behind the low-level conn API and behind database/sql.
+var sqliteAPIs = []struct {
+	name string
+	new  func(path string) lookuper
+}{
+	{"conn", func(path string) lookuper { return sqlite.New(path, dirsize, sqlite.WithDataset(dataset)) }},
+	{"database-sql", func(path string) lookuper { return sqlitesql.New(path, dirsize, sqlitesql.WithDataset(dataset)) }},
+}
+
+func BenchmarkCreateFolderSqliteSQL(b *testing.B) {
+	db := sqlitesql.New("test.db", dirsize, sqlitesql.WithDataset(dataset))
+	for i := 0; i < b.N; i++ {
+		if err := db.CreateFolder(); err != nil {
+			b.Fatalf("create folder: %v", err)
+		}
+		if err := db.Delete(); err != nil {
+			b.Fatalf("delete: %v", err)
+		}
+	}
+}
+
+// BenchmarkLookupSqliteAPI measures what database/sql adds to a lookup.
+func BenchmarkLookupSqliteAPI(b *testing.B) {
+	for _, api := range sqliteAPIs {
+		b.Run(api.name, func(b *testing.B) {
+			db := api.new(filepath.Join(b.TempDir(), "test.db"))
+			if err := db.CreateFolder(); err != nil {
+				b.Fatalf("create folder: %v", err)
+			}
+			if err := db.OpenReadOnly(); err != nil {
+				b.Fatalf("open readonly: %v", err)
+			}
+			defer db.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Lookup(rand.Intn(dirsize), true); err != nil {
+					b.Fatalf("lookup valid: %v", err)
+				}
+			}
+			b.StopTimer()
+		})
+	}
+}
+
+// BenchmarkLookupSqliteSQLParallel runs lookups from all CPUs through pools of different sizes.
+func BenchmarkLookupSqliteSQLParallel(b *testing.B) {
+	for _, conns := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("conns-%d", conns), func(b *testing.B) {
+			db := sqlitesql.New(filepath.Join(b.TempDir(), "test.db"), dirsize,
+				sqlitesql.WithDataset(dataset), sqlitesql.WithMaxConns(conns))
+			if err := db.CreateFolder(); err != nil {
+				b.Fatalf("create folder: %v", err)
+			}
+			if err := db.OpenReadOnly(); err != nil {
+				b.Fatalf("open readonly: %v", err)
+			}
+			defer db.Close()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := db.Lookup(rand.Intn(dirsize), true); err != nil {
+						b.Errorf("lookup valid: %v", err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+		})
+	}
+}
+
+// TestSqliteSQL checks that the database/sql backend reads back what the conn backend does.
+func TestSqliteSQL(t *testing.T) {
+	for _, api := range sqliteAPIs {
+		t.Run(api.name, func(t *testing.T) {
+			db := api.new(filepath.Join(t.TempDir(), "test.db"))
+			if err := db.CreateFolder(); err != nil {
+				t.Fatalf("create folder: %v", err)
+			}
+			if err := db.OpenReadOnly(); err != nil {
+				t.Fatalf("open readonly: %v", err)
+			}
+			defer db.Close()
+			for _, i := range []int{0, dirsize / 2, dirsize - 1} {
+				value, err := db.Lookup(i, true)
+				if err != nil {
+					t.Fatalf("lookup %d: %v", i, err)
+				}
+				if value != dataset.Value(i) {
+					t.Fatalf("index %d holds %q, want %q", i, value, dataset.Value(i))
+				}
+			}
+			if _, err := db.Lookup(0, false); err == nil {
+				t.Fatalf("lookup of an invalid key succeeded")
+			}
+		})
+	}
+	if err := sqlitesql.New(filepath.Join(t.TempDir(), "missing.db"), dirsize).OpenReadOnly(); err == nil {
+		t.Fatalf("opening a missing file succeeded")
+	}
+}
@@ -0,0 +1,270 @@
+// Package zblob stores the whole folder as one zstd-compressed blob, the way some
+// metadata stores keep each directory as a single value. Open decompresses the blob in
+// full. The blob carries a sorted index, so lookups binary-search the decompressed bytes
+// without building a map.
+//
+// The file is the magic, the uncompressed size as a uvarint and the zstd frame. The
+// uncompressed blob is at most 4 GiB and little-endian:
+//
+//	count   uint32           number of entries
+//	offsets [count+1]uint32  start of every entry relative to the first, and the end of the last
+//	entries                  uint16 key length, key, value, in key order
+package zblob
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/perbu/db-shootout/atomicfile"
+	"github.com/perbu/db-shootout/durability"
+	"github.com/perbu/db-shootout/internal/offsettable"
+	"github.com/perbu/db-shootout/keyset"
+)
+
+const (
+	magic = "zblob01\n"
+	// maxBlob is the largest uncompressed blob, which keeps every offset within a uint32.
+	maxBlob = math.MaxUint32
+)
+
+// decoder is shared by every handle, DecodeAll is safe for concurrent use. It refuses to
+// decompress more than a blob can hold, whatever size the frame claims.
+var decoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxBlob))
+
+// ZBlob implements the BenchmarkDB interface on top of a compressed blob.
+type ZBlob struct {
+	filename string
+	dirsize  int
+	level    zstd.EncoderLevel
+	mode     durability.Mode
+	data     *keyset.Dataset
+
+	blob    []byte // decompressed, nil when closed
+	table   offsettable.Table
+	current int
+
+	raw, compressed int64 // sizes of the last blob written or opened
+}
+
+// Option configures a ZBlob.
+type Option func(*ZBlob)
+
+// WithLevel sets the zstd level the blob is compressed with.
+func WithLevel(level zstd.EncoderLevel) Option {
+	return func(z *ZBlob) {
+		z.level = level
+	}
+}
+
+// WithDurability selects whether the compressed file is fsynced when it replaces the
+// old one. A blob is only ever rewritten whole, so per-op and per-batch behave alike.
+func WithDurability(mode durability.Mode) Option {
+	return func(z *ZBlob) {
+		z.mode = mode
+	}
+}
+
+// WithDataset populates the blob from a pre-generated dataset instead of generating
+// entries while writing.
+func WithDataset(data *keyset.Dataset) Option {
+	return func(z *ZBlob) {
+		z.data = data
+	}
+}
+
+// New creates a new ZBlob stored in filename.
+func New(filename string, dirsize int, opts ...Option) *ZBlob {
+	z := &ZBlob{
+		filename: filename,
+		dirsize:  dirsize,
+		level:    zstd.SpeedDefault,
+	}
+	for _, opt := range opts {
+		opt(z)
+	}
+	return z
+}
+
+// Sizes returns the uncompressed and compressed size of the last blob written or opened.
+func (z *ZBlob) Sizes() (raw, compressed int64) {
+	return z.raw, z.compressed
+}
+
+// OpenReadOnly reads and decompresses the whole blob.
+func (z *ZBlob) OpenReadOnly() error {
+	file, err := os.ReadFile(z.filename)
+	if err != nil {
+		return fmt.Errorf("open zblob: %w", err)
+	}
+	rest, ok := bytes.CutPrefix(file, []byte(magic))
+	if !ok {
+		return fmt.Errorf("open zblob: not a zblob file")
+	}
+	size, n := binary.Uvarint(rest)
+	if n <= 0 || size > maxBlob {
+		return fmt.Errorf("open zblob: bad size")
+	}
+	// the decoder sizes the blob from the frame header, capped at maxBlob
+	blob, err := decoder.DecodeAll(rest[n:], nil)
+	if err != nil {
+		return fmt.Errorf("decompress: %w", err)
+	}
+	if uint64(len(blob)) != size {
+		return fmt.Errorf("open zblob: decompressed %d bytes, header says %d", len(blob), size)
+	}
+	if err := z.parse(blob); err != nil {
+		return fmt.Errorf("open zblob: %w", err)
+	}
+	z.blob = blob
+	z.raw, z.compressed = int64(len(blob)), int64(len(rest)-n)
+	z.current = 0
+	return nil
+}
+
+// parse points the table into blob.
+func (z *ZBlob) parse(blob []byte) error {
+	if len(blob) < 4 {
+		return fmt.Errorf("blob too short")
+	}
+	count := binary.LittleEndian.Uint32(blob)
+	table, err := offsettable.Narrow.Parse(blob[4:], uint64(count))
+	if err != nil {
+		return err
+	}
+	z.table = table
+	return nil
+}
+
+// CreateFolder writes the blob.
+func (z *ZBlob) CreateFolder() error {
+	if err := z.Populate(); err != nil {
+		return fmt.Errorf("populate: %w", err)
+	}
+	return nil
+}
+
+// Populate serializes dirsize entries in key order, compresses them into a fresh file
+// and atomically renames it into place. Unless durability is off, it is fsynced around
+// the rename.
+func (z *ZBlob) Populate() error {
+	order := z.data.Sorted(z.dirsize)
+	var raw bytes.Buffer
+	w := bufio.NewWriter(&raw)
+	w.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(order))))
+	if err := offsettable.Narrow.Write(w, z.data, order); err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+	// writes to a bytes.Buffer don't fail
+	w.Flush()
+	if raw.Len() > maxBlob {
+		return fmt.Errorf("serialize: blob takes %d bytes, more than %d", raw.Len(), maxBlob)
+	}
+	blob := raw.Bytes()
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(z.level), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return fmt.Errorf("create encoder: %w", err)
+	}
+	file := binary.AppendUvarint([]byte(magic), uint64(len(blob)))
+	header := len(file)
+	file = encoder.EncodeAll(blob, file)
+	encoder.Close()
+	z.raw, z.compressed = int64(len(blob)), int64(len(file)-header)
+
+	f, err := atomicfile.Create(z.filename, z.mode != durability.None)
+	if err != nil {
+		return fmt.Errorf("create zblob: %w", err)
+	}
+	if _, err := f.Write(file); err != nil {
+		f.Abort()
+		return fmt.Errorf("write zblob: %w", err)
+	}
+	if err := f.Commit(); err != nil {
+		f.Abort()
+		return fmt.Errorf("publish: %w", err)
+	}
+	return f.Close()
+}
+
+// Delete removes the file.
+func (z *ZBlob) Delete() error {
+	if err := z.Close(); err != nil {
+		return err
+	}
+	return os.Remove(z.filename)
+}
+
+// Close drops the decompressed blob.
+func (z *ZBlob) Close() error {
+	z.blob, z.table = nil, offsettable.Table{}
+	return nil
+}
+
+// Get binary-searches for key and returns its value without copying, or nil if the key
+// doesn't exist. The value points into the blob and is only valid until Close.
+func (z *ZBlob) Get(key []byte) ([]byte, error) {
+	if z.blob == nil {
+		return nil, fmt.Errorf("database is not open")
+	}
+	return z.table.Get(key)
+}
+
+// Next returns the keys in sorted order.
+func (z *ZBlob) Next() (string, bool, error) {
+	if z.blob == nil {
+		return "", false, fmt.Errorf("database is not open")
+	}
+	if z.current >= z.table.Len() {
+		return "", false, nil
+	}
+	key, _, err := z.table.Entry(z.current)
+	if err != nil {
+		return "", false, err
+	}
+	z.current++
+	return string(key), true, nil
+}
+
+// PrefixScan returns the keys starting with prefix in key order.
+func (z *ZBlob) PrefixScan(prefix string) ([]string, error) {
+	if z.blob == nil {
+		return nil, fmt.Errorf("database is not open")
+	}
+	return z.table.PrefixScan(prefix)
+}
+
+// ReadPage returns up to limit keys after cursor in key order, and the cursor of the next
+// page, which is the last key returned. The next cursor is empty after the last page.
+func (z *ZBlob) ReadPage(cursor string, limit int) ([]string, string, error) {
+	if z.blob == nil {
+		return nil, "", fmt.Errorf("database is not open")
+	}
+	return z.table.ReadPage(cursor, limit)
+}
+
+// Lookup retrieves the content of the entry at the given index.
+func (z *ZBlob) Lookup(index int, valid bool) (string, error) {
+	if index < 0 || index >= z.dirsize {
+		return "", fmt.Errorf("index out of bounds")
+	}
+	var filename string
+	switch valid {
+	case true:
+		filename = keyset.GenerateKey(index)
+	case false:
+		filename = keyset.GenerateInvalidKey(index)
+	}
+	val, err := z.Get([]byte(filename))
+	if err != nil {
+		return "", fmt.Errorf("get: %w", err)
+	}
+	if val == nil {
+		return "", fmt.Errorf("no row found")
+	}
+	return string(val), nil
+}
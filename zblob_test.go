@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	cdbdb64 "github.com/perbu/db-shootout/cdb64"
+	"github.com/perbu/db-shootout/sortedfile"
+	"github.com/perbu/db-shootout/zblob"
+)
+
+// blobBackends compares the compressed blob at a few levels with the uncompressed
+// static files.
+var blobBackends = []struct {
+	name string
+	new  func(path string) BenchmarkDB
+}{
+	{"ZBlob/fastest", func(path string) BenchmarkDB {
+		return zblob.New(path, dirsize, zblob.WithLevel(zstd.SpeedFastest), zblob.WithDataset(dataset))
+	}},
+	{"ZBlob/default", func(path string) BenchmarkDB {
+		return zblob.New(path, dirsize, zblob.WithLevel(zstd.SpeedDefault), zblob.WithDataset(dataset))
+	}},
+	{"ZBlob/best", func(path string) BenchmarkDB {
+		return zblob.New(path, dirsize, zblob.WithLevel(zstd.SpeedBestCompression), zblob.WithDataset(dataset))
+	}},
+	{"SortedFile", func(path string) BenchmarkDB {
+		return sortedfile.New(path, dirsize, sortedfile.WithDataset(dataset))
+	}},
+	{"CDB64", func(path string) BenchmarkDB {
+		return cdbdb64.New(path, dirsize, cdbdb64.WithDataset(dataset))
+	}},
+}
+
+// reportRatio reports the compression ratio of a zblob, uncompressed over compressed size.
+func reportRatio(b *testing.B, db BenchmarkDB) {
+	if db, ok := db.(*zblob.ZBlob); ok {
+		raw, compressed := db.Sizes()
+		b.ReportMetric(float64(raw)/float64(compressed), "ratio")
+	}
+}
+
+// BenchmarkOpenLookupBlob opens the file for every lookup, which is what a blob costs
+// when the directory isn't cached decoded.
+func BenchmarkOpenLookupBlob(b *testing.B) {
+	for _, backend := range blobBackends {
+		b.Run(backend.name, func(b *testing.B) {
+			db := backend.new(filepath.Join(b.TempDir(), "test.db"))
+			if err := db.CreateFolder(); err != nil {
+				b.Fatalf("create folder: %v", err)
+			}
+			defer db.Delete()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := db.OpenReadOnly(); err != nil {
+					b.Fatalf("open readonly: %v", err)
+				}
+				if _, err := db.Lookup(rand.Intn(dirsize), true); err != nil {
+					b.Fatalf("lookup valid: %v", err)
+				}
+				if err := db.Close(); err != nil {
+					b.Fatalf("close: %v", err)
+				}
+			}
+			b.StopTimer()
+			reportRatio(b, db)
+		})
+	}
+}
+
+// BenchmarkOpenReaddirBlob opens the file and lists every entry.
+func BenchmarkOpenReaddirBlob(b *testing.B) {
+	for _, backend := range blobBackends {
+		b.Run(backend.name, func(b *testing.B) {
+			db := backend.new(filepath.Join(b.TempDir(), "test.db"))
+			if err := db.CreateFolder(); err != nil {
+				b.Fatalf("create folder: %v", err)
+			}
+			defer db.Delete()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := db.OpenReadOnly(); err != nil {
+					b.Fatalf("open readonly: %v", err)
+				}
+				for entry := 0; entry < dirsize; entry++ {
+					if _, _, err := db.Next(); err != nil {
+						b.Fatalf("next: %v", err)
+					}
+				}
+				if err := db.Close(); err != nil {
+					b.Fatalf("close: %v", err)
+				}
+			}
+			b.StopTimer()
+			reportRatio(b, db)
+		})
+	}
+}
+
+// TestZBlob checks the entries, that the blob came out smaller than its input, and that
+// a header disagreeing with the frame is rejected on open.
+func TestZBlob(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.zblob")
+	db := zblob.New(path, dirsize, zblob.WithDataset(dataset))
+	defer db.Delete()
+	checkEntries(t, db, dataset, dirsize, true)
+	raw, compressed := db.Sizes()
+	if raw == 0 || compressed == 0 || compressed >= raw {
+		t.Fatalf("raw %d bytes, compressed %d bytes", raw, compressed)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	const magic = "zblob01\n"
+	_, n := binary.Uvarint(file[len(magic):])
+	header := binary.AppendUvarint([]byte(magic), uint64(raw)+1)
+	if err := os.WriteFile(path, append(header, file[len(magic)+n:]...), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := db.OpenReadOnly(); err == nil {
+		t.Fatalf("opened a blob whose header overstates its size")
+	}
+}
@@ -0,0 +1,249 @@
+// Package zipdb stores the folder as a zip archive with one member per entry, the way
+// read-only datasets are often shipped. Opening reads the central directory and indexes
+// it by name; Lookup opens one member and Next lists the members in archive order.
+package zipdb
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/perbu/db-shootout/atomicfile"
+	"github.com/perbu/db-shootout/durability"
+	"github.com/perbu/db-shootout/keyset"
+)
+
+// Method selects how members are stored.
+type Method uint16
+
+const (
+	// Stored keeps members uncompressed. This is the default.
+	Stored = Method(zip.Store)
+	// Deflated compresses every member on its own.
+	Deflated = Method(zip.Deflate)
+)
+
+func (m Method) String() string {
+	switch m {
+	case Stored:
+		return "stored"
+	case Deflated:
+		return "deflated"
+	default:
+		return fmt.Sprintf("method(%d)", uint16(m))
+	}
+}
+
+// ZipDB implements the BenchmarkDB interface on top of a zip archive.
+type ZipDB struct {
+	filename string
+	dirsize  int
+	method   Method
+	mode     durability.Mode
+	data     *keyset.Dataset
+
+	r       *zip.ReadCloser
+	index   map[string]*zip.File // the central directory by name
+	current int
+}
+
+// Option configures a ZipDB.
+type Option func(*ZipDB)
+
+// WithMethod selects how members are stored.
+func WithMethod(method Method) Option {
+	return func(z *ZipDB) {
+		z.method = method
+	}
+}
+
+// WithDurability selects whether the published archive is fsynced. The archive is always
+// written as one batch, so per-op durability is the same as per-batch.
+func WithDurability(mode durability.Mode) Option {
+	return func(z *ZipDB) {
+		z.mode = mode
+	}
+}
+
+// WithDataset populates the archive from a pre-generated dataset instead of generating
+// entries while writing.
+func WithDataset(data *keyset.Dataset) Option {
+	return func(z *ZipDB) {
+		z.data = data
+	}
+}
+
+// New creates a new ZipDB stored in filename.
+func New(filename string, dirsize int, opts ...Option) *ZipDB {
+	z := &ZipDB{
+		filename: filename,
+		dirsize:  dirsize,
+		method:   Stored,
+	}
+	for _, opt := range opts {
+		opt(z)
+	}
+	return z
+}
+
+// OpenReadOnly reads the central directory and indexes it by name.
+func (z *ZipDB) OpenReadOnly() error {
+	r, err := zip.OpenReader(z.filename)
+	if err != nil {
+		return fmt.Errorf("open zip: %w", err)
+	}
+	z.index = make(map[string]*zip.File, len(r.File))
+	for _, f := range r.File {
+		z.index[f.Name] = f
+	}
+	z.r = r
+	z.current = 0
+	return nil
+}
+
+// CreateFolder writes the archive.
+func (z *ZipDB) CreateFolder() error {
+	if err := z.Populate(); err != nil {
+		return fmt.Errorf("populate: %w", err)
+	}
+	return nil
+}
+
+// Populate writes a fresh archive with dirsize members and atomically renames it into
+// place. Unless durability is off, it is fsynced around the rename.
+func (z *ZipDB) Populate() error {
+	f, err := atomicfile.Create(z.filename, z.mode != durability.None)
+	if err != nil {
+		return fmt.Errorf("create zip: %w", err)
+	}
+	if err := z.write(f); err != nil {
+		f.Abort()
+		return fmt.Errorf("write zip: %w", err)
+	}
+	if err := f.Commit(); err != nil {
+		f.Abort()
+		return fmt.Errorf("publish: %w", err)
+	}
+	return f.Close()
+}
+
+// write writes every member and the central directory.
+func (z *ZipDB) write(out io.Writer) error {
+	w := zip.NewWriter(out)
+	for i := 0; i < z.dirsize; i++ {
+		// no modification time, so the archive only depends on the entries
+		member, err := w.CreateHeader(&zip.FileHeader{Name: z.data.Key(i), Method: uint16(z.method)})
+		if err != nil {
+			return fmt.Errorf("create member: %w", err)
+		}
+		if _, err := io.WriteString(member, z.data.Value(i)); err != nil {
+			return fmt.Errorf("write member: %w", err)
+		}
+	}
+	return w.Close()
+}
+
+// Delete removes the archive.
+func (z *ZipDB) Delete() error {
+	if err := z.Close(); err != nil {
+		return err
+	}
+	return os.Remove(z.filename)
+}
+
+// Close closes the archive.
+func (z *ZipDB) Close() error {
+	if z.r != nil {
+		err := z.r.Close()
+		z.r, z.index = nil, nil
+		return err
+	}
+	return nil
+}
+
+// Next returns the member names in archive order, straight from the central directory.
+func (z *ZipDB) Next() (string, bool, error) {
+	if z.r == nil {
+		return "", false, fmt.Errorf("database is not open")
+	}
+	if z.current >= len(z.r.File) {
+		return "", false, nil
+	}
+	name := z.r.File[z.current].Name
+	z.current++
+	return name, true, nil
+}
+
+// PrefixScan returns the member names starting with prefix in archive order, scanning the
+// central directory.
+func (z *ZipDB) PrefixScan(prefix string) ([]string, error) {
+	if z.r == nil {
+		return nil, fmt.Errorf("database is not open")
+	}
+	var names []string
+	for _, f := range z.r.File {
+		if strings.HasPrefix(f.Name, prefix) {
+			names = append(names, f.Name)
+		}
+	}
+	return names, nil
+}
+
+// ReadPage returns up to limit member names after cursor in archive order, and the cursor
+// of the next page. The cursor is a position in the central directory, which is already
+// in memory. The next cursor is empty after the last page.
+func (z *ZipDB) ReadPage(cursor string, limit int) ([]string, string, error) {
+	if z.r == nil {
+		return nil, "", fmt.Errorf("database is not open")
+	}
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	pos, err := keyset.ParsePositionCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	i := int(min(pos, int64(len(z.r.File))))
+	end := min(i+limit, len(z.r.File))
+	keys := make([]string, 0, end-i)
+	for ; i < end; i++ {
+		keys = append(keys, z.r.File[i].Name)
+	}
+	if end == len(z.r.File) {
+		return keys, "", nil
+	}
+	return keys, keyset.PositionCursor(int64(end)), nil
+}
+
+// Lookup reads the member for the entry at the given index, checking its CRC.
+func (z *ZipDB) Lookup(index int, valid bool) (string, error) {
+	if z.r == nil {
+		return "", fmt.Errorf("database is not open")
+	}
+	if index < 0 || index >= z.dirsize {
+		return "", fmt.Errorf("index out of bounds")
+	}
+	var filename string
+	switch valid {
+	case true:
+		filename = keyset.GenerateKey(index)
+	case false:
+		filename = keyset.GenerateInvalidKey(index)
+	}
+	f, ok := z.index[filename]
+	if !ok {
+		return "", fmt.Errorf("no row found")
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return "", fmt.Errorf("open member: %w", err)
+	}
+	defer rc.Close()
+	content, err := io.ReadAll(rc)
+	if err != nil {
+		return "", fmt.Errorf("read member: %w", err)
+	}
+	return string(content), nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cdbdb64 "github.com/perbu/db-shootout/cdb64"
+	"github.com/perbu/db-shootout/zipdb"
+)
+
+// archiveBackends compares a zip archive, stored and deflated, with cdb64 as formats
+// for immutable metadata bundles.
+var archiveBackends = []struct {
+	name string
+	new  func(path string) BenchmarkDB
+}{
+	{"Zip/stored", func(path string) BenchmarkDB {
+		return zipdb.New(path, dirsize, zipdb.WithMethod(zipdb.Stored), zipdb.WithDataset(dataset))
+	}},
+	{"Zip/deflated", func(path string) BenchmarkDB {
+		return zipdb.New(path, dirsize, zipdb.WithMethod(zipdb.Deflated), zipdb.WithDataset(dataset))
+	}},
+	{"CDB64", func(path string) BenchmarkDB {
+		return cdbdb64.New(path, dirsize, cdbdb64.WithDataset(dataset))
+	}},
+}
+
+// BenchmarkCreateFolderArchive builds each format and reports the file size.
+func BenchmarkCreateFolderArchive(b *testing.B) {
+	for _, backend := range archiveBackends {
+		b.Run(backend.name, func(b *testing.B) {
+			path := filepath.Join(b.TempDir(), "test.db")
+			db := backend.new(path)
+			for i := 0; i < b.N; i++ {
+				if err := db.CreateFolder(); err != nil {
+					b.Fatalf("create folder: %v", err)
+				}
+			}
+			b.StopTimer()
+			info, err := os.Stat(path)
+			if err != nil {
+				b.Fatalf("stat: %v", err)
+			}
+			b.ReportMetric(float64(info.Size()), "file-bytes")
+			if err := db.Delete(); err != nil {
+				b.Fatalf("delete: %v", err)
+			}
+		})
+	}
+}
+
+func BenchmarkLookupArchive(b *testing.B) {
+	for _, backend := range archiveBackends {
+		b.Run(backend.name, func(b *testing.B) {
+			db := backend.new(filepath.Join(b.TempDir(), "test.db"))
+			if err := db.CreateFolder(); err != nil {
+				b.Fatalf("create folder: %v", err)
+			}
+			if err := db.OpenReadOnly(); err != nil {
+				b.Fatalf("open readonly: %v", err)
+			}
+			defer db.Delete()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Lookup(rand.Intn(dirsize), true); err != nil {
+					b.Fatalf("lookup valid: %v", err)
+				}
+			}
+			b.StopTimer()
+		})
+	}
+}
+
+// BenchmarkOpenReaddirArchive opens the file and lists every entry, which for a zip is
+// reading and indexing the central directory.
+func BenchmarkOpenReaddirArchive(b *testing.B) {
+	for _, backend := range archiveBackends {
+		b.Run(backend.name, func(b *testing.B) {
+			db := backend.new(filepath.Join(b.TempDir(), "test.db"))
+			if err := db.CreateFolder(); err != nil {
+				b.Fatalf("create folder: %v", err)
+			}
+			defer db.Delete()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := db.OpenReadOnly(); err != nil {
+					b.Fatalf("open readonly: %v", err)
+				}
+				for entry := 0; entry < dirsize; entry++ {
+					if _, _, err := db.Next(); err != nil {
+						b.Fatalf("next: %v", err)
+					}
+				}
+				if err := db.Close(); err != nil {
+					b.Fatalf("close: %v", err)
+				}
+			}
+			b.StopTimer()
+		})
+	}
+}
+
+// TestZipDB round-trips the archive with both methods.
+func TestZipDB(t *testing.T) {
+	for _, method := range []zipdb.Method{zipdb.Stored, zipdb.Deflated} {
+		t.Run(method.String(), func(t *testing.T) {
+			db := zipdb.New(filepath.Join(t.TempDir(), "test.zip"), dirsize,
+				zipdb.WithMethod(method), zipdb.WithDataset(dataset))
+			if err := db.CreateFolder(); err != nil {
+				t.Fatalf("create folder: %v", err)
+			}
+			if err := db.OpenReadOnly(); err != nil {
+				t.Fatalf("open readonly: %v", err)
+			}
+			defer db.Delete()
+			for _, i := range []int{0, dirsize / 2, dirsize - 1} {
+				if value, err := db.Lookup(i, true); err != nil || value != dataset.Value(i) {
+					t.Fatalf("lookup %d got %q, %v, want %q", i, value, err, dataset.Value(i))
+				}
+			}
+			if _, err := db.Lookup(0, false); err == nil {
+				t.Fatalf("lookup of an invalid key succeeded")
+			}
+			for i := 0; ; i++ {
+				key, ok, err := db.Next()
+				if err != nil {
+					t.Fatalf("next: %v", err)
+				}
+				if !ok {
+					if i != dirsize {
+						t.Fatalf("listed %d entries, want %d", i, dirsize)
+					}
+					break
+				}
+				// members are written in index order
+				if key != dataset.Key(i) {
+					t.Fatalf("entry %d is %q, want %q", i, key, dataset.Key(i))
+				}
+			}
+		})
+	}
+}